@@ -0,0 +1,133 @@
+package main
+
+import (
+	"counter/store"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+)
+
+// maxBatchSize is the maximum amount of ops in a single batch request
+const maxBatchSize = 100
+
+type batchItem struct {
+	Key   string `json:"key"`
+	Op    string `json:"op"`
+	Value *int   `json:"value"`
+	Token string `json:"token"`
+}
+
+type batchItemResult struct {
+	Key    string `json:"key"`
+	Status int    `json:"status"`
+	Count  *int   `json:"count,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// parseBatchItem turns a batch item into a store op, on failure it returns the status and message for the item
+func parseBatchItem(item *batchItem) (store.Op, int, string) {
+	key, err := normalizeKey(item.Key)
+	if err != nil {
+		return store.Op{}, http.StatusBadRequest, fmt.Sprintf("Invalid key: %v", err)
+	}
+
+	op := store.Op{Key: key, Kind: store.OpKind(item.Op), Amount: 1}
+	switch op.Kind {
+	case store.OpIncrement, store.OpDecrement:
+		if item.Value != nil {
+			op.Amount = *item.Value
+		}
+	case store.OpSet:
+		if item.Value == nil {
+			return store.Op{}, http.StatusBadRequest, "Missing value"
+		}
+		op.Amount = *item.Value
+	default:
+		return store.Op{}, http.StatusBadRequest, fmt.Sprintf("Invalid op: %v", item.Op)
+	}
+
+	if op.AccessKey, err = uuid.Parse(item.Token); err != nil || op.AccessKey == uuid.Nil {
+		return store.Op{}, http.StatusUnauthorized, "Invalid access token"
+	}
+
+	return op, http.StatusOK, ""
+}
+
+func batchErrorStatus(err error) int {
+	switch err {
+	case store.ErrNotFound:
+		return http.StatusNotFound
+	case store.ErrWrongAccessKey:
+		return http.StatusUnauthorized
+	case store.ErrAborted:
+		return http.StatusFailedDependency
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Batch applies a JSON array of ops to multiple counters and returns the status of every op.
+// With ?atomic=true either all ops are applied or none of them.
+func (rs *Routes) Batch(w http.ResponseWriter, r *http.Request) {
+	atomic := r.URL.Query().Get("atomic") == "true"
+	log.Tracef("Batch (atomic: %v)", atomic)
+
+	var items []batchItem
+	if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+		http.Error(w, "Could not decode json", http.StatusBadRequest)
+		return
+	} else if len(items) > maxBatchSize {
+		http.Error(w, fmt.Sprintf("Batch contains more than %v ops", maxBatchSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	results := make([]batchItemResult, len(items))
+	ops := make([]store.Op, 0, len(items))
+	// indices maps the ops to their items, items that are invalid have no op
+	indices := make([]int, 0, len(items))
+	invalid := false
+	for i := range items {
+		results[i].Key = items[i].Key
+		op, status, msg := parseBatchItem(&items[i])
+		if status != http.StatusOK {
+			results[i].Status, results[i].Error = status, msg
+			invalid = true
+			continue
+		}
+		ops = append(ops, op)
+		indices = append(indices, i)
+	}
+
+	if atomic && invalid {
+		for _, i := range indices {
+			results[i].Status, results[i].Error = http.StatusFailedDependency, store.ErrAborted.Error()
+		}
+		ops = nil
+	}
+
+	if len(ops) > 0 {
+		opResults, err := rs.repo.Batch(ops, atomic)
+		if err != nil {
+			log.Errorf("Batch: %v", err)
+			http.Error(w, "Couldn't apply batch in database", http.StatusInternalServerError)
+			return
+		}
+
+		for j, res := range opResults {
+			i := indices[j]
+			results[i].Key = ops[j].Key
+			if res.Err != nil {
+				results[i].Status, results[i].Error = batchErrorStatus(res.Err), res.Err.Error()
+				continue
+			}
+			count := res.Value.Count
+			results[i].Status, results[i].Count = http.StatusOK, &count
+		}
+	}
+
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		log.Error("Batch: writing response failed")
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"counter/store"
+	"errors"
+	"flag"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+)
+
+// commands are the subcommands of the counter binary, without a command the server is started
+var commands = map[string]func(args []string) error{
+	"migrate-diskv": migrateDiskvCommand,
+	"export":        exportCommand,
+	"import":        importCommand,
+}
+
+// runCommand runs the subcommand named by the first argument, it returns false if there is no such command
+func runCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return false
+	}
+
+	if err := cmd(args[1:]); err != nil {
+		log.Fatalf("%v: %v", args[0], err)
+	}
+
+	return true
+}
+
+func migrateDiskvCommand(args []string) error {
+	fs := flag.NewFlagSet("migrate-diskv", flag.ExitOnError)
+	defaultPath := os.Getenv("DISKPATH")
+	if defaultPath == "" {
+		defaultPath = "./data"
+	}
+	path := fs.String("path", defaultPath, "diskv data directory to migrate")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	m, err := store.MigrateDiskv(*path)
+	if err != nil {
+		return err
+	}
+
+	if m.Migrated == 0 {
+		log.Infof("Nothing to migrate in %v", *path)
+		return nil
+	}
+	log.Infof("Migrated %v counters, the old data was kept at %v.legacy", m.Migrated, *path)
+	if m.Ambiguous > 0 {
+		log.Warnf("%v counters had dashes in their keys which were migrated as slashes, they are listed in %v",
+			m.Ambiguous, m.Mapping)
+	}
+	return nil
+}
+
+// openCommandStore opens the configured database for export and import, which would be pointless with a memory
+// database that isn't persisted
+func openCommandStore() (store.Repository, error) {
+	cfg := getConfig()
+	if cfg.DB == dbMemory && cfg.MemoryDir == "" {
+		return nil, errors.New("the memory database only keeps counters with MEMORY_DIR")
+	}
+	return openStore(cfg)
+}
+
+func exportCommand(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	output := fs.String("o", "-", "file to write the counters to, - for stdout")
+	prefix := fs.String("prefix", "", "only export counters whose keys start with this prefix")
+	every := fs.Int("progress", 10000, "log the progress after this many counters, 0 disables it")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	s, err := openCommandStore()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	w := os.Stdout
+	if *output != "-" {
+		if w, err = os.Create(*output); err != nil {
+			return err
+		}
+		defer w.Close()
+	}
+
+	n, err := exportCounters(s, w, *prefix, func(n int) {
+		if *every > 0 && n%*every == 0 {
+			log.Infof("Exported %v counters", n)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed after %v counters: %w", n, err)
+	}
+
+	log.Infof("Exported %v counters", n)
+	if w != os.Stdout {
+		return w.Sync()
+	}
+	return nil
+}
+
+func importCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	input := fs.String("i", "-", "file to read the counters from, - for stdin")
+	existing := fs.String("existing", string(existingSkip), "what to do with counters that already exist: skip, overwrite or fail")
+	dryRun := fs.Bool("dry-run", false, "only check what would be imported without writing anything")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	policy := existingPolicy(*existing)
+	switch policy {
+	case existingSkip, existingOverwrite, existingFail:
+	default:
+		return fmt.Errorf("invalid policy for existing counters: %v", *existing)
+	}
+
+	var r io.Reader = os.Stdin
+	if *input != "-" {
+		f, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	s, err := openCommandStore()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	stats, err := importCounters(s, r, importOptions{
+		Existing: policy,
+		DryRun:   *dryRun,
+		Progress: func(stats importStats) {
+			if *dryRun {
+				log.Infof("Checked %v", stats)
+			} else {
+				log.Infof("Imported %v", stats)
+			}
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed after %v: %w", stats, err)
+	}
+
+	if *dryRun {
+		log.Infof("Dry run, nothing was written: %v", stats)
+	} else {
+		log.Infof("Done: %v", stats)
+	}
+	return nil
+}
@@ -1,24 +1,87 @@
 package main
 
-import log "github.com/sirupsen/logrus"
-import "github.com/caarlos0/env/v6"
+import (
+	"counter/store"
+	"github.com/caarlos0/env/v6"
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+	"go.etcd.io/etcd/clientv3"
+	"time"
+)
 
 type db string
 
 const (
-	dbMemory db = "memory"
-	dbEtcd3  db = "etcd3"
-	dbDisk   db = "disk"
-	dbRedis  db = "redis"
-	dbBadger db = "badger"
-	dbNull   db = "null"
+	dbMemory   db = "memory"
+	dbEtcd3    db = "etcd3"
+	dbDisk     db = "disk"
+	dbRedis    db = "redis"
+	dbBadger   db = "badger"
+	dbSQLite   db = "sqlite"
+	dbPostgres db = "postgres"
+	dbBolt     db = "bolt"
+	dbNull     db = "null"
 )
 
 type config struct {
 	DB       db       `env:"DB"`
 	DBHosts  []string `env:"DBHOST" envSeparator:","`
 	DiskPath string   `env:"DISKPATH"`
+	DSN      string   `env:"DSN"`
 	Address  string   `env:"ADDRESS"`
+
+	EtcdUsername      string `env:"ETCD_USERNAME"`
+	EtcdPassword      string `env:"ETCD_PASSWORD"`
+	EtcdNamespace     string `env:"ETCD_NAMESPACE"`
+	EtcdTLS           bool   `env:"ETCD_TLS"`
+	EtcdTLSCA         string `env:"ETCD_TLS_CA"`
+	EtcdTLSCert       string `env:"ETCD_TLS_CERT"`
+	EtcdTLSKey        string `env:"ETCD_TLS_KEY"`
+	EtcdTLSSkipVerify bool   `env:"ETCD_TLS_SKIP_VERIFY"`
+
+	RedisMasterName       string `env:"REDIS_MASTER_NAME"`
+	RedisCluster          bool   `env:"REDIS_CLUSTER"`
+	RedisPassword         string `env:"REDIS_PASSWORD"`
+	RedisSentinelPassword string `env:"REDIS_SENTINEL_PASSWORD"`
+	RedisDB               int    `env:"REDIS_DB"`
+	RedisHashTag          string `env:"REDIS_HASH_TAG"`
+	RedisTLS              bool   `env:"REDIS_TLS"`
+	RedisTLSCA            string `env:"REDIS_TLS_CA"`
+	RedisTLSCert          string `env:"REDIS_TLS_CERT"`
+	RedisTLSKey           string `env:"REDIS_TLS_KEY"`
+	RedisTLSSkipVerify    bool   `env:"REDIS_TLS_SKIP_VERIFY"`
+
+	MemoryDir              string            `env:"MEMORY_DIR"`
+	MemoryFsync            store.FsyncPolicy `env:"MEMORY_FSYNC" envDefault:"interval"`
+	MemoryFsyncInterval    time.Duration     `env:"MEMORY_FSYNC_INTERVAL" envDefault:"1s"`
+	MemorySnapshotInterval time.Duration     `env:"MEMORY_SNAPSHOT_INTERVAL" envDefault:"10m"`
+
+	CacheSize  int           `env:"CACHE_SIZE"`
+	CacheTTL   time.Duration `env:"CACHE_TTL" envDefault:"5s"`
+	CacheWatch bool          `env:"CACHE_WATCH" envDefault:"true"`
+
+	CoalesceInterval time.Duration `env:"COALESCE_INTERVAL"`
+	CoalesceMaxKeys  int           `env:"COALESCE_MAX_KEYS" envDefault:"10000"`
+
+	IdempotencyWindow time.Duration `env:"IDEMPOTENCY_WINDOW" envDefault:"24h"`
+	PutCreate         bool          `env:"PUT_CREATE"`
+
+	CORSOrigins []string      `env:"CORS_ORIGINS" envSeparator:","`
+	CORSMethods []string      `env:"CORS_METHODS" envSeparator:"," envDefault:"GET,HEAD,POST,PUT,PATCH,DELETE,OPTIONS"`
+	CORSHeaders []string      `env:"CORS_HEADERS" envSeparator:"," envDefault:"Authorization,Content-Type,If-Match,If-None-Match,Idempotency-Key"`
+	CORSMaxAge  time.Duration `env:"CORS_MAX_AGE" envDefault:"10m"`
+
+	WebhookAttempts     int           `env:"WEBHOOK_ATTEMPTS" envDefault:"5"`
+	WebhookBackoff      time.Duration `env:"WEBHOOK_BACKOFF" envDefault:"1s"`
+	WebhookMaxBackoff   time.Duration `env:"WEBHOOK_MAX_BACKOFF" envDefault:"5m"`
+	WebhookTimeout      time.Duration `env:"WEBHOOK_TIMEOUT" envDefault:"10s"`
+	WebhookDeadLetters  string        `env:"WEBHOOK_DEAD_LETTERS"`
+	WebhookAllowPrivate bool          `env:"WEBHOOK_ALLOW_PRIVATE"`
+
+	MetricsCounterPrefix string `env:"METRICS_COUNTER_PREFIX"`
+
+	ShutdownDelay   time.Duration `env:"SHUTDOWN_DELAY" envDefault:"5s"`
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT" envDefault:"15s"`
 }
 
 func getConfig() (cfg config) {
@@ -38,6 +101,16 @@ func getConfig() (cfg config) {
 		cfg.DiskPath = "./data"
 	}
 
+	if cfg.DB == dbSQLite && cfg.DiskPath == "" {
+		log.Warn("Defaulting to ./counter.db file for sqlite storage")
+		cfg.DiskPath = "./counter.db"
+	}
+
+	if cfg.DB == dbBolt && cfg.DiskPath == "" {
+		log.Warn("Defaulting to ./counter.bolt file for bolt storage")
+		cfg.DiskPath = "./counter.bolt"
+	}
+
 	if cfg.DB == dbNull {
 		log.Warn("Are you sure?")
 	}
@@ -46,6 +119,19 @@ func getConfig() (cfg config) {
 		log.Fatalf("No database host(s) specified but was required")
 	}
 
+	if cfg.DB == dbRedis && cfg.RedisMasterName == "" && (cfg.RedisCluster || len(cfg.DBHosts) > 1) {
+		if cfg.RedisDB != 0 {
+			log.Warn("Ignoring REDIS_DB as Redis Cluster only has database 0")
+		}
+		if cfg.RedisHashTag == "" {
+			log.Info("Defaulting to {counter} hash tag for Redis Cluster")
+		}
+	}
+
+	if cfg.DSN == "" && cfg.DB == dbPostgres {
+		log.Fatalf("No database DSN specified but was required")
+	}
+
 	if cfg.Address == "" {
 		log.Info("Defaulting to :8080 address")
 		cfg.Address = ":8080"
@@ -53,3 +139,53 @@ func getConfig() (cfg config) {
 
 	return
 }
+
+// etcdOptions returns the options of the etcd store, TLS is used if enabled or if any TLS file is configured
+func (cfg *config) etcdOptions() (store.EtcdOptions, error) {
+	opts := store.EtcdOptions{
+		Config: clientv3.Config{
+			Endpoints:   cfg.DBHosts,
+			DialTimeout: 5 * time.Second,
+			Username:    cfg.EtcdUsername,
+			Password:    cfg.EtcdPassword,
+		},
+		Namespace: cfg.EtcdNamespace,
+	}
+
+	if cfg.EtcdTLS || cfg.EtcdTLSCA != "" || cfg.EtcdTLSCert != "" || cfg.EtcdTLSKey != "" {
+		tlsConfig, err := clientTLSConfig(cfg.EtcdTLSCA, cfg.EtcdTLSCert, cfg.EtcdTLSKey, cfg.EtcdTLSSkipVerify)
+		if err != nil {
+			return store.EtcdOptions{}, err
+		}
+		opts.Config.TLS = tlsConfig
+	}
+
+	return opts, nil
+}
+
+// redisOptions returns the options of the redis store, TLS is used if enabled or if any TLS file is configured
+func (cfg *config) redisOptions() (store.RedisOptions, error) {
+	opts := store.RedisOptions{
+		Client: redis.UniversalOptions{
+			Addrs:            cfg.DBHosts,
+			MasterName:       cfg.RedisMasterName,
+			Password:         cfg.RedisPassword,
+			SentinelPassword: cfg.RedisSentinelPassword,
+			DB:               cfg.RedisDB,
+			MaxRetries:       5,
+			DialTimeout:      5 * time.Second,
+		},
+		Cluster: cfg.RedisCluster,
+		HashTag: cfg.RedisHashTag,
+	}
+
+	if cfg.RedisTLS || cfg.RedisTLSCA != "" || cfg.RedisTLSCert != "" || cfg.RedisTLSKey != "" {
+		tlsConfig, err := clientTLSConfig(cfg.RedisTLSCA, cfg.RedisTLSCert, cfg.RedisTLSKey, cfg.RedisTLSSkipVerify)
+		if err != nil {
+			return store.RedisOptions{}, err
+		}
+		opts.Client.TLSConfig = tlsConfig
+	}
+
+	return opts, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// allowedMethods are the methods supported on counters
+var allowedMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+	http.MethodOptions,
+}
+
+// exposedHeaders are the response headers readable by cross-origin scripts, the Authorization header
+// contains the access key of a newly created counter
+var exposedHeaders = []string{"Authorization", "ETag", countHeader, "Idempotent-Replayed"}
+
+// corsOptions configures the CORS middleware
+type corsOptions struct {
+	// AllowedOrigins are the origins allowed to make cross-origin requests, "*" allows any origin.
+	// When empty CORS is disabled.
+	AllowedOrigins []string
+	// AllowedMethods are the methods allowed in cross-origin requests
+	AllowedMethods []string
+	// AllowedHeaders are the request headers allowed in cross-origin requests
+	AllowedHeaders []string
+	// MaxAge is how long the result of a preflight request may be cached
+	MaxAge time.Duration
+}
+
+func (o *corsOptions) originAllowed(origin string) bool {
+	for _, allowed := range o.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// corsMiddleware adds CORS headers to responses for allowed origins and answers preflight requests
+func corsMiddleware(opts corsOptions) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" || !opts.originAllowed(origin) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			h := w.Header()
+			h.Add("Vary", "Origin")
+			h.Set("Access-Control-Allow-Origin", origin)
+			h.Set("Access-Control-Expose-Headers", strings.Join(exposedHeaders, ", "))
+
+			if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Preflight request
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+			h.Set("Access-Control-Allow-Methods", strings.Join(opts.AllowedMethods, ", "))
+			h.Set("Access-Control-Allow-Headers", strings.Join(opts.AllowedHeaders, ", "))
+			if opts.MaxAge > 0 {
+				h.Set("Access-Control-Max-Age", strconv.Itoa(int(opts.MaxAge/time.Second)))
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
+
+// optionsHandler answers OPTIONS requests that aren't CORS preflights with the supported methods
+func optionsHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Allow", strings.Join(allowedMethods, ", "))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var testCorsOptions = corsOptions{
+	AllowedOrigins: []string{"https://example.com"},
+	AllowedMethods: []string{http.MethodGet, http.MethodPatch},
+	AllowedHeaders: []string{"Authorization", "Content-Type"},
+	MaxAge:         time.Minute,
+}
+
+func TestCorsMiddleware_Preflight(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("preflight should not reach the handler")
+	})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodOptions, "/yeet", nil)
+	r.Header.Set("Origin", "https://example.com")
+	r.Header.Set("Access-Control-Request-Method", http.MethodPatch)
+
+	corsMiddleware(testCorsOptions)(next).ServeHTTP(w, r)
+
+	res := w.Result()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	assert.Equal(t, "https://example.com", res.Header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "GET, PATCH", res.Header.Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "Authorization, Content-Type", res.Header.Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "60", res.Header.Get("Access-Control-Max-Age"))
+}
+
+func TestCorsMiddleware_ExposesHeaders(t *testing.T) {
+	called := false
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/yeet", nil)
+	r.Header.Set("Origin", "https://example.com")
+
+	corsMiddleware(testCorsOptions)(next).ServeHTTP(w, r)
+
+	res := w.Result()
+	assert.True(t, called)
+	assert.Equal(t, "https://example.com", res.Header.Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, res.Header.Get("Access-Control-Expose-Headers"), "Authorization")
+	assert.Contains(t, res.Header.Get("Access-Control-Expose-Headers"), countHeader)
+}
+
+func TestCorsMiddleware_DisallowedOrigin(t *testing.T) {
+	called := false
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/yeet", nil)
+	r.Header.Set("Origin", "https://evil.com")
+
+	corsMiddleware(testCorsOptions)(next).ServeHTTP(w, r)
+
+	assert.True(t, called)
+	assert.Empty(t, w.Result().Header.Get("Access-Control-Allow-Origin"))
+}
+
+func TestCorsMiddleware_Wildcard(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/yeet", nil)
+	r.Header.Set("Origin", "https://anything.com")
+
+	corsMiddleware(corsOptions{AllowedOrigins: []string{"*"}})(next).ServeHTTP(w, r)
+
+	assert.Equal(t, "https://anything.com", w.Result().Header.Get("Access-Control-Allow-Origin"))
+}
+
+func TestOptionsHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodOptions, "/yeet", nil)
+
+	optionsHandler(w, r)
+
+	res := w.Result()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	assert.Contains(t, res.Header.Get("Allow"), http.MethodHead)
+}
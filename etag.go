@@ -0,0 +1,50 @@
+package main
+
+import (
+	"counter/store"
+	"strconv"
+	"strings"
+)
+
+// etag formats the version of a counter as a strong entity tag
+func etag(v *store.Value) string {
+	return `"` + strconv.FormatUint(v.Version, 10) + `"`
+}
+
+// etagMatches reports whether a comma separated If-Match or If-None-Match header matches the counter.
+// Weak tags are compared like strong ones, as versions always identify the exact value.
+func etagMatches(header string, v *store.Value) bool {
+	tag := etag(v)
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ifMatchVersions parses an If-Match header into the versions a counter may have, so the store can check it while
+// applying an op. It returns nil if any version matches, unparseable tags are mapped to version 0 which no
+// stored counter has.
+func ifMatchVersions(header string) []uint64 {
+	if header == "" {
+		return nil
+	}
+
+	var versions []uint64
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" {
+			return nil
+		}
+		var version uint64
+		if len(candidate) > 2 && strings.HasPrefix(candidate, `"`) && strings.HasSuffix(candidate, `"`) {
+			version, _ = strconv.ParseUint(candidate[1:len(candidate)-1], 10, 64)
+		}
+		versions = append(versions, version)
+	}
+
+	return versions
+}
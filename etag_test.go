@@ -0,0 +1,33 @@
+package main
+
+import (
+	"counter/store"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestEtagMatches(t *testing.T) {
+	v := store.Value{Version: 42}
+
+	assert.Equal(t, `"42"`, etag(&v))
+
+	assert.True(t, etagMatches(`"42"`, &v))
+	assert.True(t, etagMatches(`W/"42"`, &v))
+	assert.True(t, etagMatches(`"1", "42"`, &v))
+	assert.True(t, etagMatches(`*`, &v))
+
+	assert.False(t, etagMatches(`"41"`, &v))
+	assert.False(t, etagMatches(`42`, &v))
+	assert.False(t, etagMatches(`"1", "2"`, &v))
+}
+
+func TestIfMatchVersions(t *testing.T) {
+	assert.Nil(t, ifMatchVersions(``))
+	assert.Nil(t, ifMatchVersions(`*`))
+	assert.Nil(t, ifMatchVersions(`"1", *`))
+
+	assert.Equal(t, []uint64{42}, ifMatchVersions(`"42"`))
+	assert.Equal(t, []uint64{1, 42}, ifMatchVersions(`"1", W/"42"`))
+	// Tags that aren't versions never match
+	assert.Equal(t, []uint64{0, 0}, ifMatchVersions(`42, "abc"`))
+}
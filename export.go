@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"counter/store"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"strings"
+	"time"
+)
+
+// exportRecord is a single line of an export. The version is informational, stores assign their own on import.
+type exportRecord struct {
+	Key       string    `json:"key"`
+	Count     int       `json:"count"`
+	AccessKey uuid.UUID `json:"access_key"`
+	Version   uint64    `json:"version,omitempty"`
+	Expires   int64     `json:"expires,omitempty"`
+	// Data is the payload of reserved records like webhook registrations
+	Data string `json:"data,omitempty"`
+}
+
+// expired reports whether the record has an expiry time which has passed
+func (rec *exportRecord) expired() bool {
+	return rec.Expires != 0 && time.Now().Unix() >= rec.Expires
+}
+
+// exportCounters writes all counters below prefix as JSON Lines, including reserved records like webhook
+// registrations. Idempotency records and webhook claims are skipped, they only matter to retries of requests made to
+// and events of the old database.
+// progress is called with the amount of exported counters after every one.
+func exportCounters(s store.Repository, w io.Writer, prefix string, progress func(n int)) (int, error) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	n := 0
+	err := s.Scan(prefix, func(key string, value store.Value) error {
+		rec := exportRecord{
+			Key:       key,
+			Count:     value.Count,
+			AccessKey: value.AccessKey,
+			Version:   value.Version,
+			Expires:   value.Expires,
+			Data:      value.Data,
+		}
+		if rec.expired() || strings.HasPrefix(key, idempotencyPrefix) || strings.HasPrefix(key, webhookClaimPrefix) {
+			return nil
+		}
+		if err := enc.Encode(&rec); err != nil {
+			return err
+		}
+		n++
+		progress(n)
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+
+	return n, bw.Flush()
+}
+
+// existingPolicy decides what happens when an imported counter already exists
+type existingPolicy string
+
+const (
+	// existingSkip keeps the existing counter
+	existingSkip existingPolicy = "skip"
+	// existingOverwrite replaces the existing counter
+	existingOverwrite existingPolicy = "overwrite"
+	// existingFail stops the import
+	existingFail existingPolicy = "fail"
+)
+
+// importChunkSize is the amount of records that are checked for existing counters at once
+const importChunkSize = 1000
+
+type importOptions struct {
+	// Existing is what happens with counters that already exist
+	Existing existingPolicy
+	// DryRun only reads and checks the records without writing anything
+	DryRun bool
+	// Progress is called with the statistics after every chunk of records
+	Progress func(stats importStats)
+}
+
+// importStats are the outcomes of the imported records, with DryRun what would have happened
+type importStats struct {
+	Read        int
+	Created     int
+	Overwritten int
+	Skipped     int
+	Expired     int
+}
+
+func (stats importStats) String() string {
+	return fmt.Sprintf("%v read, %v created, %v overwritten, %v skipped as they exist, %v skipped as they expired",
+		stats.Read, stats.Created, stats.Overwritten, stats.Skipped, stats.Expired)
+}
+
+// errCounterExists is returned by importCounters for existing counters with existingFail
+var errCounterExists = errors.New("counter already exists")
+
+// importCounters reads counters written by exportCounters and creates them in s. Records are read and checked
+// in chunks, a record that can't be read stops the import, the counters of the previous chunks are kept.
+func importCounters(s store.Repository, r io.Reader, opts importOptions) (importStats, error) {
+	var stats importStats
+	scanner := bufio.NewScanner(r)
+
+	line := 0
+	var chunk []exportRecord
+	for {
+		more := scanner.Scan()
+		if more {
+			line++
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" {
+				continue
+			}
+
+			var rec exportRecord
+			if err := json.Unmarshal([]byte(text), &rec); err != nil {
+				return stats, fmt.Errorf("line %v: %w", line, err)
+			} else if !strings.HasPrefix(rec.Key, "/") {
+				return stats, fmt.Errorf("line %v: invalid key %q", line, rec.Key)
+			} else if rec.AccessKey == uuid.Nil {
+				return stats, fmt.Errorf("line %v: missing access key of %v", line, rec.Key)
+			}
+			stats.Read++
+			if rec.expired() {
+				stats.Expired++
+				continue
+			}
+			chunk = append(chunk, rec)
+		}
+
+		if len(chunk) >= importChunkSize || (!more && len(chunk) > 0) {
+			if err := importChunk(s, chunk, opts, &stats); err != nil {
+				return stats, err
+			}
+			chunk = chunk[:0]
+			if opts.Progress != nil {
+				opts.Progress(stats)
+			}
+		}
+
+		if !more {
+			return stats, scanner.Err()
+		}
+	}
+}
+
+// importChunk creates the counters of a chunk of records according to the policy for existing ones
+func importChunk(s store.Repository, chunk []exportRecord, opts importOptions, stats *importStats) error {
+	keys := make([]string, len(chunk))
+	for i, rec := range chunk {
+		keys[i] = rec.Key
+	}
+	existing, err := s.GetMany(keys)
+	if err != nil {
+		return err
+	}
+
+	// Nothing of the chunk is written if it would fail
+	if opts.Existing == existingFail {
+		for i, rec := range chunk {
+			if existing[i].AccessKey != uuid.Nil {
+				return fmt.Errorf("%w: %v", errCounterExists, rec.Key)
+			}
+		}
+	}
+
+	for i, rec := range chunk {
+		exists := existing[i].AccessKey != uuid.Nil
+		if exists && opts.Existing == existingSkip {
+			stats.Skipped++
+			continue
+		}
+
+		if !opts.DryRun {
+			err := s.Create(rec.Key, store.Value{Count: rec.Count, AccessKey: rec.AccessKey, Expires: rec.Expires, Data: rec.Data})
+			if err != nil {
+				return fmt.Errorf("failed to create %v: %w", rec.Key, err)
+			}
+		}
+		if exists {
+			stats.Overwritten++
+		} else {
+			stats.Created++
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"counter/store"
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportImport(t *testing.T) {
+	from := store.NewMemoryStore()
+	a, b := uuid.New(), uuid.New()
+	expires := time.Now().Add(time.Hour).Unix()
+	assert.NoError(t, from.Create("/a", store.Value{Count: 1, AccessKey: a}))
+	assert.NoError(t, from.Create("/b/c", store.Value{Count: -2, AccessKey: b, Expires: expires}))
+	assert.NoError(t, from.Create(idempotencyRecordKey("/a", a, "retry-me"), store.Value{Count: 1, AccessKey: a, Expires: expires}))
+	claim := store.Event{Key: "/a", Value: store.Value{Count: 1, AccessKey: a, Version: 1}}
+	assert.NoError(t, from.Create(webhookClaimKey(&claim), store.Value{AccessKey: a, Expires: expires}))
+	hook := webhook{URL: "https://example.com/hook", Events: []string{webhookChange}, Secret: "hunter2"}
+	assert.NoError(t, NewWebhooks(from, WebhookOptions{}).register("/a", &hook))
+
+	var buf bytes.Buffer
+	var progress []int
+	n, err := exportCounters(from, &buf, "", func(n int) {
+		progress = append(progress, n)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, []int{1, 2, 3}, progress)
+
+	// Every counter is a line of JSON
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 3)
+	records := make(map[string]exportRecord)
+	for _, line := range lines {
+		var rec exportRecord
+		assert.NoError(t, json.Unmarshal([]byte(line), &rec))
+		records[rec.Key] = rec
+	}
+	assert.Equal(t, exportRecord{Key: "/a", Count: 1, AccessKey: a, Version: 1}, records["/a"])
+	// Without the idempotency records and webhook claims
+	assert.NotContains(t, records, idempotencyRecordKey("/a", a, "retry-me"))
+	assert.NotContains(t, records, webhookClaimKey(&claim))
+
+	to := store.NewMemoryStore()
+	stats, err := importCounters(to, &buf, importOptions{Existing: existingSkip})
+	assert.NoError(t, err)
+	assert.Equal(t, importStats{Read: 3, Created: 3}, stats)
+
+	v, err := to.Get("/a")
+	assert.NoError(t, err)
+	assert.Equal(t, store.Value{Count: 1, AccessKey: a, Version: 1}, v)
+	v, err = to.Get("/b/c")
+	assert.NoError(t, err)
+	assert.Equal(t, store.Value{Count: -2, AccessKey: b, Version: 1, Expires: expires}, v)
+
+	// Including the webhook registrations
+	hooks, err := NewWebhooks(to, WebhookOptions{}).list("/a")
+	assert.NoError(t, err)
+	hook.Secret = ""
+	assert.Equal(t, []webhook{hook}, hooks)
+
+	// Exports can be limited to a prefix
+	buf.Reset()
+	n, err = exportCounters(from, &buf, "/b", func(int) {})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
+
+func TestImport_Existing(t *testing.T) {
+	a, b := uuid.New(), uuid.New()
+	input := `{"key": "/a", "count": 5, "access_key": "` + a.String() + `"}
+
+{"key": "/b", "count": 6, "access_key": "` + b.String() + `"}
+{"key": "/c", "count": 7, "access_key": "` + b.String() + `", "expires": 1}
+`
+	existing := store.Value{Count: 1, AccessKey: uuid.New()}
+	stored := store.Value{Count: 1, AccessKey: existing.AccessKey, Version: 1}
+
+	for _, tc := range []struct {
+		policy existingPolicy
+		dryRun bool
+		stats  importStats
+		err    error
+		a      store.Value
+		b      store.Value
+	}{
+		{policy: existingSkip, stats: importStats{Read: 3, Created: 1, Skipped: 1, Expired: 1},
+			a: stored, b: store.Value{Count: 6, AccessKey: b, Version: 1}},
+		{policy: existingOverwrite, stats: importStats{Read: 3, Created: 1, Overwritten: 1, Expired: 1},
+			a: store.Value{Count: 5, AccessKey: a, Version: 2}, b: store.Value{Count: 6, AccessKey: b, Version: 1}},
+		{policy: existingOverwrite, dryRun: true, stats: importStats{Read: 3, Created: 1, Overwritten: 1, Expired: 1},
+			a: stored},
+		// Nothing of the chunk is written if a counter exists
+		{policy: existingFail, stats: importStats{Read: 3, Expired: 1}, err: errCounterExists, a: stored},
+	} {
+		s := store.NewMemoryStore()
+		assert.NoError(t, s.Create("/a", existing))
+
+		stats, err := importCounters(s, strings.NewReader(input), importOptions{Existing: tc.policy, DryRun: tc.dryRun})
+		assert.True(t, errors.Is(err, tc.err), "%v: %v", tc.policy, err)
+		assert.Equal(t, tc.stats, stats, tc.policy)
+
+		v, err := s.Get("/a")
+		assert.NoError(t, err)
+		assert.Equal(t, tc.a, v, tc.policy)
+		v, err = s.Get("/b")
+		assert.NoError(t, err)
+		assert.Equal(t, tc.b, v, tc.policy)
+		v, err = s.Get("/c")
+		assert.NoError(t, err)
+		assert.Equal(t, store.Value{}, v, tc.policy)
+	}
+}
+
+func TestImport_Invalid(t *testing.T) {
+	for _, input := range []string{
+		`not json`,
+		`{"key": "a", "count": 1, "access_key": "` + uuid.New().String() + `"}`,
+		`{"key": "/a", "count": 1}`,
+	} {
+		s := store.NewMemoryStore()
+		_, err := importCounters(s, strings.NewReader(`{"key": "/ok", "access_key": "`+uuid.New().String()+`"}`+"\n"+input),
+			importOptions{Existing: existingSkip})
+		assert.Error(t, err, input)
+		assert.Contains(t, err.Error(), "line 2", input)
+	}
+}
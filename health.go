@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"counter/store"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+// readyTimeout is how long the database gets to answer a readiness probe
+const readyTimeout = 2 * time.Second
+
+type healthResponse struct {
+	Status   string          `json:"status"`
+	Database *databaseHealth `json:"database,omitempty"`
+}
+
+type databaseHealth struct {
+	Status  string `json:"status"`
+	Latency string `json:"latency"`
+	Error   string `json:"error,omitempty"`
+}
+
+func writeHealth(w http.ResponseWriter, code int, resp healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Error("Health: writing response failed")
+	}
+}
+
+// Healthz reports that the process is alive, it doesn't touch the database
+func (rs *Routes) Healthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+// Readyz pings the database and reports whether requests can currently be served.
+// Stores that can't be pinged are always ready, unless the server is shutting down.
+func (rs *Routes) Readyz(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-rs.draining:
+		writeHealth(w, http.StatusServiceUnavailable, healthResponse{Status: "shutting down"})
+		return
+	default:
+	}
+
+	pinger, ok := rs.repo.(store.Pinger)
+	if !ok {
+		writeHealth(w, http.StatusOK, healthResponse{Status: "ok"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := pinger.Ping(ctx)
+	db := &databaseHealth{Status: "ok", Latency: time.Since(start).String()}
+	if err != nil {
+		log.Warnf("Readyz: pinging the database failed: %v", err)
+		db.Status, db.Error = "unavailable", err.Error()
+		writeHealth(w, http.StatusServiceUnavailable, healthResponse{Status: "unavailable", Database: db})
+		return
+	}
+
+	writeHealth(w, http.StatusOK, healthResponse{Status: "ok", Database: db})
+}
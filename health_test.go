@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"counter/store"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// pingStore is a store whose pings fail with err
+type pingStore struct {
+	store.Repository
+	err error
+}
+
+func (s *pingStore) Ping(ctx context.Context) error {
+	return s.err
+}
+
+func readyz(rs Routes) (*httptest.ResponseRecorder, healthResponse) {
+	w := httptest.NewRecorder()
+	rs.Readyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	var resp healthResponse
+	_ = json.NewDecoder(w.Body).Decode(&resp)
+	return w, resp
+}
+
+func TestRoutes_Healthz(t *testing.T) {
+	rs := NewRoutes(&pingStore{store.NewMemoryStore(), errors.New("connection refused")})
+
+	w := httptest.NewRecorder()
+	rs.Healthz(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status": "ok"}`, w.Body.String())
+}
+
+func TestRoutes_Readyz(t *testing.T) {
+	w, resp := readyz(NewRoutes(&pingStore{Repository: store.NewMemoryStore()}))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "ok", resp.Status)
+	assert.Equal(t, "ok", resp.Database.Status)
+	assert.NotEmpty(t, resp.Database.Latency)
+	assert.Empty(t, resp.Database.Error)
+
+	w, resp = readyz(NewRoutes(&pingStore{store.NewMemoryStore(), errors.New("connection refused")}))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "unavailable", resp.Status)
+	assert.Equal(t, "unavailable", resp.Database.Status)
+	assert.Equal(t, "connection refused", resp.Database.Error)
+
+	// Stores that can't be pinged are always ready
+	w, resp = readyz(NewRoutes(store.NewNullStore()))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "ok", resp.Status)
+	assert.Nil(t, resp.Database)
+
+	// Unless the server is shutting down
+	draining := make(chan struct{})
+	close(draining)
+	w, resp = readyz(NewRoutesWithOptions(&pingStore{Repository: store.NewMemoryStore()}, RoutesOptions{Draining: draining}))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "shutting down", resp.Status)
+	assert.Nil(t, resp.Database)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"counter/store"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// idempotencyHeader is the request header clients use to make retries of a PATCH safe
+const idempotencyHeader = "Idempotency-Key"
+
+// maxIdempotencyKeyLength is the maximum accepted length of an idempotency key
+const maxIdempotencyKeyLength = 255
+
+// defaultIdempotencyWindow is how long the result of an idempotent request is remembered by default
+const defaultIdempotencyWindow = 24 * time.Hour
+
+// idempotencyPrefix is the prefix of the store keys of idempotency records
+const idempotencyPrefix = reservedPrefix + "idempotency/"
+
+// idempotencyNamespace is the namespace of the request identifiers stored as access keys of idempotency records
+var idempotencyNamespace = uuid.NewSHA1(uuid.NameSpaceURL, []byte("counter/idempotency"))
+
+// idempotencyRecordKey returns the store key of the dedupe record for an idempotency key on a counter.
+// Records live in the reserved namespace so they can never collide with a counter. They are bound to the access key
+// of the request, so they don't survive recreating the counter and requests with another token never see them.
+func idempotencyRecordKey(key string, accessKey uuid.UUID, idempotencyKey string) string {
+	sum := sha256.Sum256([]byte(key + "\n" + accessKey.String() + "\n" + idempotencyKey))
+	return idempotencyPrefix + hex.EncodeToString(sum[:])
+}
+
+// idempotencyRequest identifies the request a record was made for in its access key, a record that is still
+// reserved by a request being processed has another identifier than the finished one
+func idempotencyRequest(method, op string, pending bool) uuid.UUID {
+	state := "done"
+	if pending {
+		state = "pending"
+	}
+	return uuid.NewSHA1(idempotencyNamespace, []byte(method+" "+op+" "+state))
+}
+
+// idempotencyOutcome is what reserving an idempotency record found
+type idempotencyOutcome int
+
+const (
+	// idempotencyReserved means the record was created, the request has to be processed and recorded
+	idempotencyReserved idempotencyOutcome = iota
+	// idempotencyReplay means an earlier request with the same key and op finished, its count can be replayed
+	idempotencyReplay
+	// idempotencyInProgress means an earlier request with the same key and op hasn't finished yet
+	idempotencyInProgress
+	// idempotencyMismatch means the key was used for another op before
+	idempotencyMismatch
+)
+
+// idempotencyRecord is the dedupe record of a single request with an idempotency key
+type idempotencyRecord struct {
+	key     string
+	method  string
+	op      string
+	expires int64
+	// outcome is what reserving the record found
+	outcome idempotencyOutcome
+	// count is the resulting count of the earlier request with idempotencyReplay
+	count int
+}
+
+// reserveIdempotent atomically creates the pending record of a request. If a record exists already, its outcome
+// tells how to respond to the retry.
+func (rs *Routes) reserveIdempotent(key string, accessKey uuid.UUID, idempotencyKey, method, op string) (
+	idempotencyRecord, error) {
+	rec := idempotencyRecord{
+		key:     idempotencyRecordKey(key, accessKey, idempotencyKey),
+		method:  method,
+		op:      op,
+		expires: time.Now().Add(rs.idempotencyWindow).Unix(),
+	}
+
+	_, err := rs.repo.Apply(store.Op{
+		Key:       rec.key,
+		Kind:      store.OpCreate,
+		AccessKey: idempotencyRequest(method, op, true),
+		Expires:   rec.expires,
+	})
+	if err == nil {
+		rec.outcome = idempotencyReserved
+		return rec, nil
+	} else if err != store.ErrExists {
+		return rec, err
+	}
+
+	existing, err := rs.repo.Get(rec.key)
+	if err != nil {
+		return rec, err
+	}
+	switch existing.AccessKey {
+	case idempotencyRequest(method, op, false):
+		rec.outcome, rec.count = idempotencyReplay, existing.Count
+	case idempotencyRequest(method, op, true), uuid.Nil:
+		// A record that is gone again was released by a failed request, which can be retried
+		rec.outcome = idempotencyInProgress
+	default:
+		rec.outcome = idempotencyMismatch
+	}
+	return rec, nil
+}
+
+// finishIdempotent records the resulting count of the request, replacing the pending record
+func (rs *Routes) finishIdempotent(rec *idempotencyRecord, count int) {
+	err := rs.repo.Create(rec.key, store.Value{
+		Count:     count,
+		AccessKey: idempotencyRequest(rec.method, rec.op, false),
+		Expires:   rec.expires,
+	})
+	if err != nil {
+		log.Errorf("Recording idempotency key failed, retries are refused until it expires: %v", err)
+	}
+}
+
+// releaseIdempotent deletes the pending record of a request that failed, so it can be retried
+func (rs *Routes) releaseIdempotent(rec *idempotencyRecord) {
+	_, err := rs.repo.Apply(store.Op{
+		Key:       rec.key,
+		Kind:      store.OpDelete,
+		AccessKey: idempotencyRequest(rec.method, rec.op, true),
+	})
+	if err != nil && err != store.ErrNotFound {
+		log.Errorf("Releasing idempotency key failed, retries are refused until it expires: %v", err)
+	}
+}
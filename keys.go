@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// maxKeyLength is the maximum length of a normalized counter key
+const maxKeyLength = 256
+
+// reservedPrefix is the path prefix reserved for service endpoints, no counters can be created below it
+const reservedPrefix = "/_"
+
+// reservedKeys are well known paths that are requested by browsers and tooling and should never become counters
+var reservedKeys = map[string]bool{
+	"/favicon.ico": true,
+	"/robots.txt":  true,
+	"/metrics":     true,
+	"/healthz":     true,
+	"/readyz":      true,
+}
+
+var (
+	errKeyEmpty    = errors.New("key is empty")
+	errKeyTooLong  = fmt.Errorf("key is longer than %v characters", maxKeyLength)
+	errKeyReserved = errors.New("key is reserved")
+	errKeyDotPath  = errors.New("key may not contain . or .. segments")
+)
+
+func isKeyChar(c rune) bool {
+	return c >= 'a' && c <= 'z' ||
+		c >= 'A' && c <= 'Z' ||
+		c >= '0' && c <= '9' ||
+		strings.ContainsRune("/-._~", c)
+}
+
+// normalizeKey turns a request path (without query string) into a counter key.
+// Duplicate and trailing slashes are collapsed and the result is validated against
+// the allowed length, charset and the reserved namespace.
+func normalizeKey(path string) (string, error) {
+	var b strings.Builder
+	b.WriteByte('/')
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "" {
+			continue
+		}
+		if segment == "." || segment == ".." {
+			return "", errKeyDotPath
+		}
+		if b.Len() > 1 {
+			b.WriteByte('/')
+		}
+		b.WriteString(segment)
+	}
+	key := b.String()
+
+	if key == "/" {
+		return "", errKeyEmpty
+	}
+	if len(key) > maxKeyLength {
+		return "", errKeyTooLong
+	}
+	for _, c := range key {
+		if !isKeyChar(c) {
+			return "", fmt.Errorf("key contains invalid character %q", c)
+		}
+	}
+	if strings.HasPrefix(key, reservedPrefix) || reservedKeys[key] {
+		return "", errKeyReserved
+	}
+
+	return key, nil
+}
+
+// counterKey returns the normalized key of a request, if the key is invalid it writes a 400 and returns false
+func counterKey(w http.ResponseWriter, r *http.Request) (string, bool) {
+	key, err := normalizeKey(r.URL.Path)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid key: %v", err), http.StatusBadRequest)
+		return "", false
+	}
+
+	return key, true
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeKey(t *testing.T) {
+	valid := map[string]string{
+		"/yeet":           "/yeet",
+		"/some/path":      "/some/path",
+		"//some//path//":  "/some/path",
+		"some/path":       "/some/path",
+		"/a-b_c.d~e/1":    "/a-b_c.d~e/1",
+		"/not_/reserved":  "/not_/reserved",
+		"/metrics/custom": "/metrics/custom",
+	}
+	for path, expected := range valid {
+		key, err := normalizeKey(path)
+		assert.NoError(t, err, path)
+		assert.Equal(t, expected, key, path)
+	}
+
+	invalid := []string{
+		"/",
+		"",
+		"///",
+		"/_batch",
+		"//_batch",
+		"/_/anything",
+		"/favicon.ico",
+		"/metrics",
+		"/healthz/",
+		"/a/../b",
+		"/./a",
+		"/white space",
+		"/ünïcode",
+		"/" + strings.Repeat("a", maxKeyLength),
+	}
+	for _, path := range invalid {
+		_, err := normalizeKey(path)
+		assert.Error(t, err, path)
+	}
+}
+
+func TestCounterKey_StripsQuery(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/yeet?cache=bust", nil)
+
+	key, ok := counterKey(w, r)
+	assert.True(t, ok)
+	assert.Equal(t, "/yeet", key)
+}
+
+func TestCounterKey_Invalid(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/_reserved", nil)
+
+	_, ok := counterKey(w, r)
+	assert.False(t, ok)
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+}
@@ -1,56 +1,178 @@
 package main
 
 import (
+	"context"
 	"counter/store"
 	"fmt"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
 func main() {
+	if runCommand(os.Args[1:]) {
+		return
+	}
+
 	log.Info("Starting up")
 
 	cfg := getConfig()
 
-	s, err := func() (store.Repository, error) {
-		switch cfg.DB {
-		case dbMemory:
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := serve(ctx, cfg); err != nil {
+		log.Fatal(err)
+	}
+	log.Info("Shut down")
+}
+
+// openStore opens the database selected by the configuration
+func openStore(cfg config) (store.Repository, error) {
+	switch cfg.DB {
+	case dbMemory:
+		if cfg.MemoryDir == "" {
 			return store.NewMemoryStore(), nil
-		case dbEtcd3:
-			return store.NewEtcdStore(cfg.DBHosts)
-		case dbDisk:
-			_ = os.Mkdir(cfg.DiskPath, os.ModePerm)
-			return store.NewDiskvStore(cfg.DiskPath), nil
-		case dbBadger:
-			_ = os.Mkdir(cfg.DiskPath, os.ModePerm)
-			return store.NewBadgerStore(cfg.DiskPath)
-		case dbRedis:
-			return store.NewRedisStore(cfg.DBHosts[0]), nil
-		case dbNull:
-			log.Warn("Welp I guess you are")
-			return store.NewNullStore(), nil
-		default:
-			return nil, fmt.Errorf("unsupported database: %v", cfg.DB)
 		}
-	}()
+		return store.NewPersistentMemoryStore(cfg.MemoryDir, store.PersistOptions{
+			Fsync:            cfg.MemoryFsync,
+			FsyncInterval:    cfg.MemoryFsyncInterval,
+			SnapshotInterval: cfg.MemorySnapshotInterval,
+		})
+	case dbEtcd3:
+		opts, err := cfg.etcdOptions()
+		if err != nil {
+			return nil, err
+		}
+		return store.NewEtcdStoreFromOptions(opts)
+	case dbDisk:
+		_ = os.Mkdir(cfg.DiskPath, os.ModePerm)
+		return store.NewDiskvStore(cfg.DiskPath), nil
+	case dbBadger:
+		_ = os.Mkdir(cfg.DiskPath, os.ModePerm)
+		return store.NewBadgerStore(cfg.DiskPath)
+	case dbSQLite:
+		return store.NewSQLiteStore(cfg.DiskPath)
+	case dbBolt:
+		return store.NewBoltStore(cfg.DiskPath)
+	case dbPostgres:
+		return store.NewPostgresStore(cfg.DSN)
+	case dbRedis:
+		opts, err := cfg.redisOptions()
+		if err != nil {
+			return nil, err
+		}
+		return store.NewRedisStoreFromOptions(context.Background(), opts), nil
+	case dbNull:
+		log.Warn("Welp I guess you are")
+		return store.NewNullStore(), nil
+	default:
+		return nil, fmt.Errorf("unsupported database: %v", cfg.DB)
+	}
+}
+
+// serve runs the server until ctx is done. It then reports not ready to load balancers for cfg.ShutdownDelay,
+// waits up to cfg.ShutdownTimeout for requests to finish and closes the database.
+func serve(ctx context.Context, cfg config) error {
+	s, err := openStore(cfg)
 	if err != nil {
-		log.Fatalf("Failed to create database: %v", err)
+		return fmt.Errorf("failed to create database: %w", err)
+	}
+
+	// Every run gets its own registry, so main can be started more than once in tests
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	s = store.NewInstrumentedStore(s, string(cfg.DB), reg)
+	if cfg.CacheSize > 0 {
+		s = store.NewCachingStore(s, store.CacheOptions{Size: cfg.CacheSize, TTL: cfg.CacheTTL, Watch: cfg.CacheWatch})
+	}
+	if cfg.CoalesceInterval > 0 {
+		s = store.NewCoalescingStore(s, store.CoalesceOptions{
+			Interval:    cfg.CoalesceInterval,
+			MaxPending:  cfg.CoalesceMaxKeys,
+			Passthrough: reservedPrefix,
+		})
+	}
+
+	if cfg.MetricsCounterPrefix != "" {
+		reg.MustRegister(newCounterCollector(s, cfg.MetricsCounterPrefix))
 	}
-	defer s.Close()
+
+	webhookOpts := WebhookOptions{
+		MaxAttempts:  cfg.WebhookAttempts,
+		Backoff:      cfg.WebhookBackoff,
+		MaxBackoff:   cfg.WebhookMaxBackoff,
+		Timeout:      cfg.WebhookTimeout,
+		AllowPrivate: cfg.WebhookAllowPrivate,
+	}
+	if cfg.WebhookDeadLetters != "" {
+		f, err := os.OpenFile(cfg.WebhookDeadLetters, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			_ = s.Close()
+			return fmt.Errorf("failed to open webhook dead letter log: %w", err)
+		}
+		defer f.Close()
+		webhookOpts.DeadLetters = f
+	}
+	webhooks := NewWebhooks(s, webhookOpts)
+	webhooksCtx, stopWebhooks := context.WithCancel(context.Background())
+	webhooksDone := make(chan struct{})
+	go func() {
+		webhooks.Run(webhooksCtx)
+		close(webhooksDone)
+	}()
+
+	// Closed once shutting down, from then on readiness probes fail
+	draining := make(chan struct{})
 
 	// Create routes object
-	rs := NewRoutes(s)
+	rs := NewRoutesWithOptions(s, RoutesOptions{
+		IdempotencyWindow: cfg.IdempotencyWindow,
+		AllowPutCreate:    cfg.PutCreate,
+		AllowedOrigins:    cfg.CORSOrigins,
+		Webhooks:          webhooks,
+		Draining:          draining,
+	})
 
 	// Router
 	r := mux.NewRouter()
-	r.PathPrefix("/").Methods(http.MethodGet).HandlerFunc(rs.GetCounter)
+	r.Path("/healthz").Methods(http.MethodGet, http.MethodHead).HandlerFunc(rs.Healthz)
+	r.Path("/readyz").Methods(http.MethodGet, http.MethodHead).HandlerFunc(rs.Readyz)
+	r.Path("/metrics").Methods(http.MethodGet).Handler(promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	r.Path("/_batch").Methods(http.MethodPost).HandlerFunc(rs.Batch)
+	r.Path("/_query").Methods(http.MethodPost).HandlerFunc(rs.Query)
+	r.Path("/_ws").Methods(http.MethodGet).HandlerFunc(rs.WebSocket)
+	r.PathPrefix("/_webhooks/").Methods(http.MethodPost).HandlerFunc(rs.RegisterWebhook)
+	r.PathPrefix("/_webhooks/").Methods(http.MethodGet).HandlerFunc(rs.ListWebhooks)
+	r.PathPrefix("/_webhooks/").Methods(http.MethodDelete).HandlerFunc(rs.DeleteWebhook)
+	r.Path("/_stream").Methods(http.MethodGet).HandlerFunc(rs.StreamPrefix)
+	r.PathPrefix("/_stream/").Methods(http.MethodGet).HandlerFunc(rs.StreamPrefix)
+	r.PathPrefix("/").Methods(http.MethodGet, http.MethodHead).HandlerFunc(rs.GetCounter)
 	r.PathPrefix("/").Methods(http.MethodPatch).HandlerFunc(rs.PatchCounter)
 	r.PathPrefix("/").Methods(http.MethodPost).HandlerFunc(rs.CreateCounter)
+	r.PathPrefix("/").Methods(http.MethodPut).HandlerFunc(rs.PutCounter)
 	r.PathPrefix("/").Methods(http.MethodDelete).HandlerFunc(rs.DeleteCounter)
+	r.PathPrefix("/").Methods(http.MethodOptions).HandlerFunc(optionsHandler)
+	r.Use(corsMiddleware(corsOptions{
+		AllowedOrigins: cfg.CORSOrigins,
+		AllowedMethods: cfg.CORSMethods,
+		AllowedHeaders: cfg.CORSHeaders,
+		MaxAge:         cfg.CORSMaxAge,
+	}))
 	r.Use(rootMiddleware)
+	r.Use(metricsMiddleware(reg))
+
+	// Requests derive their context from base, cancelling it when shutting down ends streams and websockets,
+	// which would otherwise keep Shutdown waiting
+	base, cancelBase := context.WithCancel(context.Background())
+	defer cancelBase()
 
 	srv := &http.Server{
 		Handler: r,
@@ -58,17 +180,52 @@ func main() {
 		// Good practice: enforce timeouts for servers you create!
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
+		BaseContext: func(net.Listener) context.Context {
+			return base
+		},
 	}
+	srv.RegisterOnShutdown(cancelBase)
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		log.Infof("Shutting down, draining for %v", cfg.ShutdownDelay)
+		close(draining)
+		time.Sleep(cfg.ShutdownDelay)
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		shutdownErr <- srv.Shutdown(shutdownCtx)
+	}()
 
 	log.Infof("Started listing on %v", srv.Addr)
-	log.Fatal(srv.ListenAndServe())
+	err = srv.ListenAndServe()
+	if err == http.ErrServerClosed {
+		if err = <-shutdownErr; err != nil {
+			err = fmt.Errorf("requests didn't finish within %v: %w", cfg.ShutdownTimeout, err)
+			_ = srv.Close()
+		}
+	}
+
+	stopWebhooks()
+	<-webhooksDone
+	_ = webhooks.Close()
+
+	log.Info("Closing database")
+	if closeErr := s.Close(); closeErr != nil {
+		log.Errorf("Failed to close database: %v", closeErr)
+		if err == nil {
+			err = closeErr
+		}
+	}
+	return err
 }
 
 var gitHash string
 
 func rootMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.RequestURI == "/" {
+		if r.URL.Path == "/" {
 			_, _ = fmt.Fprintln(w, "Hello World!")
 			_, _ = fmt.Fprintln(w, "Git SHA: "+gitHash)
 		} else {
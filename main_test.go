@@ -2,8 +2,11 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"counter/store"
 	"encoding/json"
 	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
@@ -70,6 +73,93 @@ func TestBadger(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestSQLite(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Setup
+	dir, err := ioutil.TempDir("", "counter-test-sqlite")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	err = os.Setenv("DB", string(dbSQLite))
+	assert.NoError(t, err)
+	err = os.Setenv("DISKPATH", dir+"/counter.db")
+	assert.NoError(t, err)
+
+	// Start tests
+	e2eTest(t, "localhost:9006")
+
+	log.Info("Finished sqlite test")
+}
+
+func TestBolt(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Setup
+	dir, err := ioutil.TempDir("", "counter-test-bolt")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	err = os.Setenv("DB", string(dbBolt))
+	assert.NoError(t, err)
+	err = os.Setenv("DISKPATH", dir+"/counter.bolt")
+	assert.NoError(t, err)
+
+	// Start tests
+	e2eTest(t, "localhost:9008")
+
+	log.Info("Finished bolt test")
+}
+
+func TestPersistentMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// Setup
+	dir, err := ioutil.TempDir("", "counter-test-memory")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	err = os.Setenv("DB", string(dbMemory))
+	assert.NoError(t, err)
+	err = os.Setenv("MEMORY_DIR", dir)
+	assert.NoError(t, err)
+	defer os.Unsetenv("MEMORY_DIR")
+
+	// Start tests
+	e2eTest(t, "localhost:9009")
+
+	log.Info("Finished persistent memory test")
+}
+
+func TestPostgres(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	// You can run postgres as following:
+	// initdb -D /tmp/pgdata && postgres -D /tmp/pgdata -k /tmp
+	// then set POSTGRESDSN=postgres://localhost:5432/postgres
+
+	dsn := os.Getenv("POSTGRESDSN")
+	if dsn == "" {
+		t.Skip("Skipping postgres test as POSTGRESDSN is not set up")
+	}
+
+	// Setup
+	err := os.Setenv("DB", string(dbPostgres))
+	assert.NoError(t, err)
+	err = os.Setenv("DSN", dsn)
+	assert.NoError(t, err)
+
+	// Start tests
+	e2eTest(t, "localhost:9007")
+
+	log.Info("Finished postgres test")
+}
+
 func TestEtcd(t *testing.T) {
 	if testing.Short() {
 		t.Skip()
@@ -193,6 +283,17 @@ func e2eTest(t *testing.T, addr string) {
 	assert.Contains(t, text, "0")
 	assert.NotContains(t, text, token)
 
+	// HEAD only returns the headers
+	req, err = http.NewRequest(http.MethodHead, url+"/test/yeet", nil)
+	assert.NoError(t, err)
+	resp, err = client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "0", resp.Header.Get(countHeader))
+	bites, err = ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Empty(t, bites)
+
 	// Increment counter without token
 	req, err = http.NewRequest(http.MethodPatch, url+"/test/yeet", nil)
 	assert.NoError(t, err)
@@ -269,4 +370,103 @@ func e2eTest(t *testing.T, addr string) {
 	resp, err = client.Do(req)
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// The memory store is always ready
+	resp, err = http.Get(url + "/readyz")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Metrics include the requests made above
+	resp, err = http.Get(url + "/metrics")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	bites, err = ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	text = string(bites)
+	assert.Contains(t, text, `counter_http_requests_total{code="201",method="post"} 1`)
+	assert.Contains(t, text, "counter_store_operation_duration_seconds")
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "counter-test-shutdown")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	addr := "localhost:9005"
+	url := "http://" + addr
+	cfg := config{
+		DB:              dbBadger,
+		DiskPath:        dir,
+		Address:         addr,
+		WebhookBackoff:  time.Second,
+		ShutdownDelay:   time.Second,
+		ShutdownTimeout: 5 * time.Second,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(ctx, cfg)
+	}()
+
+	// Wait until the server is ready
+	assert.Eventually(t, func() bool {
+		resp, err := http.Get(url + "/readyz")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, 5*time.Second, 50*time.Millisecond)
+
+	resp, err := http.Post(url+"/shutdown", "", nil)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	// Open a stream and a websocket, both are ended by the shutdown
+	req, err := http.NewRequest(http.MethodGet, url+"/shutdown", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	stream, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer stream.Body.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/_ws", nil)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	cancel()
+
+	// Load balancers are told to stop routing before requests are refused
+	assert.Eventually(t, func() bool {
+		resp, err := http.Get(url + "/readyz")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusServiceUnavailable
+	}, cfg.ShutdownDelay, 50*time.Millisecond)
+
+	_, err = ioutil.ReadAll(stream.Body)
+	assert.NoError(t, err)
+
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "unexpected error: %v", err)
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(cfg.ShutdownTimeout):
+		t.Fatal("Timed out waiting for the server to shut down")
+	}
+
+	// The database was closed, so it can be opened again
+	s, err := store.NewBadgerStore(dir)
+	assert.NoError(t, err)
+	defer s.Close()
+	_, err = s.Get("/shutdown")
+	assert.NoError(t, err)
 }
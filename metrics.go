@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"counter/store"
+	"errors"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxExportedCounters limits the amount of counters exported as gauges, every counter is a separate series
+const maxExportedCounters = 1000
+
+// errTooManyCounters stops scanning once maxExportedCounters counters have been exported
+var errTooManyCounters = errors.New("too many counters")
+
+// statusRecorder records the status code of a response. It implements Unwrap, so streams can still flush and clear
+// their deadlines with http.ResponseController, and Hijack for websockets.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking is not supported")
+	}
+	r.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// metricsMiddleware counts the requests and observes their latency by method and status code
+func metricsMiddleware(reg prometheus.Registerer) mux.MiddlewareFunc {
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "counter_http_requests_total",
+		Help: "Amount of HTTP requests by method and status code.",
+	}, []string{"method", "code"})
+	duration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "counter_http_request_duration_seconds",
+		Help:    "Latency of HTTP requests by method and status code, streams are observed when they are closed.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "code"})
+	reg.MustRegister(requests, duration)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := &statusRecorder{ResponseWriter: w}
+			next.ServeHTTP(rec, r)
+
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			labels := prometheus.Labels{"method": strings.ToLower(r.Method), "code": strconv.Itoa(rec.status)}
+			requests.With(labels).Inc()
+			duration.With(labels).Observe(time.Since(start).Seconds())
+		})
+	}
+}
+
+// counterCollector exports the counts of all counters below a prefix as gauges, they are read on every scrape
+type counterCollector struct {
+	repo   store.Repository
+	prefix string
+	desc   *prometheus.Desc
+}
+
+func newCounterCollector(repo store.Repository, prefix string) *counterCollector {
+	return &counterCollector{
+		repo:   repo,
+		prefix: prefix,
+		desc:   prometheus.NewDesc("counter_value", "Current count of a counter.", []string{"key"}, nil),
+	}
+}
+
+func (c *counterCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *counterCollector) Collect(ch chan<- prometheus.Metric) {
+	n := 0
+	err := c.repo.Scan(c.prefix, func(key string, value store.Value) error {
+		if strings.HasPrefix(key, reservedPrefix) {
+			return nil
+		} else if n >= maxExportedCounters {
+			return errTooManyCounters
+		}
+		n++
+
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(value.Count), key)
+		return nil
+	})
+
+	if err == errTooManyCounters {
+		log.Warnf("Metrics: only the first %v counters below %v are exported", maxExportedCounters, c.prefix)
+	} else if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.desc, err)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"counter/store"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsMiddleware(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	handler := metricsMiddleware(reg)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.Error(w, "Counter not yet created", http.StatusNotFound)
+			return
+		}
+
+		// Streams need to be able to flush and clear their deadline through the recorder
+		rc := http.NewResponseController(w)
+		assert.NoError(t, rc.SetWriteDeadline(time.Time{}))
+		assert.NoError(t, rc.Flush())
+	}))
+
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	for _, path := range []string{"/yeet", "/yeet", "/missing"} {
+		resp, err := http.Get(srv.URL + path)
+		assert.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	expected := `
+# HELP counter_http_requests_total Amount of HTTP requests by method and status code.
+# TYPE counter_http_requests_total counter
+counter_http_requests_total{code="200",method="get"} 2
+counter_http_requests_total{code="404",method="get"} 1
+`
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(expected), "counter_http_requests_total"))
+}
+
+func TestCounterCollector(t *testing.T) {
+	s := store.NewMemoryStore()
+	assert.NoError(t, s.Create("/exported/a", store.Value{Count: 1, AccessKey: uuid.New()}))
+	assert.NoError(t, s.Create("/exported/b", store.Value{Count: 2, AccessKey: uuid.New()}))
+	assert.NoError(t, s.Create("/hidden", store.Value{Count: 3, AccessKey: uuid.New()}))
+
+	expected := `
+# HELP counter_value Current count of a counter.
+# TYPE counter_value gauge
+counter_value{key="/exported/a"} 1
+counter_value{key="/exported/b"} 2
+`
+	assert.NoError(t, testutil.CollectAndCompare(newCounterCollector(s, "/exported"), strings.NewReader(expected)))
+}
+
+func TestCounterCollector_Limit(t *testing.T) {
+	s := store.NewMemoryStore()
+	for i := 0; i <= maxExportedCounters; i++ {
+		assert.NoError(t, s.Create("/c"+uuid.New().String(), store.Value{Count: i, AccessKey: uuid.New()}))
+	}
+
+	ch := make(chan prometheus.Metric, maxExportedCounters+1)
+	newCounterCollector(s, "/").Collect(ch)
+	assert.Len(t, ch, maxExportedCounters)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+)
+
+// maxQueryKeys is the maximum amount of keys in a single query request
+const maxQueryKeys = 500
+
+type queryArgs struct {
+	Keys []string `json:"keys"`
+}
+
+// Query returns the counts of multiple counters at once, counters that don't exist are null
+func (rs *Routes) Query(w http.ResponseWriter, r *http.Request) {
+	var args queryArgs
+	if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+		http.Error(w, "Could not decode json", http.StatusBadRequest)
+		return
+	} else if len(args.Keys) > maxQueryKeys {
+		http.Error(w, fmt.Sprintf("Query contains more than %v keys", maxQueryKeys), http.StatusRequestEntityTooLarge)
+		return
+	}
+	log.Tracef("Query on %v keys", len(args.Keys))
+
+	keys := make([]string, len(args.Keys))
+	for i, raw := range args.Keys {
+		key, err := normalizeKey(raw)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid key %q: %v", raw, err), http.StatusBadRequest)
+			return
+		}
+		keys[i] = key
+	}
+
+	values, err := rs.repo.GetMany(keys)
+	if err != nil {
+		http.Error(w, "Couldn't get values from database", http.StatusInternalServerError)
+		return
+	}
+
+	counts := make(map[string]*int, len(keys))
+	for i, key := range keys {
+		if values[i].AccessKey == uuid.Nil {
+			counts[key] = nil
+			continue
+		}
+		count := values[i].Count
+		counts[key] = &count
+	}
+
+	if err := json.NewEncoder(w).Encode(counts); err != nil {
+		log.Error("Query: writing response failed")
+	}
+}
@@ -7,35 +7,91 @@ import (
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Routes struct {
 	repo store.Repository
+	// idempotencyWindow is how long the result of a request with an Idempotency-Key is remembered
+	idempotencyWindow time.Duration
+	// allowPutCreate allows PUT to create counters that don't exist yet
+	allowPutCreate bool
+	// allowedOrigins are the origins that are allowed to open websockets
+	allowedOrigins []string
+	// webhooks keeps the webhook registrations of counters, webhooks are disabled if it is nil
+	webhooks *Webhooks
+	// hub shares a single watch between all websockets
+	hub *wsHub
+	// draining is closed once the server is shutting down
+	draining <-chan struct{}
+}
+
+// RoutesOptions configures the behaviour of Routes
+type RoutesOptions struct {
+	// IdempotencyWindow is how long the result of a PATCH with an Idempotency-Key header is remembered
+	IdempotencyWindow time.Duration
+	// AllowPutCreate allows PUT to create counters that don't exist yet, using the access key of the request
+	AllowPutCreate bool
+	// AllowedOrigins are the origins that are allowed to open websockets, "*" allows all origins
+	AllowedOrigins []string
+	// Webhooks keeps the webhook registrations of counters, webhooks are disabled if it is nil
+	Webhooks *Webhooks
+	// Draining is closed when the server starts shutting down, from then on Readyz reports not ready
+	Draining <-chan struct{}
 }
 
 func NewRoutes(repo store.Repository) Routes {
-	return Routes{repo}
+	return NewRoutesWithOptions(repo, RoutesOptions{
+		IdempotencyWindow: defaultIdempotencyWindow,
+	})
+}
+
+func NewRoutesWithOptions(repo store.Repository, opts RoutesOptions) Routes {
+	return Routes{
+		repo:              repo,
+		idempotencyWindow: opts.IdempotencyWindow,
+		allowPutCreate:    opts.AllowPutCreate,
+		allowedOrigins:    opts.AllowedOrigins,
+		webhooks:          opts.Webhooks,
+		hub:               newWsHub(repo),
+		draining:          opts.Draining,
+	}
 }
 
 func marshal(key string, value *store.Value) string {
 	return fmt.Sprintf("{ \"%v\": %v }", key, value.Count)
 }
 
-func (rs *Routes) authenticate(w http.ResponseWriter, r *http.Request) bool {
-	c, err := rs.repo.Get(r.RequestURI)
-	if err != nil {
-		return false
-	}
-
+// bearerToken parses the access key from the Authorization header of a request
+func bearerToken(r *http.Request) (uuid.UUID, bool) {
 	header := r.Header.Get("Authorization")
 	if !strings.HasPrefix(header, "Bearer ") {
-		http.Error(w, "Invalid access token", http.StatusUnauthorized)
-		return false
+		return uuid.Nil, false
 	}
 	token := strings.TrimPrefix(header, "Bearer ")
 	parsedToken, err := uuid.Parse(token)
+	if err != nil || parsedToken == uuid.Nil {
+		return uuid.Nil, false
+	}
+
+	return parsedToken, true
+}
+
+// authenticate checks the counter exists and the request has its access key, otherwise it responds with an error
+func (rs *Routes) authenticate(w http.ResponseWriter, r *http.Request, key string) bool {
+	c, err := rs.repo.Get(key)
 	if err != nil {
+		http.Error(w, "Couldn't get value from database", http.StatusInternalServerError)
+		return false
+	} else if c.AccessKey == uuid.Nil {
+		http.Error(w, "Counter not yet created", http.StatusNotFound)
+		return false
+	}
+
+	parsedToken, ok := bearerToken(r)
+	if !ok {
 		http.Error(w, "Invalid access token", http.StatusUnauthorized)
 		return false
 	}
@@ -49,8 +105,12 @@ func (rs *Routes) authenticate(w http.ResponseWriter, r *http.Request) bool {
 }
 
 func (rs *Routes) GetCounter(w http.ResponseWriter, r *http.Request) {
-	log.Tracef("GetCounter on %v", r.RequestURI)
-	c, err := rs.repo.Get(r.RequestURI)
+	key, ok := counterKey(w, r)
+	if !ok {
+		return
+	}
+	log.Tracef("GetCounter on %v", key)
+	c, err := rs.repo.Get(key)
 	if err != nil {
 		http.Error(w, "Couldn't get value from database", http.StatusInternalServerError)
 		return
@@ -59,9 +119,33 @@ func (rs *Routes) GetCounter(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = fmt.Fprint(w, marshal(r.RequestURI, &c))
+	if r.Method == http.MethodGet && wantsEventStream(r) {
+		rs.streamCounter(w, r, key)
+		return
+	}
+
+	if header := r.Header.Get("If-None-Match"); header != "" && etagMatches(header, &c) {
+		if c.Version != 0 {
+			w.Header().Set("ETag", etag(&c))
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	rs.writeCounter(w, key, &c)
+}
+
+// countHeader contains the current count of a counter, so HEAD requests can be used to read it
+const countHeader = "X-Count"
+
+func (rs *Routes) writeCounter(w http.ResponseWriter, key string, c *store.Value) {
+	w.Header().Set(countHeader, strconv.Itoa(c.Count))
+	if c.Version != 0 {
+		w.Header().Set("ETag", etag(c))
+	}
+	_, err := fmt.Fprint(w, marshal(key, c))
 	if err != nil {
-		log.Error("GetCounter: writing response failed")
+		log.Error("writing counter response failed")
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 	}
 }
@@ -70,18 +154,17 @@ type patchArgs struct {
 	Op string `json:"op"`
 }
 
+// PatchCounter authenticates, checks If-Match and applies the op with a single store operation, the store is only
+// read beforehand to tell a missing counter from a missing token. With an idempotency key the record of the request
+// is reserved before and written after.
 func (rs *Routes) PatchCounter(w http.ResponseWriter, r *http.Request) {
-	log.Tracef("PatchCounter on %v", r.RequestURI)
-	c, err := rs.repo.Get(r.RequestURI)
-	if err != nil {
-		http.Error(w, "Couldn't get value from database", http.StatusInternalServerError)
-		return
-	} else if c.AccessKey == uuid.Nil {
-		http.Error(w, "Counter not yet created", http.StatusNotFound)
+	key, ok := counterKey(w, r)
+	if !ok {
 		return
 	}
-
-	if !rs.authenticate(w, r) {
+	log.Tracef("PatchCounter on %v", key)
+	token, ok := rs.requireToken(w, r, key)
+	if !ok {
 		return
 	}
 
@@ -91,28 +174,105 @@ func (rs *Routes) PatchCounter(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var kind store.OpKind
 	switch args.Op {
 	case "increment":
-		if err := rs.repo.Increment(r.RequestURI); err != nil {
-			http.Error(w, "Couldn't increment value in database", http.StatusInternalServerError)
+		kind = store.OpIncrement
+	case "decrement":
+		kind = store.OpDecrement
+	default:
+		http.Error(w, fmt.Sprintf("Invalid op: %v", args.Op), http.StatusBadRequest)
+		return
+	}
+
+	idempotencyKey := r.Header.Get(idempotencyHeader)
+	var record idempotencyRecord
+	if len(idempotencyKey) > maxIdempotencyKeyLength {
+		http.Error(w, "Idempotency key too long", http.StatusBadRequest)
+		return
+	} else if idempotencyKey != "" {
+		// The record is reserved before applying the op, so concurrent retries can't apply it twice
+		var err error
+		record, err = rs.reserveIdempotent(key, token, idempotencyKey, r.Method, args.Op)
+		if err != nil {
+			http.Error(w, "Couldn't create idempotency record in database", http.StatusInternalServerError)
 			return
 		}
-	case "decrement":
-		if err := rs.repo.Decrement(r.RequestURI); err != nil {
-			http.Error(w, "Couldn't decrement value in database", http.StatusInternalServerError)
+		switch record.outcome {
+		case idempotencyReplay:
+			w.Header().Set("Idempotent-Replayed", "true")
+			rs.writeCounter(w, key, &store.Value{Count: record.count})
+			return
+		case idempotencyInProgress:
+			http.Error(w, "A request with this idempotency key is in progress", http.StatusConflict)
+			return
+		case idempotencyMismatch:
+			http.Error(w, "Idempotency key was used for another request", http.StatusUnprocessableEntity)
 			return
 		}
-	default:
-		http.Error(w, fmt.Sprintf("Invalid op: %v", args.Op), http.StatusBadRequest)
+	}
+
+	c, ok := rs.apply(w, r, store.Op{Key: key, Kind: kind, Amount: 1, AccessKey: token},
+		fmt.Sprintf("Couldn't %v value in database", args.Op))
+	if idempotencyKey != "" {
+		if ok {
+			rs.finishIdempotent(&record, c.Count)
+		} else {
+			rs.releaseIdempotent(&record)
+		}
+	}
+	if !ok {
 		return
 	}
-	rs.GetCounter(w, r)
+
+	rs.writeCounter(w, key, &c)
+}
+
+// requireToken returns the access key of the request. Without a valid one the counter is read to respond with
+// 404 if it doesn't exist and 401 otherwise.
+func (rs *Routes) requireToken(w http.ResponseWriter, r *http.Request, key string) (uuid.UUID, bool) {
+	if token, ok := bearerToken(r); ok {
+		return token, true
+	}
+
+	c, err := rs.repo.Get(key)
+	if err != nil {
+		http.Error(w, "Couldn't get value from database", http.StatusInternalServerError)
+	} else if c.AccessKey == uuid.Nil {
+		http.Error(w, "Counter not yet created", http.StatusNotFound)
+	} else {
+		http.Error(w, "Invalid access token", http.StatusUnauthorized)
+	}
+	return uuid.Nil, false
+}
+
+// apply applies op with the versions of the If-Match header of the request, writing an error response if that fails
+func (rs *Routes) apply(w http.ResponseWriter, r *http.Request, op store.Op, failure string) (store.Value, bool) {
+	op.Versions = ifMatchVersions(r.Header.Get("If-Match"))
+	c, err := rs.repo.Apply(op)
+	switch err {
+	case nil:
+		return c, true
+	case store.ErrNotFound:
+		http.Error(w, "Counter not yet created", http.StatusNotFound)
+	case store.ErrWrongAccessKey:
+		http.Error(w, "Wrong access token", http.StatusUnauthorized)
+	case store.ErrVersionMismatch:
+		http.Error(w, "Counter has been modified", http.StatusPreconditionFailed)
+	default:
+		http.Error(w, failure, http.StatusInternalServerError)
+	}
+	return store.Value{}, false
 }
 
 func (rs *Routes) CreateCounter(w http.ResponseWriter, r *http.Request) {
-	log.Tracef("CreateCounter on %v", r.RequestURI)
+	key, ok := counterKey(w, r)
+	if !ok {
+		return
+	}
+	log.Tracef("CreateCounter on %v", key)
 
-	c, err := rs.repo.Get(r.RequestURI)
+	c, err := rs.repo.Get(key)
 	if err != nil {
 		http.Error(w, "Couldn't get value from database", http.StatusInternalServerError)
 		return
@@ -122,7 +282,7 @@ func (rs *Routes) CreateCounter(w http.ResponseWriter, r *http.Request) {
 	}
 
 	v := store.Value{Count: 0, AccessKey: uuid.New()}
-	if err := rs.repo.Create(r.RequestURI, v); err != nil {
+	if err := rs.repo.Create(key, v); err != nil {
 		http.Error(w, "Couldn't create value in database", http.StatusInternalServerError)
 		return
 	}
@@ -130,31 +290,105 @@ func (rs *Routes) CreateCounter(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Authorization", "Bearer "+v.AccessKey.String())
 	w.WriteHeader(http.StatusCreated)
 
-	_, err = fmt.Fprintf(w, "{ \"%v\": %v, \"AccessKey\": \"%v\" }", r.RequestURI, v.Count, v.AccessKey.String())
+	_, err = fmt.Fprintf(w, "{ \"%v\": %v, \"AccessKey\": \"%v\" }", key, v.Count, v.AccessKey.String())
 	if err != nil {
 		log.Error("CreateCounter: writing response failed")
 		http.Error(w, "Internal server error encountered when formatting response", http.StatusInternalServerError)
 	}
 }
 
-func (rs *Routes) DeleteCounter(w http.ResponseWriter, r *http.Request) {
-	log.Tracef("DeleteCounter on %v", r.RequestURI)
+type putArgs struct {
+	Count *int `json:"count"`
+}
+
+// PutCounter replaces the state of a counter, unlike PatchCounter repeating the request has no further effect.
+// If the counter doesn't exist and creating on PUT is allowed, it is created with the access key of the request.
+// The counter is only read to decide between both, setting and creating are single store operations.
+func (rs *Routes) PutCounter(w http.ResponseWriter, r *http.Request) {
+	key, ok := counterKey(w, r)
+	if !ok {
+		return
+	}
+	log.Tracef("PutCounter on %v", key)
 
-	c, err := rs.repo.Get(r.RequestURI)
+	c, err := rs.repo.Get(key)
 	if err != nil {
 		http.Error(w, "Couldn't get value from database", http.StatusInternalServerError)
 		return
-	} else if c.AccessKey == uuid.Nil {
+	}
+	exists := c.AccessKey != uuid.Nil
+
+	if !exists && !rs.allowPutCreate {
 		http.Error(w, "Counter not yet created", http.StatusNotFound)
 		return
 	}
 
-	if !rs.authenticate(w, r) {
+	token, ok := bearerToken(r)
+	if !ok {
+		http.Error(w, "Invalid access token", http.StatusUnauthorized)
+		return
+	} else if exists && c.AccessKey != token {
+		http.Error(w, "Wrong access token", http.StatusUnauthorized)
+		return
+	}
+
+	if exists && r.Header.Get("If-None-Match") == "*" {
+		http.Error(w, "Counter already exists", http.StatusPreconditionFailed)
+		return
+	} else if !exists && r.Header.Get("If-Match") != "" {
+		http.Error(w, "Counter not yet created", http.StatusPreconditionFailed)
 		return
 	}
 
-	if err := rs.repo.Delete(r.RequestURI); err != nil {
-		http.Error(w, "Couldn't delete value from database", http.StatusInternalServerError)
+	var args putArgs
+	if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+		http.Error(w, "Could not decode json", http.StatusBadRequest)
+		return
+	} else if args.Count == nil {
+		http.Error(w, "Missing count", http.StatusBadRequest)
 		return
 	}
+
+	if !exists {
+		v, err := rs.repo.Apply(store.Op{Key: key, Kind: store.OpCreate, Amount: *args.Count, AccessKey: token})
+		switch err {
+		case nil:
+			w.Header().Set("Authorization", "Bearer "+token.String())
+			w.WriteHeader(http.StatusCreated)
+			rs.writeCounter(w, key, &v)
+			return
+		case store.ErrExists:
+			// The counter has been created since it was read, it is replaced unless the request only creates
+			if r.Header.Get("If-None-Match") == "*" {
+				http.Error(w, "Counter already exists", http.StatusPreconditionFailed)
+				return
+			}
+		default:
+			http.Error(w, "Couldn't set value in database", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// The store checks the access key and If-Match again, the counter may have changed since it was read
+	v, ok := rs.apply(w, r, store.Op{Key: key, Kind: store.OpSet, Amount: *args.Count, AccessKey: token},
+		"Couldn't set value in database")
+	if !ok {
+		return
+	}
+
+	rs.writeCounter(w, key, &v)
+}
+
+func (rs *Routes) DeleteCounter(w http.ResponseWriter, r *http.Request) {
+	key, ok := counterKey(w, r)
+	if !ok {
+		return
+	}
+	log.Tracef("DeleteCounter on %v", key)
+	token, ok := rs.requireToken(w, r, key)
+	if !ok {
+		return
+	}
+
+	rs.apply(w, r, store.Op{Key: key, Kind: store.OpDelete, AccessKey: token}, "Couldn't delete value from database")
 }
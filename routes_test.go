@@ -5,6 +5,7 @@ import (
 	"counter/store"
 	"counter/store/mock_store"
 	"encoding/json"
+	"errors"
 	"github.com/golang/mock/gomock"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
@@ -12,7 +13,9 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestMarshal(t *testing.T) {
@@ -109,7 +112,7 @@ func TestRoutes_authenticate(t *testing.T) {
 
 	rs := NewRoutes(repo)
 
-	assert.True(t, rs.authenticate(w, r))
+	assert.True(t, rs.authenticate(w, r, uri))
 }
 
 func TestRoutes_authenticate_noheader(t *testing.T) {
@@ -132,10 +135,33 @@ func TestRoutes_authenticate_noheader(t *testing.T) {
 
 	rs := NewRoutes(repo)
 
-	assert.False(t, rs.authenticate(w, r))
+	assert.False(t, rs.authenticate(w, r, uri))
 	assert.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
 }
 
+func TestRoutes_authenticate_missing(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	uri := "/yeet"
+
+	repo := mock_store.NewMockRepository(ctrl)
+	repo.EXPECT().Get(uri).Return(store.Value{}, nil).Times(1)
+	repo.EXPECT().Get(uri).Return(store.Value{}, errors.New("yeet")).Times(1)
+
+	rs := NewRoutes(repo)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, uri, nil)
+	r.Header.Set("Authorization", "Bearer "+uuid.New().String())
+	assert.False(t, rs.authenticate(w, r, uri))
+	assert.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+
+	w = httptest.NewRecorder()
+	assert.False(t, rs.authenticate(w, r, uri))
+	assert.Equal(t, http.StatusInternalServerError, w.Result().StatusCode)
+}
+
 func TestRoutes_authenticate_wrongheader(t *testing.T) {
 	// Bearer but invalid uuid
 	helperAuthenticateWrongheader(t, "Bearer Yeet")
@@ -166,7 +192,7 @@ func helperAuthenticateWrongheader(t *testing.T, header string) {
 
 	rs := NewRoutes(repo)
 
-	assert.False(t, rs.authenticate(w, r))
+	assert.False(t, rs.authenticate(w, r, uri))
 	assert.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
 }
 
@@ -188,11 +214,14 @@ func PatchTests(t *testing.T, op string) {
 
 	repo := mock_store.NewMockRepository(ctrl)
 
-	repo.EXPECT().Get(uri).Return(v, nil).MinTimes(1)
+	nv := v
+	nv.Version = 8
 	if op == "increment" {
-		repo.EXPECT().Increment(uri).Return(nil).Times(1)
+		nv.Count++
+		repo.EXPECT().Apply(store.Op{Key: uri, Kind: store.OpIncrement, Amount: 1, AccessKey: v.AccessKey}).Return(nv, nil).Times(1)
 	} else if op == "decrement" {
-		repo.EXPECT().Decrement(uri).Return(nil).Times(1)
+		nv.Count--
+		repo.EXPECT().Apply(store.Op{Key: uri, Kind: store.OpDecrement, Amount: 1, AccessKey: v.AccessKey}).Return(nv, nil).Times(1)
 	} else {
 		t.Fail()
 	}
@@ -209,11 +238,12 @@ func PatchTests(t *testing.T, op string) {
 
 	res := w.Result()
 	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, `"8"`, res.Header.Get("ETag"))
 
 	buf := new(strings.Builder)
 	_, err = io.Copy(buf, res.Body)
 	assert.NoError(t, err)
-	assert.Equal(t, marshal(uri, &v), buf.String())
+	assert.Equal(t, marshal(uri, &nv), buf.String())
 }
 
 func TestRoutes_IncrementCounterUnAuth(t *testing.T) {
@@ -268,6 +298,33 @@ func TestRoutes_IncrementCounterNX(t *testing.T) {
 	assert.Equal(t, http.StatusNotFound, res.StatusCode)
 }
 
+func TestRoutes_IncrementCounterWrongToken(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	token := uuid.New()
+	uri := "/yeet"
+
+	repo := mock_store.NewMockRepository(ctrl)
+
+	// The store checks the access key while applying the op
+	repo.EXPECT().Apply(store.Op{Key: uri, Kind: store.OpIncrement, Amount: 1, AccessKey: token}).
+		Return(store.Value{}, store.ErrWrongAccessKey).Times(1)
+
+	w := httptest.NewRecorder()
+	b, err := json.Marshal(patchArgs{Op: "increment"})
+	assert.NoError(t, err)
+	r := httptest.NewRequest(http.MethodPatch, uri, bytes.NewReader(b))
+	r.Header.Set("Authorization", "Bearer "+token.String())
+
+	rs := NewRoutes(repo)
+
+	rs.PatchCounter(w, r)
+
+	res := w.Result()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+}
+
 func TestRoutes_CreateCounter_Exists(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -348,8 +405,7 @@ func TestRoutes_DeleteCounter(t *testing.T) {
 
 	repo := mock_store.NewMockRepository(ctrl)
 
-	repo.EXPECT().Get(uri).Return(v, nil).MinTimes(1)
-	repo.EXPECT().Delete(uri).Return(nil).Times(1)
+	repo.EXPECT().Apply(store.Op{Key: uri, Kind: store.OpDelete, AccessKey: v.AccessKey}).Return(store.Value{}, nil).Times(1)
 
 	w := httptest.NewRecorder()
 	r := httptest.NewRequest(http.MethodPost, uri, nil)
@@ -415,3 +471,642 @@ func TestRoutes_DeleteCounterNX(t *testing.T) {
 	res := w.Result()
 	assert.Equal(t, http.StatusNotFound, res.StatusCode)
 }
+
+func TestRoutes_InvalidKey(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// No calls to the repository are expected
+	repo := mock_store.NewMockRepository(ctrl)
+	rs := NewRoutes(repo)
+
+	handlers := []http.HandlerFunc{rs.GetCounter, rs.PatchCounter, rs.CreateCounter, rs.DeleteCounter}
+	for _, handler := range handlers {
+		for _, uri := range []string{"/_reserved", "/favicon.ico", "/a/../b"} {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, uri, nil)
+
+			handler(w, r)
+
+			assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+		}
+	}
+}
+
+func TestRoutes_GetCounterNormalized(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	v := store.Value{
+		Count:     42,
+		AccessKey: uuid.New(),
+	}
+
+	repo := mock_store.NewMockRepository(ctrl)
+
+	repo.EXPECT().Get("/yeet/yoot").Return(v, nil).Times(1)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "//yeet//yoot/?query=string", nil)
+
+	rs := NewRoutes(repo)
+
+	rs.GetCounter(w, r)
+
+	res := w.Result()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	buf := new(strings.Builder)
+	_, err := io.Copy(buf, res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, marshal("/yeet/yoot", &v), buf.String())
+}
+
+func TestRoutes_PatchCounterIdempotent(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	v := store.Value{
+		Count:     42,
+		AccessKey: uuid.New(),
+	}
+
+	uri := "/yeet"
+	recordKey := idempotencyRecordKey(uri, v.AccessKey, "retry-me")
+
+	repo := mock_store.NewMockRepository(ctrl)
+
+	// The record is reserved before the op is applied
+	gomock.InOrder(
+		repo.EXPECT().Apply(gomock.Any()).DoAndReturn(func(op store.Op) (store.Value, error) {
+			assert.Equal(t, recordKey, op.Key)
+			assert.Equal(t, store.OpCreate, op.Kind)
+			assert.Equal(t, idempotencyRequest(http.MethodPatch, "increment", true), op.AccessKey)
+			assert.True(t, op.Expires > time.Now().Unix())
+			return store.Value{AccessKey: op.AccessKey, Version: 1, Expires: op.Expires}, nil
+		}).Times(1),
+		repo.EXPECT().Apply(store.Op{Key: uri, Kind: store.OpIncrement, Amount: 1, AccessKey: v.AccessKey}).
+			Return(store.Value{Count: v.Count + 1, AccessKey: v.AccessKey, Version: 2}, nil).Times(1),
+		repo.EXPECT().Create(recordKey, gomock.Any()).DoAndReturn(func(_ string, record store.Value) error {
+			assert.Equal(t, v.Count+1, record.Count)
+			assert.Equal(t, idempotencyRequest(http.MethodPatch, "increment", false), record.AccessKey)
+			assert.True(t, record.Expires > time.Now().Unix())
+			return nil
+		}).Times(1),
+	)
+
+	w := httptest.NewRecorder()
+	b, err := json.Marshal(patchArgs{Op: "increment"})
+	assert.NoError(t, err)
+	r := httptest.NewRequest(http.MethodPatch, uri, bytes.NewReader(b))
+	r.Header.Set("Authorization", "Bearer "+v.AccessKey.String())
+	r.Header.Set(idempotencyHeader, "retry-me")
+
+	rs := NewRoutes(repo)
+
+	rs.PatchCounter(w, r)
+
+	res := w.Result()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Empty(t, res.Header.Get("Idempotent-Replayed"))
+}
+
+func TestRoutes_PatchCounterIdempotentReplay(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	v := store.Value{
+		Count:     42,
+		AccessKey: uuid.New(),
+	}
+	record := store.Value{
+		Count:     41,
+		AccessKey: idempotencyRequest(http.MethodPatch, "increment", false),
+	}
+
+	uri := "/yeet"
+	recordKey := idempotencyRecordKey(uri, v.AccessKey, "retry-me")
+
+	repo := mock_store.NewMockRepository(ctrl)
+
+	// The op isn't applied again
+	repo.EXPECT().Apply(gomock.Any()).DoAndReturn(func(op store.Op) (store.Value, error) {
+		assert.Equal(t, recordKey, op.Key)
+		assert.Equal(t, store.OpCreate, op.Kind)
+		return store.Value{}, store.ErrExists
+	}).Times(1)
+	repo.EXPECT().Get(recordKey).Return(record, nil).Times(1)
+
+	w := httptest.NewRecorder()
+	b, err := json.Marshal(patchArgs{Op: "increment"})
+	assert.NoError(t, err)
+	r := httptest.NewRequest(http.MethodPatch, uri, bytes.NewReader(b))
+	r.Header.Set("Authorization", "Bearer "+v.AccessKey.String())
+	r.Header.Set(idempotencyHeader, "retry-me")
+
+	rs := NewRoutes(repo)
+
+	rs.PatchCounter(w, r)
+
+	res := w.Result()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "true", res.Header.Get("Idempotent-Replayed"))
+
+	buf := new(strings.Builder)
+	_, err = io.Copy(buf, res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, marshal(uri, &store.Value{Count: 41}), buf.String())
+}
+
+func TestRoutes_PatchCounterIdempotentConcurrent(t *testing.T) {
+	s := store.NewMemoryStore()
+	accessKey := uuid.New()
+	assert.NoError(t, s.Create("/yeet", store.Value{AccessKey: accessKey}))
+	rs := NewRoutes(s)
+
+	patch := func(op, idempotencyKey string) *http.Response {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPatch, "/yeet", strings.NewReader(`{"op": "`+op+`"}`))
+		r.Header.Set("Authorization", "Bearer "+accessKey.String())
+		r.Header.Set(idempotencyHeader, idempotencyKey)
+		rs.PatchCounter(w, r)
+		return w.Result()
+	}
+
+	// Concurrent retries apply the op once, the others are either told to retry or replayed
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := patch("increment", "retry-me")
+			assert.Contains(t, []int{http.StatusOK, http.StatusConflict}, res.StatusCode)
+		}()
+	}
+	wg.Wait()
+
+	v, err := s.Get("/yeet")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, v.Count)
+
+	res := patch("increment", "retry-me")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "true", res.Header.Get("Idempotent-Replayed"))
+
+	// The key can't be reused for another op
+	res = patch("decrement", "retry-me")
+	assert.Equal(t, http.StatusUnprocessableEntity, res.StatusCode)
+
+	// Failed requests can be retried
+	assert.NoError(t, s.Delete("/yeet"))
+	res = patch("increment", "other")
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+	assert.NoError(t, s.Create("/yeet", store.Value{AccessKey: accessKey}))
+	res = patch("increment", "other")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Empty(t, res.Header.Get("Idempotent-Replayed"))
+
+	v, err = s.Get("/yeet")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, v.Count)
+}
+
+func TestIdempotencyRecordKey(t *testing.T) {
+	accessKey := uuid.New()
+	a := idempotencyRecordKey("/a", accessKey, "key")
+	assert.True(t, strings.HasPrefix(a, reservedPrefix))
+	assert.NotEqual(t, a, idempotencyRecordKey("/b", accessKey, "key"))
+	assert.NotEqual(t, a, idempotencyRecordKey("/a", accessKey, "other"))
+	assert.NotEqual(t, a, idempotencyRecordKey("/a", uuid.New(), "key"))
+
+	_, err := normalizeKey(a)
+	assert.Error(t, err, "records must not be reachable as counters")
+}
+
+func TestRoutes_GetCounterNotModified(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	v := store.Value{
+		Count:     42,
+		AccessKey: uuid.New(),
+		Version:   7,
+	}
+
+	uri := "/yeet"
+
+	repo := mock_store.NewMockRepository(ctrl)
+
+	repo.EXPECT().Get(uri).Return(v, nil).Times(2)
+
+	rs := NewRoutes(repo)
+
+	// Without If-None-Match the ETag is returned
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, uri, nil)
+	rs.GetCounter(w, r)
+
+	res := w.Result()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, `"7"`, res.Header.Get("ETag"))
+	assert.Equal(t, "42", res.Header.Get(countHeader))
+
+	// Which can be used to make a conditional request
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, uri, nil)
+	r.Header.Set("If-None-Match", res.Header.Get("ETag"))
+	rs.GetCounter(w, r)
+
+	res = w.Result()
+	assert.Equal(t, http.StatusNotModified, res.StatusCode)
+	assert.Equal(t, 0, w.Body.Len())
+}
+
+func TestRoutes_PatchCounterPreconditionFailed(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	v := store.Value{
+		Count:     42,
+		AccessKey: uuid.New(),
+		Version:   7,
+	}
+
+	uri := "/yeet"
+
+	repo := mock_store.NewMockRepository(ctrl)
+
+	// The store checks the version while applying the op
+	repo.EXPECT().Apply(store.Op{Key: uri, Kind: store.OpIncrement, Amount: 1, AccessKey: v.AccessKey, Versions: []uint64{6}}).
+		Return(store.Value{}, store.ErrVersionMismatch).Times(1)
+
+	w := httptest.NewRecorder()
+	b, err := json.Marshal(patchArgs{Op: "increment"})
+	assert.NoError(t, err)
+	r := httptest.NewRequest(http.MethodPatch, uri, bytes.NewReader(b))
+	r.Header.Set("Authorization", "Bearer "+v.AccessKey.String())
+	r.Header.Set("If-Match", `"6"`)
+
+	rs := NewRoutes(repo)
+
+	rs.PatchCounter(w, r)
+
+	assert.Equal(t, http.StatusPreconditionFailed, w.Result().StatusCode)
+}
+
+func TestRoutes_DeleteCounterPreconditionFailed(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	v := store.Value{
+		Count:     42,
+		AccessKey: uuid.New(),
+		Version:   7,
+	}
+
+	uri := "/yeet"
+
+	repo := mock_store.NewMockRepository(ctrl)
+
+	// The store checks the version while deleting
+	repo.EXPECT().Apply(store.Op{Key: uri, Kind: store.OpDelete, AccessKey: v.AccessKey, Versions: []uint64{6}}).
+		Return(store.Value{}, store.ErrVersionMismatch).Times(1)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodDelete, uri, nil)
+	r.Header.Set("Authorization", "Bearer "+v.AccessKey.String())
+	r.Header.Set("If-Match", `"6"`)
+
+	rs := NewRoutes(repo)
+
+	rs.DeleteCounter(w, r)
+
+	assert.Equal(t, http.StatusPreconditionFailed, w.Result().StatusCode)
+}
+
+func putRequest(t *testing.T, uri string, count int, token uuid.UUID) *http.Request {
+	b, err := json.Marshal(putArgs{Count: &count})
+	assert.NoError(t, err)
+	r := httptest.NewRequest(http.MethodPut, uri, bytes.NewReader(b))
+	r.Header.Set("Authorization", "Bearer "+token.String())
+	return r
+}
+
+func TestRoutes_PutCounter(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	v := store.Value{
+		Count:     42,
+		AccessKey: uuid.New(),
+	}
+	nv := store.Value{
+		Count:     7,
+		AccessKey: v.AccessKey,
+	}
+
+	uri := "/yeet"
+
+	repo := mock_store.NewMockRepository(ctrl)
+
+	gomock.InOrder(
+		repo.EXPECT().Get(uri).Return(v, nil).Times(1),
+		repo.EXPECT().Apply(store.Op{Key: uri, Kind: store.OpSet, Amount: 7, AccessKey: v.AccessKey, Versions: []uint64{1}}).
+			Return(nv, nil).Times(1),
+	)
+
+	w := httptest.NewRecorder()
+	r := putRequest(t, uri, 7, v.AccessKey)
+	r.Header.Set("If-Match", `"1"`)
+
+	rs := NewRoutes(repo)
+
+	rs.PutCounter(w, r)
+
+	res := w.Result()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Empty(t, res.Header.Get("Authorization"))
+
+	buf := new(strings.Builder)
+	_, err := io.Copy(buf, res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, marshal(uri, &nv), buf.String())
+}
+
+func TestRoutes_PutCounterUnAuth(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	v := store.Value{
+		Count:     42,
+		AccessKey: uuid.New(),
+	}
+
+	uri := "/yeet"
+
+	repo := mock_store.NewMockRepository(ctrl)
+
+	repo.EXPECT().Get(uri).Return(v, nil).Times(1)
+
+	w := httptest.NewRecorder()
+	r := putRequest(t, uri, 7, uuid.New())
+
+	rs := NewRoutes(repo)
+
+	rs.PutCounter(w, r)
+
+	assert.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+}
+
+func TestRoutes_PutCounterNX(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	uri := "/yeet"
+
+	repo := mock_store.NewMockRepository(ctrl)
+
+	repo.EXPECT().Get(uri).Return(store.Value{}, nil).Times(1)
+
+	w := httptest.NewRecorder()
+	r := putRequest(t, uri, 7, uuid.New())
+
+	rs := NewRoutes(repo)
+
+	rs.PutCounter(w, r)
+
+	assert.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+}
+
+func TestRoutes_PutCounterCreate(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	token := uuid.New()
+	nv := store.Value{
+		Count:     7,
+		AccessKey: token,
+	}
+
+	uri := "/yeet"
+
+	repo := mock_store.NewMockRepository(ctrl)
+
+	gomock.InOrder(
+		repo.EXPECT().Get(uri).Return(store.Value{}, nil).Times(1),
+		repo.EXPECT().Apply(store.Op{Key: uri, Kind: store.OpCreate, Amount: 7, AccessKey: token}).
+			Return(nv, nil).Times(1),
+	)
+
+	w := httptest.NewRecorder()
+	r := putRequest(t, uri, 7, token)
+
+	rs := NewRoutesWithOptions(repo, RoutesOptions{AllowPutCreate: true})
+
+	rs.PutCounter(w, r)
+
+	res := w.Result()
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	assert.Equal(t, "Bearer "+token.String(), res.Header.Get("Authorization"))
+}
+
+func TestRoutes_PutCounterCreateRace(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	token := uuid.New()
+	nv := store.Value{
+		Count:     7,
+		AccessKey: token,
+		Version:   2,
+	}
+
+	uri := "/yeet"
+
+	repo := mock_store.NewMockRepository(ctrl)
+
+	// The counter is created by another request in between, so it is set instead
+	gomock.InOrder(
+		repo.EXPECT().Get(uri).Return(store.Value{}, nil).Times(1),
+		repo.EXPECT().Apply(store.Op{Key: uri, Kind: store.OpCreate, Amount: 7, AccessKey: token}).
+			Return(store.Value{}, store.ErrExists).Times(1),
+		repo.EXPECT().Apply(store.Op{Key: uri, Kind: store.OpSet, Amount: 7, AccessKey: token}).
+			Return(nv, nil).Times(1),
+	)
+
+	w := httptest.NewRecorder()
+	r := putRequest(t, uri, 7, token)
+
+	rs := NewRoutesWithOptions(repo, RoutesOptions{AllowPutCreate: true})
+
+	rs.PutCounter(w, r)
+
+	res := w.Result()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Empty(t, res.Header.Get("Authorization"))
+	assert.Equal(t, etag(&nv), res.Header.Get("ETag"))
+}
+
+func TestRoutes_PutCounterMissingCount(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	v := store.Value{
+		Count:     42,
+		AccessKey: uuid.New(),
+	}
+
+	uri := "/yeet"
+
+	repo := mock_store.NewMockRepository(ctrl)
+
+	repo.EXPECT().Get(uri).Return(v, nil).Times(1)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPut, uri, strings.NewReader("{}"))
+	r.Header.Set("Authorization", "Bearer "+v.AccessKey.String())
+
+	rs := NewRoutes(repo)
+
+	rs.PutCounter(w, r)
+
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+}
+
+func TestRoutes_PutCounterIfNoneMatch(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	v := store.Value{
+		Count:     42,
+		AccessKey: uuid.New(),
+	}
+
+	uri := "/yeet"
+
+	repo := mock_store.NewMockRepository(ctrl)
+
+	repo.EXPECT().Get(uri).Return(v, nil).Times(1)
+
+	w := httptest.NewRecorder()
+	r := putRequest(t, uri, 7, v.AccessKey)
+	r.Header.Set("If-None-Match", "*")
+
+	rs := NewRoutes(repo)
+
+	rs.PutCounter(w, r)
+
+	assert.Equal(t, http.StatusPreconditionFailed, w.Result().StatusCode)
+}
+
+func TestRoutes_Batch(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	token := uuid.New()
+	uri := "/yeet"
+
+	repo := mock_store.NewMockRepository(ctrl)
+
+	repo.EXPECT().Batch([]store.Op{
+		{Key: uri, Kind: store.OpIncrement, Amount: 1, AccessKey: token},
+		{Key: uri, Kind: store.OpSet, Amount: 5, AccessKey: token},
+	}, false).Return([]store.OpResult{
+		{Value: store.Value{Count: 43, AccessKey: token}},
+		{Err: store.ErrWrongAccessKey},
+	}, nil).Times(1)
+
+	w := httptest.NewRecorder()
+	body := `[
+		{"key": "/yeet", "op": "increment", "token": "` + token.String() + `"},
+		{"key": "/_reserved", "op": "increment", "token": "` + token.String() + `"},
+		{"key": "/yeet", "op": "set", "value": 5, "token": "` + token.String() + `"},
+		{"key": "/yeet", "op": "increment", "token": "invalid"}
+	]`
+	r := httptest.NewRequest(http.MethodPost, "/_batch", strings.NewReader(body))
+
+	rs := NewRoutes(repo)
+
+	rs.Batch(w, r)
+
+	res := w.Result()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	var results []batchItemResult
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&results))
+	assert.Len(t, results, 4)
+	assert.Equal(t, http.StatusOK, results[0].Status)
+	assert.Equal(t, 43, *results[0].Count)
+	assert.Equal(t, http.StatusBadRequest, results[1].Status)
+	assert.Equal(t, http.StatusUnauthorized, results[2].Status)
+	assert.Equal(t, http.StatusUnauthorized, results[3].Status)
+}
+
+func TestRoutes_BatchAtomicInvalid(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// No calls to the repository are expected
+	repo := mock_store.NewMockRepository(ctrl)
+
+	w := httptest.NewRecorder()
+	body := `[
+		{"key": "/yeet", "op": "increment", "token": "` + uuid.New().String() + `"},
+		{"key": "/yeet", "op": "explode", "token": "` + uuid.New().String() + `"}
+	]`
+	r := httptest.NewRequest(http.MethodPost, "/_batch?atomic=true", strings.NewReader(body))
+
+	rs := NewRoutes(repo)
+
+	rs.Batch(w, r)
+
+	var results []batchItemResult
+	assert.NoError(t, json.NewDecoder(w.Result().Body).Decode(&results))
+	assert.Equal(t, http.StatusFailedDependency, results[0].Status)
+	assert.Equal(t, http.StatusBadRequest, results[1].Status)
+}
+
+func TestRoutes_Query(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	repo := mock_store.NewMockRepository(ctrl)
+
+	repo.EXPECT().GetMany([]string{"/a", "/b/c"}).Return([]store.Value{
+		{Count: 42, AccessKey: uuid.New()},
+		{},
+	}, nil).Times(1)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/_query", strings.NewReader(`{"keys": ["/a", "//b/c/"]}`))
+
+	rs := NewRoutes(repo)
+
+	rs.Query(w, r)
+
+	res := w.Result()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	var counts map[string]*int
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&counts))
+	assert.Len(t, counts, 2)
+	assert.Equal(t, 42, *counts["/a"])
+	assert.Nil(t, counts["/b/c"])
+}
+
+func TestRoutes_QueryInvalidKey(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// No calls to the repository are expected
+	repo := mock_store.NewMockRepository(ctrl)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/_query", strings.NewReader(`{"keys": ["/a", "/_b"]}`))
+
+	rs := NewRoutes(repo)
+
+	rs.Query(w, r)
+
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+}
@@ -0,0 +1,282 @@
+package store
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/clientv3"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestApply_Null(t *testing.T) {
+	_, err := NewNullStore().Apply(Op{Key: "a", Kind: OpIncrement, Amount: 1})
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestApply(t *testing.T) {
+	forEachStore(t, testApply)
+}
+
+func testApply(t *testing.T, s Repository) {
+	a, b := uuid.New(), uuid.New()
+	expires := time.Now().Add(time.Hour).Unix()
+	assert.NoError(t, s.Create("/a", Value{Count: 1, AccessKey: a, Expires: expires}))
+	assert.NoError(t, s.Create("/b", Value{Count: 10, AccessKey: b}))
+
+	// Ops are only applied if all checks pass
+	_, err := s.Apply(Op{Key: "/c", Kind: OpIncrement, Amount: 1})
+	assert.Equal(t, ErrNotFound, err)
+	_, err = s.Apply(Op{Key: "/a", Kind: OpIncrement, Amount: 1, AccessKey: b})
+	assert.Equal(t, ErrWrongAccessKey, err)
+	_, err = s.Apply(Op{Key: "/a", Kind: OpDelete, AccessKey: b})
+	assert.Equal(t, ErrWrongAccessKey, err)
+	_, err = s.Apply(Op{Key: "/a", Kind: OpIncrement, Amount: 1, AccessKey: a, Versions: []uint64{0}})
+	assert.Equal(t, ErrVersionMismatch, err)
+
+	v, err := s.Get("/a")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, v.Count)
+
+	// The new value is returned, keeping the expiry
+	applied, err := s.Apply(Op{Key: "/a", Kind: OpIncrement, Amount: 5, AccessKey: a, Versions: []uint64{0, v.Version}})
+	assert.NoError(t, err)
+	assert.Equal(t, 6, applied.Count)
+	assert.Equal(t, a, applied.AccessKey)
+	assert.Equal(t, expires, applied.Expires)
+	assert.NotEqual(t, v.Version, applied.Version)
+
+	v, err = s.Get("/a")
+	assert.NoError(t, err)
+	assert.Equal(t, applied, v)
+
+	applied, err = s.Apply(Op{Key: "/a", Kind: OpDecrement, Amount: 2, AccessKey: a})
+	assert.NoError(t, err)
+	assert.Equal(t, 4, applied.Count)
+	applied, err = s.Apply(Op{Key: "/b", Kind: OpSet, Amount: 3})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, applied.Count)
+	assert.Equal(t, b, applied.AccessKey)
+
+	// Deleting returns the zero Value
+	applied, err = s.Apply(Op{Key: "/b", Kind: OpDelete, AccessKey: b})
+	assert.NoError(t, err)
+	assert.Equal(t, Value{}, applied)
+	v, err = s.Get("/b")
+	assert.NoError(t, err)
+	assert.Equal(t, Value{}, v)
+	_, err = s.Apply(Op{Key: "/b", Kind: OpDelete, AccessKey: b})
+	assert.Equal(t, ErrNotFound, err)
+
+	v, err = s.Get("/a")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, v.Count)
+}
+
+func TestApply_Create(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Repository) {
+		a, b := uuid.New(), uuid.New()
+		expires := time.Now().Add(time.Hour).Unix()
+
+		_, err := s.Apply(Op{Key: "/new", Kind: OpCreate, Amount: 1})
+		assert.Error(t, err)
+
+		created, err := s.Apply(Op{Key: "/new", Kind: OpCreate, Amount: 3, AccessKey: a, Expires: expires})
+		assert.NoError(t, err)
+		assert.Equal(t, 3, created.Count)
+		assert.Equal(t, a, created.AccessKey)
+		assert.Equal(t, expires, created.Expires)
+		assert.NotZero(t, created.Version)
+
+		v, err := s.Get("/new")
+		assert.NoError(t, err)
+		assert.Equal(t, created, v)
+
+		// Existing counters are kept
+		_, err = s.Apply(Op{Key: "/new", Kind: OpCreate, Amount: 5, AccessKey: b})
+		assert.Equal(t, ErrExists, err)
+		v, err = s.Get("/new")
+		assert.NoError(t, err)
+		assert.Equal(t, created, v)
+
+		// Only one of concurrent creates succeeds
+		var wg sync.WaitGroup
+		var succeeded int32
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, err := s.Apply(Op{Key: "/concurrent", Kind: OpCreate, Amount: i, AccessKey: uuid.New()})
+				if err == nil {
+					atomic.AddInt32(&succeeded, 1)
+				} else {
+					assert.Equal(t, ErrExists, err)
+				}
+			}(i)
+		}
+		wg.Wait()
+		assert.Equal(t, int32(1), succeeded)
+	})
+}
+
+// patchBeforeApply is the sequence of store calls a PATCH used to make: reading the counter, reading it again to
+// authenticate, incrementing it and reading the new value for the response
+func patchBeforeApply(s Repository, key string, accessKey uuid.UUID) (Value, error) {
+	for i := 0; i < 2; i++ {
+		v, err := s.Get(key)
+		if err != nil {
+			return Value{}, err
+		} else if v.AccessKey != accessKey {
+			return Value{}, ErrWrongAccessKey
+		}
+	}
+	if err := s.Increment(key); err != nil {
+		return Value{}, err
+	}
+	return s.Get(key)
+}
+
+// benchmarkPatch compares the store calls of a PATCH before and with Apply, roundTrips returns the amount of
+// requests the store has sent to its backend so far
+func benchmarkPatch(b *testing.B, s Repository, roundTrips func() int64) {
+	accessKey := uuid.New()
+	if err := s.Create("/a", Value{AccessKey: accessKey}); err != nil {
+		b.Fatal(err)
+	}
+
+	patches := map[string]func() (Value, error){
+		"Get+Increment": func() (Value, error) {
+			return patchBeforeApply(s, "/a", accessKey)
+		},
+		"Apply": func() (Value, error) {
+			return s.Apply(Op{Key: "/a", Kind: OpIncrement, Amount: 1, AccessKey: accessKey})
+		},
+	}
+	for _, name := range []string{"Get+Increment", "Apply"} {
+		patch := patches[name]
+		b.Run(name, func(b *testing.B) {
+			start := roundTrips()
+			for i := 0; i < b.N; i++ {
+				if _, err := patch(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(roundTrips()-start)/float64(b.N), "roundtrips/op")
+		})
+	}
+}
+
+func BenchmarkPatch_Memory(b *testing.B) {
+	benchmarkPatch(b, NewMemoryStore(), func() int64 { return 0 })
+}
+
+// countingHook counts the commands sent to redis, a pipeline is a single round trip
+type countingHook struct {
+	count int64
+}
+
+func (h *countingHook) BeforeProcess(ctx context.Context, _ redis.Cmder) (context.Context, error) {
+	atomic.AddInt64(&h.count, 1)
+	return ctx, nil
+}
+
+func (h *countingHook) AfterProcess(context.Context, redis.Cmder) error {
+	return nil
+}
+
+func (h *countingHook) BeforeProcessPipeline(ctx context.Context, _ []redis.Cmder) (context.Context, error) {
+	atomic.AddInt64(&h.count, 1)
+	return ctx, nil
+}
+
+func (h *countingHook) AfterProcessPipeline(context.Context, []redis.Cmder) error {
+	return nil
+}
+
+func BenchmarkPatch_Redis(b *testing.B) {
+	host := os.Getenv("REDISHOST")
+	if host == "" {
+		b.Skip("Skipping redis benchmark as REDISHOST is not set up")
+	}
+
+	s := NewRedisStore(host)
+	defer s.Close()
+	defer s.Delete("/a")
+
+	hook := &countingHook{}
+	s.rdb.AddHook(hook)
+	benchmarkPatch(b, s, func() int64 { return atomic.LoadInt64(&hook.count) })
+}
+
+// countingKV counts the requests sent to etcd
+type countingKV struct {
+	clientv3.KV
+	count int64
+}
+
+func (kv *countingKV) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	atomic.AddInt64(&kv.count, 1)
+	return kv.KV.Get(ctx, key, opts...)
+}
+
+func (kv *countingKV) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	atomic.AddInt64(&kv.count, 1)
+	return kv.KV.Put(ctx, key, val, opts...)
+}
+
+func (kv *countingKV) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
+	atomic.AddInt64(&kv.count, 1)
+	return kv.KV.Delete(ctx, key, opts...)
+}
+
+// Txn counts the round trip when the transaction is committed
+func (kv *countingKV) Txn(ctx context.Context) clientv3.Txn {
+	return &countingTxn{Txn: kv.KV.Txn(ctx), count: &kv.count}
+}
+
+type countingTxn struct {
+	clientv3.Txn
+	count *int64
+}
+
+func (txn *countingTxn) If(cs ...clientv3.Cmp) clientv3.Txn {
+	txn.Txn = txn.Txn.If(cs...)
+	return txn
+}
+
+func (txn *countingTxn) Then(ops ...clientv3.Op) clientv3.Txn {
+	txn.Txn = txn.Txn.Then(ops...)
+	return txn
+}
+
+func (txn *countingTxn) Else(ops ...clientv3.Op) clientv3.Txn {
+	txn.Txn = txn.Txn.Else(ops...)
+	return txn
+}
+
+func (txn *countingTxn) Commit() (*clientv3.TxnResponse, error) {
+	atomic.AddInt64(txn.count, 1)
+	return txn.Txn.Commit()
+}
+
+func BenchmarkPatch_Etcd(b *testing.B) {
+	host := os.Getenv("ETCDHOST")
+	if host == "" {
+		b.Skip("Skipping etcd benchmark as ETCDHOST is not set up")
+	}
+
+	s, err := NewEtcdStore([]string{host})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+	defer s.Delete("/a")
+
+	kv := &countingKV{KV: s.cli.KV}
+	s.cli.KV = kv
+	benchmarkPatch(b, s, func() int64 { return atomic.LoadInt64(&kv.count) })
+}
@@ -1,31 +1,73 @@
 package store
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"github.com/dgraph-io/badger/v2"
+	"github.com/dgraph-io/badger/v2/pb"
+	"github.com/google/uuid"
+	"time"
 )
 
 type BadgerStore struct {
 	db *badger.DB
 }
 
+// internalPrefix is the prefix of keys used by the store itself,
+// they can't collide with counters as their keys start with a slash
+const internalPrefix = "\x00"
+
+// pingKey is written and read back by Ping
+const pingKey = internalPrefix + "ping"
+
 func NewBadgerStore(path string) (*BadgerStore, error) {
 	db, err := badger.Open(badger.DefaultOptions(path))
 	if err != nil {
 		return nil, err
 	}
 
-	return &BadgerStore{db}, nil
+	return &BadgerStore{db: db}, nil
 }
 
-func (b *BadgerStore) set(key string, value Value) error {
-	return b.db.Update(func(txn *badger.Txn) error {
-		v, err := json.Marshal(&value)
-		if err != nil {
+func setTxn(txn *badger.Txn, key string, value Value) error {
+	// The version is the commit timestamp of the item
+	value.Version = 0
+	v, err := json.Marshal(&value)
+	if err != nil {
+		return err
+	}
+
+	e := badger.NewEntry([]byte(key), v)
+	if value.Expires != 0 {
+		e = e.WithTTL(value.ttl())
+	}
+
+	return txn.SetEntry(e)
+}
+
+func getTxn(txn *badger.Txn, key string) (v Value, err error) {
+	item, err := txn.Get([]byte(key))
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			return Value{}, nil
+		} else {
+			return Value{}, err
+		}
+	}
+
+	return v, item.Value(func(val []byte) error {
+		if err := json.Unmarshal(val, &v); err != nil {
 			return err
 		}
+		v.Version = item.Version()
+		return nil
+	})
+}
 
-		return txn.Set([]byte(key), v)
+func (b *BadgerStore) set(key string, value Value) error {
+	return b.db.Update(func(txn *badger.Txn) error {
+		return setTxn(txn, key, value)
 	})
 }
 
@@ -35,18 +77,48 @@ func (b *BadgerStore) Create(key string, value Value) error {
 
 func (b *BadgerStore) Get(key string) (v Value, err error) {
 	return v, b.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(key))
-		if err != nil {
-			if err == badger.ErrKeyNotFound {
-				return nil
-			} else {
+		v, err = getTxn(txn, key)
+		return err
+	})
+}
+
+func (b *BadgerStore) GetMany(keys []string) (values []Value, err error) {
+	values = make([]Value, len(keys))
+	return values, b.db.View(func(txn *badger.Txn) error {
+		for i, key := range keys {
+			if values[i], err = getTxn(txn, key); err != nil {
 				return err
 			}
 		}
+		return nil
+	})
+}
 
-		return item.Value(func(val []byte) error {
-			return json.Unmarshal(val, &v)
-		})
+func (b *BadgerStore) Scan(prefix string, fn func(key string, value Value) error) error {
+	return b.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: true, PrefetchSize: 100, Prefix: []byte(prefix)})
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			if bytes.HasPrefix(item.Key(), []byte(internalPrefix)) {
+				continue
+			}
+
+			var v Value
+			err := item.Value(func(val []byte) error {
+				return json.Unmarshal(val, &v)
+			})
+			if err != nil {
+				return err
+			}
+			v.Version = item.Version()
+
+			if err := fn(string(item.KeyCopy(nil)), v); err != nil {
+				return err
+			}
+		}
+		return nil
 	})
 }
 
@@ -78,6 +150,233 @@ func (b *BadgerStore) Decrement(key string) error {
 	return b.set(key, v)
 }
 
+// committedVersion returns the version key got from a transaction that read it at readTs and has been committed.
+// Any other commit of the key after readTs would have conflicted with the transaction, so the oldest version newer
+// than readTs is the one it wrote, even if the key has been written again since. The caller has to hold a read
+// transaction opened before the commit, which keeps badger from discarding that version.
+func committedVersion(txn *badger.Txn, key string, readTs uint64) uint64 {
+	it := txn.NewIterator(badger.IteratorOptions{AllVersions: true, Prefix: []byte(key)})
+	defer it.Close()
+
+	// Versions of a key are sorted from new to old, followed by longer keys with the same prefix
+	var version uint64
+	for it.Seek([]byte(key)); it.Valid() && bytes.Equal(it.Item().Key(), []byte(key)); it.Next() {
+		if it.Item().Version() <= readTs {
+			break
+		}
+		version = it.Item().Version()
+	}
+	return version
+}
+
+// Apply retries on conflicts like Batch, the version of the new value is looked up after committing
+func (b *BadgerStore) Apply(op Op) (v Value, err error) {
+	guard := b.db.NewTransaction(false)
+	defer guard.Discard()
+
+	var readTs uint64
+	for i := 0; i < maxBatchRetries; i++ {
+		err = b.db.Update(func(txn *badger.Txn) error {
+			readTs = txn.ReadTs()
+			old, err := getTxn(txn, op.Key)
+			if err != nil {
+				return err
+			}
+			if v, err = applyOp(op, old); err != nil {
+				return err
+			}
+
+			if v == (Value{}) {
+				return txn.Delete([]byte(op.Key))
+			}
+			return setTxn(txn, op.Key, v)
+		})
+		if err != badger.ErrConflict {
+			break
+		}
+	}
+	if err == badger.ErrConflict {
+		return Value{}, errTooManyConflicts
+	} else if err != nil || v == (Value{}) {
+		return Value{}, err
+	}
+
+	return v, b.db.View(func(txn *badger.Txn) error {
+		v.Version = committedVersion(txn, op.Key, readTs)
+		return nil
+	})
+}
+
+func (b *BadgerStore) Batch(ops []Op, atomic bool) (results []OpResult, err error) {
+	guard := b.db.NewTransaction(false)
+	defer guard.Discard()
+
+	var readTs uint64
+	for i := 0; i < maxBatchRetries; i++ {
+		err = b.db.Update(func(txn *badger.Txn) error {
+			readTs = txn.ReadTs()
+			var changed map[string]Value
+			var err error
+			results, changed, err = applyBatch(ops, atomic, func(key string) (Value, error) {
+				return getTxn(txn, key)
+			})
+			if err != nil {
+				return err
+			}
+
+			for key, v := range changed {
+				if err := setTxn(txn, key, v); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != badger.ErrConflict {
+			break
+		}
+	}
+	if err == badger.ErrConflict {
+		return nil, errTooManyConflicts
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Versions are commit timestamps, which are only known after committing
+	return results, b.db.View(func(txn *badger.Txn) error {
+		for i, op := range ops {
+			if results[i].Err == nil {
+				results[i].Value.Version = committedVersion(txn, op.Key, readTs)
+			}
+		}
+		return nil
+	})
+}
+
+// watchBarrierPrefix is the prefix of the keys Watch writes to find out when its subscription is active
+const watchBarrierPrefix = internalPrefix + "watch/"
+
+// event turns a change published by badger into an event, the old value is the previous version of the key
+func (b *BadgerStore) event(kv *pb.KV) (Event, error) {
+	var value, old Value
+	// Deletes are published without a value
+	if len(kv.Value) > 0 {
+		if err := json.Unmarshal(kv.Value, &value); err != nil {
+			return Event{}, err
+		}
+		value.Version = kv.Version
+	}
+
+	err := b.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{AllVersions: true, Prefix: kv.Key})
+		defer it.Close()
+
+		// Versions of a key are sorted from new to old, followed by longer keys with the same prefix
+		for it.Seek(kv.Key); it.Valid() && bytes.Equal(it.Item().Key(), kv.Key); it.Next() {
+			item := it.Item()
+			if item.Version() >= kv.Version {
+				continue
+			} else if item.IsDeletedOrExpired() {
+				return nil
+			}
+			return item.Value(func(val []byte) error {
+				if err := json.Unmarshal(val, &old); err != nil {
+					return err
+				}
+				old.Version = item.Version()
+				return nil
+			})
+		}
+		return nil
+	})
+
+	return newEvent(string(kv.Key), old, value), err
+}
+
+// Watch uses the native subscriptions of badger. Badger doesn't tell when a subscription is active, so a barrier
+// key is written until the subscription has seen it, after which no change can be missed anymore.
+// The old value of an event is only known as long as badger hasn't discarded the previous version of the key.
+func (b *BadgerStore) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	barrier := []byte(watchBarrierPrefix + uuid.New().String())
+	ready := make(chan struct{})
+	ch := make(chan Event, watchBuffer)
+
+	go func() {
+		defer close(ch)
+		defer cancel()
+
+		isReady := false
+		_ = b.db.Subscribe(ctx, func(kvs *badger.KVList) error {
+			for _, kv := range kvs.Kv {
+				if bytes.Equal(kv.Key, barrier) && !isReady {
+					isReady = true
+					close(ready)
+				}
+				if bytes.HasPrefix(kv.Key, []byte(internalPrefix)) {
+					continue
+				}
+
+				e, err := b.event(kv)
+				if err != nil {
+					continue
+				}
+
+				select {
+				case ch <- e:
+				default:
+					return errSlowWatcher
+				}
+			}
+			return nil
+		}, []byte(prefix), barrier)
+	}()
+
+	defer b.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(barrier)
+	})
+	for {
+		err := b.db.Update(func(txn *badger.Txn) error {
+			return txn.Set(barrier, nil)
+		})
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+
+		select {
+		case <-ready:
+			return ch, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// Ping writes a sentinel value and reads it back
+func (b *BadgerStore) Ping(ctx context.Context) error {
+	sentinel := []byte(uuid.New().String())
+	err := b.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(pingKey), sentinel)
+	})
+	if err != nil {
+		return err
+	}
+
+	return b.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(pingKey))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			if !bytes.Equal(val, sentinel) {
+				return errPingMismatch
+			}
+			return nil
+		})
+	})
+}
+
 func (b *BadgerStore) Close() error {
 	return b.db.Close()
 }
@@ -0,0 +1,42 @@
+package store
+
+import (
+	"github.com/dgraph-io/badger/v2"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestBadgerStore_CommittedVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "counter-badger")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewBadgerStore(dir)
+	assert.NoError(t, err)
+	defer s.Close()
+
+	guard := s.db.NewTransaction(false)
+	defer guard.Discard()
+
+	// The version written by a transaction is found even if the key has been written again since
+	var readTs uint64
+	assert.NoError(t, s.db.Update(func(txn *badger.Txn) error {
+		readTs = txn.ReadTs()
+		return setTxn(txn, "/key", Value{Count: 1, AccessKey: uuid.New()})
+	}))
+	committed, err := s.Get("/key")
+	assert.NoError(t, err)
+	assert.NoError(t, s.Create("/key", Value{Count: 2, AccessKey: uuid.New()}))
+	assert.NoError(t, s.Create("/keys", Value{Count: 3, AccessKey: uuid.New()}))
+
+	latest, err := s.Get("/key")
+	assert.NoError(t, err)
+	assert.NotEqual(t, committed.Version, latest.Version)
+	assert.NoError(t, s.db.View(func(txn *badger.Txn) error {
+		assert.Equal(t, committed.Version, committedVersion(txn, "/key", readTs))
+		return nil
+	}))
+}
@@ -0,0 +1,182 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+)
+
+// OpKind is the kind of mutation an Op applies
+type OpKind string
+
+const (
+	// OpIncrement adds the amount to the count
+	OpIncrement OpKind = "increment"
+	// OpDecrement subtracts the amount from the count
+	OpDecrement OpKind = "decrement"
+	// OpSet sets the count to the amount
+	OpSet OpKind = "set"
+	// OpDelete deletes the counter, it is only supported by Apply
+	OpDelete OpKind = "delete"
+	// OpCreate creates the counter with the amount as count if it doesn't exist, it is only supported by Apply
+	OpCreate OpKind = "create"
+)
+
+// Op is a single mutation of an existing counter, or the creation of a new one with OpCreate
+type Op struct {
+	// Key is the key of the counter
+	Key string
+	// Kind is the kind of mutation
+	Kind OpKind
+	// Amount is the amount added, subtracted or set
+	Amount int
+	// AccessKey has to match the access key of the counter, uuid.Nil skips the check.
+	// With OpCreate it is the access key of the new counter and required.
+	AccessKey uuid.UUID
+	// Versions are the versions the counter may have, the op fails if it has another one. Empty skips the check,
+	// stored counters never have version 0 so it can be used to match none. OpCreate doesn't check them.
+	Versions []uint64
+	// Expires is the expiry time of a counter created with OpCreate, 0 never expires
+	Expires int64
+}
+
+// OpResult is the outcome of a single Op in a batch
+type OpResult struct {
+	// Value is the value of the counter after the op was applied
+	Value Value
+	// Err is ErrNotFound, ErrWrongAccessKey, ErrVersionMismatch or ErrAborted if the op was not applied
+	Err error
+}
+
+var (
+	// ErrNotFound is returned for ops on counters that don't exist
+	ErrNotFound = errors.New("counter not found")
+	// ErrWrongAccessKey is returned for ops with an access key not matching the counter
+	ErrWrongAccessKey = errors.New("wrong access key")
+	// ErrVersionMismatch is returned for ops on counters that don't have any of the versions of the op
+	ErrVersionMismatch = errors.New("counter has been modified")
+	// ErrExists is returned for OpCreate on counters that already exist
+	ErrExists = errors.New("counter already exists")
+	// ErrAborted is returned for ops that were not applied because another op in an atomic batch failed
+	ErrAborted = errors.New("aborted because another op in the batch failed")
+)
+
+// check checks that the op may be applied to the value
+func (op *Op) check(v *Value) error {
+	if v.AccessKey == uuid.Nil {
+		return ErrNotFound
+	}
+	if op.AccessKey != uuid.Nil && op.AccessKey != v.AccessKey {
+		return ErrWrongAccessKey
+	}
+	if len(op.Versions) == 0 {
+		return nil
+	}
+	for _, version := range op.Versions {
+		if version == v.Version {
+			return nil
+		}
+	}
+	return ErrVersionMismatch
+}
+
+// apply applies the op to the value and increases the version
+func (op *Op) apply(v *Value) error {
+	if err := op.check(v); err != nil {
+		return err
+	}
+
+	switch op.Kind {
+	case OpIncrement:
+		v.Count += op.Amount
+	case OpDecrement:
+		v.Count -= op.Amount
+	case OpSet:
+		v.Count = op.Amount
+	default:
+		return fmt.Errorf("invalid op: %v", op.Kind)
+	}
+	v.Version++
+
+	return nil
+}
+
+// create returns the value created by an OpCreate if the counter with the value v doesn't exist
+func (op *Op) create(v *Value) (Value, error) {
+	if op.AccessKey == uuid.Nil {
+		return Value{}, fmt.Errorf("invalid op: %v without access key", op.Kind)
+	} else if v.AccessKey != uuid.Nil {
+		return Value{}, ErrExists
+	}
+	return Value{Count: op.Amount, AccessKey: op.AccessKey, Version: v.Version + 1, Expires: op.Expires}, nil
+}
+
+// applyOp applies a single op to the current value of its counter and returns the value to write,
+// the zero Value if the counter has to be deleted. It implements Apply for stores that can read and write atomically.
+func applyOp(op Op, v Value) (Value, error) {
+	if op.Kind == OpCreate {
+		return op.create(&v)
+	} else if op.Kind == OpDelete {
+		return Value{}, op.check(&v)
+	}
+	if err := op.apply(&v); err != nil {
+		return Value{}, err
+	}
+	return v, nil
+}
+
+// applyBatch applies ops in order on top of the values returned by get, which is called once per key.
+// It returns the result of every op and the new values of all keys that have to be written.
+// In atomic mode nothing has to be written if any op failed.
+func applyBatch(ops []Op, atomic bool, get func(key string) (Value, error)) ([]OpResult, map[string]Value, error) {
+	values := make(map[string]Value)
+	changed := make(map[string]Value)
+	results := make([]OpResult, len(ops))
+	failed := false
+
+	for i := range ops {
+		op := &ops[i]
+		v, ok := values[op.Key]
+		if !ok {
+			var err error
+			if v, err = get(op.Key); err != nil {
+				return nil, nil, err
+			}
+			values[op.Key] = v
+		}
+
+		if err := op.apply(&v); err != nil {
+			results[i].Err = err
+			failed = true
+			continue
+		}
+
+		values[op.Key] = v
+		changed[op.Key] = v
+		results[i].Value = v
+	}
+
+	if atomic && failed {
+		for i := range results {
+			if results[i].Err == nil {
+				results[i] = OpResult{Err: ErrAborted}
+			}
+		}
+		return results, nil, nil
+	}
+
+	return results, changed, nil
+}
+
+// batchKeys returns the distinct keys of the ops in order of appearance
+func batchKeys(ops []Op) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	for _, op := range ops {
+		if !seen[op.Key] {
+			seen[op.Key] = true
+			keys = append(keys, op.Key)
+		}
+	}
+	return keys
+}
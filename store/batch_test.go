@@ -0,0 +1,76 @@
+package store
+
+import (
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBatch_Null(t *testing.T) {
+	results, err := NewNullStore().Batch([]Op{{Key: "a", Kind: OpIncrement, Amount: 1}}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, ErrNotFound, results[0].Err)
+}
+
+func TestBatch(t *testing.T) {
+	forEachStore(t, testBatch)
+}
+
+func testBatch(t *testing.T, s Repository) {
+	a, b := uuid.New(), uuid.New()
+	assert.NoError(t, s.Create("/a", Value{Count: 1, AccessKey: a}))
+	assert.NoError(t, s.Create("/b", Value{Count: 10, AccessKey: b}))
+
+	// Ops on the same key see each other
+	results, err := s.Batch([]Op{
+		{Key: "/a", Kind: OpIncrement, Amount: 5, AccessKey: a},
+		{Key: "/b", Kind: OpSet, Amount: 3, AccessKey: b},
+		{Key: "/a", Kind: OpDecrement, Amount: 1, AccessKey: a},
+	}, true)
+	assert.NoError(t, err)
+	assert.Len(t, results, 3)
+	for _, res := range results {
+		assert.NoError(t, res.Err)
+	}
+	assert.Equal(t, 6, results[0].Value.Count)
+	assert.Equal(t, 3, results[1].Value.Count)
+	assert.Equal(t, 5, results[2].Value.Count)
+
+	v, err := s.Get("/a")
+	assert.NoError(t, err)
+	assert.Equal(t, 5, v.Count)
+	assert.Equal(t, results[2].Value.Version, v.Version)
+
+	// Atomic batches with a failing op apply nothing
+	results, err = s.Batch([]Op{
+		{Key: "/a", Kind: OpIncrement, Amount: 1, AccessKey: a},
+		{Key: "/b", Kind: OpIncrement, Amount: 1, AccessKey: a},
+		{Key: "/c", Kind: OpIncrement, Amount: 1},
+	}, true)
+	assert.NoError(t, err)
+	assert.Equal(t, ErrAborted, results[0].Err)
+	assert.Equal(t, ErrWrongAccessKey, results[1].Err)
+	assert.Equal(t, ErrNotFound, results[2].Err)
+
+	v, err = s.Get("/a")
+	assert.NoError(t, err)
+	assert.Equal(t, 5, v.Count)
+
+	// Otherwise the other ops are applied
+	results, err = s.Batch([]Op{
+		{Key: "/a", Kind: OpIncrement, Amount: 1, AccessKey: a},
+		{Key: "/b", Kind: OpIncrement, Amount: 1, AccessKey: a},
+		{Key: "/b", Kind: OpIncrement, Amount: 1},
+	}, false)
+	assert.NoError(t, err)
+	assert.NoError(t, results[0].Err)
+	assert.Equal(t, ErrWrongAccessKey, results[1].Err)
+	assert.NoError(t, results[2].Err)
+
+	v, err = s.Get("/a")
+	assert.NoError(t, err)
+	assert.Equal(t, 6, v.Count)
+	v, err = s.Get("/b")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, v.Count)
+}
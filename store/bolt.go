@@ -0,0 +1,369 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+	"sync"
+	"time"
+)
+
+var (
+	// boltCounters is the bucket holding all counters
+	boltCounters = []byte("counters")
+	// boltInternal is the bucket for keys used by the store itself
+	boltInternal = []byte("internal")
+)
+
+// BoltStore keeps all counters in a single bucket of a bbolt database file, expired counters are purged periodically
+type BoltStore struct {
+	db *bolt.DB
+	// mutex serializes writes, so events are published in the order they were committed
+	mutex  sync.Mutex
+	events broadcaster
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	// Only one process can open the file, give up instead of waiting forever if another one has it open
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltCounters, boltInternal} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &BoltStore{db: db, cancel: cancel}
+	purgeEvery(ctx, &s.wg, purgeInterval, s.purge)
+	return s, nil
+}
+
+// decodeBolt decodes a value, expired values are treated like values that do not exist
+func decodeBolt(b []byte) (Value, error) {
+	if b == nil {
+		return Value{}, nil
+	}
+
+	var v Value
+	if err := json.Unmarshal(b, &v); err != nil {
+		return Value{}, err
+	} else if v.expired() {
+		return Value{}, nil
+	}
+	return v, nil
+}
+
+func getBolt(b *bolt.Bucket, key string) (Value, error) {
+	return decodeBolt(b.Get([]byte(key)))
+}
+
+func putBolt(b *bolt.Bucket, key string, v Value) error {
+	val, err := json.Marshal(&v)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), val)
+}
+
+// update runs fn in a write transaction on the counters bucket and publishes the events it returns once committed
+func (s *BoltStore) update(fn func(b *bolt.Bucket) ([]Event, error)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var events []Event
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		events, err = fn(tx.Bucket(boltCounters))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, e := range events {
+		s.events.publish(e)
+	}
+	return nil
+}
+
+func (s *BoltStore) Get(key string) (v Value, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		v, err = getBolt(tx.Bucket(boltCounters), key)
+		return err
+	})
+	return v, err
+}
+
+func (s *BoltStore) GetMany(keys []string) ([]Value, error) {
+	values := make([]Value, len(keys))
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltCounters)
+		for i, key := range keys {
+			var err error
+			if values[i], err = getBolt(b, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// Scan seeks to the prefix and reads the counters in pages, fn is called between pages so it can use the store
+func (s *BoltStore) Scan(prefix string, fn func(key string, value Value) error) error {
+	// last is the key the previous page ended with
+	var last []byte
+	for {
+		var keys []string
+		var values []Value
+		err := s.db.View(func(tx *bolt.Tx) error {
+			seek := []byte(prefix)
+			if last != nil {
+				seek = last
+			}
+			c := tx.Bucket(boltCounters).Cursor()
+			k, val := c.Seek(seek)
+			if last != nil && bytes.Equal(k, last) {
+				k, val = c.Next()
+			}
+
+			for ; k != nil && bytes.HasPrefix(k, []byte(prefix)) && len(keys) < scanPageSize; k, val = c.Next() {
+				v, err := decodeBolt(val)
+				if err != nil {
+					return err
+				} else if v == (Value{}) {
+					continue
+				}
+				keys, values = append(keys, string(k)), append(values, v)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for i, key := range keys {
+			if err := fn(key, values[i]); err != nil {
+				return err
+			}
+		}
+		if len(keys) < scanPageSize {
+			return nil
+		}
+		last = []byte(keys[len(keys)-1])
+	}
+}
+
+func (s *BoltStore) Create(key string, value Value) error {
+	return s.update(func(b *bolt.Bucket) ([]Event, error) {
+		old, err := getBolt(b, key)
+		if err != nil {
+			return nil, err
+		}
+
+		value.Version = old.Version + 1
+		if err := putBolt(b, key, value); err != nil {
+			return nil, err
+		}
+		return []Event{newEvent(key, old, value)}, nil
+	})
+}
+
+func (s *BoltStore) Delete(key string) error {
+	return s.update(func(b *bolt.Bucket) ([]Event, error) {
+		old, err := getBolt(b, key)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := b.Delete([]byte(key)); err != nil || old == (Value{}) {
+			return nil, err
+		}
+		return []Event{newEvent(key, old, Value{})}, nil
+	})
+}
+
+// add adds delta to the count of a key within a single transaction
+func (s *BoltStore) add(key string, delta int) error {
+	return s.update(func(b *bolt.Bucket) ([]Event, error) {
+		old, err := getBolt(b, key)
+		if err != nil {
+			return nil, err
+		}
+
+		v := old
+		v.Count += delta
+		v.Version++
+		if err := putBolt(b, key, v); err != nil {
+			return nil, err
+		}
+		return []Event{newEvent(key, old, v)}, nil
+	})
+}
+
+func (s *BoltStore) Increment(key string) error {
+	return s.add(key, 1)
+}
+
+func (s *BoltStore) Decrement(key string) error {
+	return s.add(key, -1)
+}
+
+func (s *BoltStore) Apply(op Op) (v Value, err error) {
+	err = s.update(func(b *bolt.Bucket) ([]Event, error) {
+		old, err := getBolt(b, op.Key)
+		if err != nil {
+			return nil, err
+		}
+		if v, err = applyOp(op, old); err != nil {
+			return nil, err
+		}
+
+		if v == (Value{}) {
+			err = b.Delete([]byte(op.Key))
+		} else {
+			err = putBolt(b, op.Key, v)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return []Event{newEvent(op.Key, old, v)}, nil
+	})
+	if err != nil {
+		return Value{}, err
+	}
+	return v, nil
+}
+
+func (s *BoltStore) Batch(ops []Op, atomic bool) (results []OpResult, err error) {
+	err = s.update(func(b *bolt.Bucket) ([]Event, error) {
+		old := make(map[string]Value)
+		var changed map[string]Value
+		var err error
+		results, changed, err = applyBatch(ops, atomic, func(key string) (Value, error) {
+			v, err := getBolt(b, key)
+			old[key] = v
+			return v, err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		events := make([]Event, 0, len(changed))
+		for key, v := range changed {
+			if err := putBolt(b, key, v); err != nil {
+				return nil, err
+			}
+			events = append(events, newEvent(key, old[key], v))
+		}
+		return events, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// purge deletes the counters that have expired, without events as they already don't exist for readers.
+// Keys are checked a page at a time in read transactions, only pages with expired counters are written.
+func (s *BoltStore) purge() error {
+	// last is the key the previous page ended with
+	var last []byte
+	for {
+		n := 0
+		var expired [][]byte
+		err := s.db.View(func(tx *bolt.Tx) error {
+			c := tx.Bucket(boltCounters).Cursor()
+			k, v := c.First()
+			if last != nil {
+				if k, v = c.Seek(last); bytes.Equal(k, last) {
+					k, v = c.Next()
+				}
+			}
+
+			for ; k != nil && n < scanPageSize; k, v = c.Next() {
+				n++
+				last = append(last[:0], k...)
+				var val Value
+				if err := json.Unmarshal(v, &val); err != nil {
+					return err
+				}
+				if val.expired() {
+					expired = append(expired, append([]byte(nil), k...))
+				}
+			}
+			return nil
+		})
+
+		if err == nil && len(expired) > 0 {
+			err = s.update(func(b *bolt.Bucket) ([]Event, error) {
+				for _, key := range expired {
+					// The counter may have been written since it was read
+					var val Value
+					if v := b.Get(key); v == nil {
+						continue
+					} else if err := json.Unmarshal(v, &val); err != nil {
+						return nil, err
+					} else if !val.expired() {
+						continue
+					}
+					if err := b.Delete(key); err != nil {
+						return nil, err
+					}
+				}
+				return nil, nil
+			})
+		}
+		if err != nil || n < scanPageSize {
+			return err
+		}
+	}
+}
+
+func (s *BoltStore) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	return s.events.watch(ctx, prefix), nil
+}
+
+// Ping writes a sentinel value and reads it back
+func (s *BoltStore) Ping(ctx context.Context) error {
+	sentinel := []byte(uuid.New().String())
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltInternal).Put([]byte("ping"), sentinel)
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.db.View(func(tx *bolt.Tx) error {
+		if !bytes.Equal(tx.Bucket(boltInternal).Get([]byte("ping")), sentinel) {
+			return errPingMismatch
+		}
+		return nil
+	})
+}
+
+// Close stops purging and closes the database
+func (s *BoltStore) Close() error {
+	s.cancel()
+	s.wg.Wait()
+	return s.db.Close()
+}
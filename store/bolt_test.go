@@ -0,0 +1,156 @@
+package store
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestBoltStore(t *testing.T) (*BoltStore, string, func()) {
+	dir, err := ioutil.TempDir("", "counter-bolt")
+	assert.NoError(t, err)
+	path := filepath.Join(dir, "counter.bolt")
+
+	s, err := NewBoltStore(path)
+	assert.NoError(t, err)
+
+	return s, path, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBoltStore(t *testing.T) {
+	s, path, cleanup := newTestBoltStore(t)
+	defer cleanup()
+
+	accessKey := uuid.New()
+	assert.NoError(t, s.Create("/key", Value{Count: 42, AccessKey: accessKey}))
+	assert.NoError(t, s.Increment("/key"))
+	assert.NoError(t, s.Increment("/key"))
+	assert.NoError(t, s.Decrement("/key"))
+
+	v, err := s.Get("/key")
+	assert.NoError(t, err)
+	assert.Equal(t, Value{Count: 43, AccessKey: accessKey, Version: 4}, v)
+
+	// The data survives reopening the database
+	assert.NoError(t, s.Close())
+	s, err = NewBoltStore(path)
+	assert.NoError(t, err)
+	defer s.Close()
+
+	v, err = s.Get("/key")
+	assert.NoError(t, err)
+	assert.Equal(t, 43, v.Count)
+
+	assert.NoError(t, s.Delete("/key"))
+	v, err = s.Get("/key")
+	assert.NoError(t, err)
+	assert.Equal(t, Value{}, v)
+}
+
+func TestBoltStore_ConcurrentIncrements(t *testing.T) {
+	s, _, cleanup := newTestBoltStore(t)
+	defer cleanup()
+
+	assert.NoError(t, s.Create("/key", Value{AccessKey: uuid.New()}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				assert.NoError(t, s.Increment("/key"))
+			}
+		}()
+	}
+	wg.Wait()
+
+	v, err := s.Get("/key")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, v.Count)
+}
+
+func TestBoltStore_Expires(t *testing.T) {
+	s, _, cleanup := newTestBoltStore(t)
+	defer cleanup()
+
+	assert.NoError(t, s.Create("/key", Value{Count: 42, AccessKey: uuid.New(), Expires: time.Now().Add(-time.Second).Unix()}))
+
+	v, err := s.Get("/key")
+	assert.NoError(t, err)
+	assert.Equal(t, Value{}, v)
+
+	assert.NoError(t, s.Scan("/", func(key string, value Value) error {
+		t.Errorf("Expired counter %v was scanned", key)
+		return nil
+	}))
+}
+
+func TestBoltStore_Purge(t *testing.T) {
+	s, _, cleanup := newTestBoltStore(t)
+	defer cleanup()
+
+	// More counters than fit in a page, every other one has expired
+	n := scanPageSize + 10
+	for i := 0; i < n; i++ {
+		v := Value{Count: i, AccessKey: uuid.New()}
+		if i%2 == 0 {
+			v.Expires = time.Now().Add(-time.Second).Unix()
+		}
+		assert.NoError(t, s.Create(fmt.Sprintf("/purge/%05d", i), v))
+	}
+
+	// Expired counters are removed from the bucket
+	assert.NoError(t, s.purge())
+	var stored int
+	assert.NoError(t, s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltCounters).ForEach(func(k, v []byte) error {
+			stored++
+			return nil
+		})
+	}))
+	assert.Equal(t, n/2, stored)
+
+	// Without expired counters nothing is written
+	txID := func() int {
+		var id int
+		assert.NoError(t, s.db.View(func(tx *bolt.Tx) error {
+			id = tx.ID()
+			return nil
+		}))
+		return id
+	}
+	before := txID()
+	assert.NoError(t, s.purge())
+	assert.Equal(t, before, txID())
+}
+
+func TestBoltStore_ScanPages(t *testing.T) {
+	s, _, cleanup := newTestBoltStore(t)
+	defer cleanup()
+
+	n := scanPageSize + 10
+	for i := 0; i < n; i++ {
+		assert.NoError(t, s.Create(fmt.Sprintf("/page/%05d", i), Value{Count: i, AccessKey: uuid.New()}))
+	}
+	assert.NoError(t, s.Create("/pages", Value{AccessKey: uuid.New()}))
+
+	// Writing during a scan doesn't block
+	seen := make(map[string]bool)
+	assert.NoError(t, s.Scan("/page/", func(key string, value Value) error {
+		assert.False(t, seen[key], "Key %v was scanned twice", key)
+		seen[key] = true
+		return s.Increment(key)
+	}))
+	assert.Len(t, seen, n)
+}
@@ -0,0 +1,334 @@
+package store
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// cacheRewatchDelay is how long CachingStore waits before watching again after a watch failed or ended
+const cacheRewatchDelay = time.Second
+
+// CacheOptions configures a CachingStore
+type CacheOptions struct {
+	// Size is the maximum amount of cached keys, the least recently used ones are evicted first
+	Size int
+	// TTL is how long a value is cached, it bounds how stale values written by other replicas can be
+	TTL time.Duration
+	// Watch invalidates cached keys when the wrapped store reports a change, which includes changes made by other
+	// replicas with backends that notify about them
+	Watch bool
+}
+
+// cacheEntry is a cached value, the zero Value caches that the key doesn't exist
+type cacheEntry struct {
+	key    string
+	value  Value
+	stored time.Time
+}
+
+// pendingRead tracks the reads of a key from the wrapped store that are in progress, including the writes of Apply.
+// Its generation is increased whenever the key is invalidated meanwhile, so they don't cache what they read.
+type pendingRead struct {
+	count int
+	gen   uint64
+}
+
+// CachingStore is a Repository decorator caching the values read with Get and GetMany. Keys are invalidated when
+// they are written through the cache and, with CacheOptions.Watch, when the wrapped store reports a change.
+// Values cached while watching isn't possible are only bounded by CacheOptions.TTL.
+type CachingStore struct {
+	next Repository
+	opts CacheOptions
+
+	// mutex guards the cache and the pending reads, which are only tracked while they are in progress
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	pending map[string]*pendingRead
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewCachingStore wraps next, watching it for changes in the background until it is closed if opts.Watch is set
+func NewCachingStore(next Repository, opts CacheOptions) *CachingStore {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &CachingStore{
+		next:    next,
+		opts:    opts,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		pending: make(map[string]*pendingRead),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+
+	if opts.Watch {
+		s.wg.Add(1)
+		go s.watch()
+	}
+	return s
+}
+
+// watch invalidates keys the wrapped store reports changes of. Changes may have been missed before a watch is
+// established and after it ends, so the cache is cleared both times.
+func (s *CachingStore) watch() {
+	defer s.wg.Done()
+
+	for {
+		events, err := s.next.Watch(s.ctx, "")
+		if err == nil {
+			s.clear()
+			for e := range events {
+				s.invalidate(e.Key)
+			}
+		}
+		s.clear()
+
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(cacheRewatchDelay):
+		}
+	}
+}
+
+// lookup returns the cached value of key if it is fresh. Otherwise the key has to be read from the wrapped store,
+// which is registered and the generation to pass to store or release is returned.
+func (s *CachingStore) lookup(key string) (Value, bool, uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	el, ok := s.entries[key]
+	if !ok {
+		return Value{}, false, s.begin(key)
+	}
+	entry := el.Value.(*cacheEntry)
+	if time.Since(entry.stored) >= s.opts.TTL {
+		s.lru.Remove(el)
+		delete(s.entries, key)
+		return Value{}, false, s.begin(key)
+	}
+
+	s.lru.MoveToFront(el)
+	if entry.value.expired() {
+		return Value{}, true, 0
+	}
+	return entry.value, true, 0
+}
+
+// begin registers a read of key from the wrapped store and returns its generation, s.mutex has to be held
+func (s *CachingStore) begin(key string) uint64 {
+	p, ok := s.pending[key]
+	if !ok {
+		p = &pendingRead{}
+		s.pending[key] = p
+	}
+	p.count++
+	return p.gen
+}
+
+// finish unregisters a read of key and reports whether the key wasn't invalidated since gen,
+// s.mutex has to be held
+func (s *CachingStore) finish(key string, gen uint64) bool {
+	p := s.pending[key]
+	ok := p.gen == gen
+	if p.count--; p.count == 0 {
+		delete(s.pending, key)
+	}
+	return ok
+}
+
+// release unregisters a read of key that failed
+func (s *CachingStore) release(key string, gen uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.finish(key, gen)
+}
+
+// store caches the value of key read from the wrapped store, unless the key was invalidated since gen
+func (s *CachingStore) store(key string, value Value, gen uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.finish(key, gen) {
+		s.put(key, value)
+	}
+}
+
+// put caches the value of key and evicts the least recently used keys beyond the size, s.mutex has to be held
+func (s *CachingStore) put(key string, value Value) {
+	if el, ok := s.entries[key]; ok {
+		entry := el.Value.(*cacheEntry)
+		entry.value, entry.stored = value, time.Now()
+		s.lru.MoveToFront(el)
+		return
+	}
+
+	s.entries[key] = s.lru.PushFront(&cacheEntry{key: key, value: value, stored: time.Now()})
+	for s.lru.Len() > s.opts.Size {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// update caches the value of key after writing it, unless the key was invalidated since gen
+func (s *CachingStore) update(key string, value Value, gen uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ok := s.finish(key, gen)
+	// Reads that started before the write mustn't cache what they read
+	s.remove(key)
+	if ok {
+		s.put(key, value)
+	}
+}
+
+// remove invalidates the pending reads of key and removes it from the cache, s.mutex has to be held
+func (s *CachingStore) remove(key string) {
+	if p, ok := s.pending[key]; ok {
+		p.gen++
+	}
+	if el, ok := s.entries[key]; ok {
+		s.lru.Remove(el)
+		delete(s.entries, key)
+	}
+}
+
+func (s *CachingStore) invalidate(keys ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, key := range keys {
+		s.remove(key)
+	}
+}
+
+func (s *CachingStore) clear() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, p := range s.pending {
+		p.gen++
+	}
+	s.entries = make(map[string]*list.Element)
+	s.lru.Init()
+}
+
+func (s *CachingStore) Get(key string) (Value, error) {
+	v, ok, gen := s.lookup(key)
+	if ok {
+		return v, nil
+	}
+
+	v, err := s.next.Get(key)
+	if err != nil {
+		s.release(key, gen)
+		return Value{}, err
+	}
+	s.store(key, v, gen)
+	return v, nil
+}
+
+// GetMany only reads the keys that aren't cached from the wrapped store
+func (s *CachingStore) GetMany(keys []string) ([]Value, error) {
+	values := make([]Value, len(keys))
+	var missing []string
+	var indexes []int
+	var gens []uint64
+	for i, key := range keys {
+		v, ok, gen := s.lookup(key)
+		if ok {
+			values[i] = v
+		} else {
+			missing, indexes, gens = append(missing, key), append(indexes, i), append(gens, gen)
+		}
+	}
+	if len(missing) == 0 {
+		return values, nil
+	}
+
+	read, err := s.next.GetMany(missing)
+	if err != nil {
+		for i, key := range missing {
+			s.release(key, gens[i])
+		}
+		return nil, err
+	}
+	for i, key := range missing {
+		values[indexes[i]] = read[i]
+		s.store(key, read[i], gens[i])
+	}
+	return values, nil
+}
+
+// Scan isn't cached, as it would only be useful for repeated scans of the same prefix
+func (s *CachingStore) Scan(prefix string, fn func(key string, value Value) error) error {
+	return s.next.Scan(prefix, fn)
+}
+
+func (s *CachingStore) Create(key string, value Value) error {
+	defer s.invalidate(key)
+	return s.next.Create(key, value)
+}
+
+func (s *CachingStore) Delete(key string) error {
+	defer s.invalidate(key)
+	return s.next.Delete(key)
+}
+
+func (s *CachingStore) Increment(key string) error {
+	defer s.invalidate(key)
+	return s.next.Increment(key)
+}
+
+func (s *CachingStore) Decrement(key string) error {
+	defer s.invalidate(key)
+	return s.next.Decrement(key)
+}
+
+// Apply caches the new value, so reading it right after doesn't reach the wrapped store
+func (s *CachingStore) Apply(op Op) (Value, error) {
+	s.mutex.Lock()
+	gen := s.begin(op.Key)
+	s.mutex.Unlock()
+
+	v, err := s.next.Apply(op)
+	if err != nil {
+		s.invalidate(op.Key)
+		s.release(op.Key, gen)
+		return Value{}, err
+	}
+	s.update(op.Key, v, gen)
+	return v, nil
+}
+
+func (s *CachingStore) Batch(ops []Op, atomic bool) ([]OpResult, error) {
+	defer s.invalidate(batchKeys(ops)...)
+	return s.next.Batch(ops, atomic)
+}
+
+func (s *CachingStore) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	return s.next.Watch(ctx, prefix)
+}
+
+// Ping forwards to the wrapped store if it is a Pinger, otherwise the store is assumed to be available
+func (s *CachingStore) Ping(ctx context.Context) error {
+	if pinger, ok := s.next.(Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+// Close stops watching and closes the wrapped store
+func (s *CachingStore) Close() error {
+	s.cancel()
+	s.wg.Wait()
+	return s.next.Close()
+}
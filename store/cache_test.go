@@ -0,0 +1,188 @@
+package store
+
+import (
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingStore counts the reads that reach the wrapped store
+type countingStore struct {
+	Repository
+	mutex sync.Mutex
+	reads int
+}
+
+func (s *countingStore) Get(key string) (Value, error) {
+	s.mutex.Lock()
+	s.reads++
+	s.mutex.Unlock()
+	return s.Repository.Get(key)
+}
+
+func (s *countingStore) GetMany(keys []string) ([]Value, error) {
+	s.mutex.Lock()
+	s.reads += len(keys)
+	s.mutex.Unlock()
+	return s.Repository.GetMany(keys)
+}
+
+func (s *countingStore) count() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.reads
+}
+
+func TestCachingStore(t *testing.T) {
+	next := &countingStore{Repository: NewMemoryStore()}
+	s := NewCachingStore(next, CacheOptions{Size: 10, TTL: time.Hour})
+	defer s.Close()
+
+	accessKey := uuid.New()
+	assert.NoError(t, s.Create("/key", Value{Count: 1, AccessKey: accessKey}))
+
+	for i := 0; i < 3; i++ {
+		v, err := s.Get("/key")
+		assert.NoError(t, err)
+		assert.Equal(t, Value{Count: 1, AccessKey: accessKey, Version: 1}, v)
+	}
+	assert.Equal(t, 1, next.count())
+
+	// Writes through the cache invalidate it
+	assert.NoError(t, s.Increment("/key"))
+	v, err := s.Get("/key")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, v.Count)
+	assert.Equal(t, 2, next.count())
+
+	_, err = s.Batch([]Op{{Key: "/key", Kind: OpSet, Amount: 5}}, false)
+	assert.NoError(t, err)
+	values, err := s.GetMany([]string{"/key", "/missing"})
+	assert.NoError(t, err)
+	assert.Equal(t, []Value{{Count: 5, AccessKey: accessKey, Version: 3}, {}}, values)
+	assert.Equal(t, 4, next.count())
+
+	// Keys that don't exist are cached as well
+	v, err = s.Get("/missing")
+	assert.NoError(t, err)
+	assert.Equal(t, Value{}, v)
+	assert.Equal(t, 4, next.count())
+
+	assert.NoError(t, s.Delete("/key"))
+	v, err = s.Get("/key")
+	assert.NoError(t, err)
+	assert.Equal(t, Value{}, v)
+	assert.Equal(t, 5, next.count())
+}
+
+func TestCachingStore_Eviction(t *testing.T) {
+	next := &countingStore{Repository: NewMemoryStore()}
+	s := NewCachingStore(next, CacheOptions{Size: 2, TTL: 50 * time.Millisecond})
+	defer s.Close()
+
+	for _, key := range []string{"/a", "/b", "/c"} {
+		assert.NoError(t, s.Create(key, Value{AccessKey: uuid.New()}))
+	}
+
+	// /a is the least recently used key once /c is read
+	_, err := s.GetMany([]string{"/a", "/b"})
+	assert.NoError(t, err)
+	_, err = s.Get("/b")
+	assert.NoError(t, err)
+	_, err = s.Get("/c")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, next.count())
+
+	_, err = s.Get("/b")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, next.count())
+	_, err = s.Get("/a")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, next.count())
+
+	// Values are only cached for the TTL
+	time.Sleep(50 * time.Millisecond)
+	_, err = s.Get("/a")
+	assert.NoError(t, err)
+	assert.Equal(t, 5, next.count())
+}
+
+func TestCachingStore_Expires(t *testing.T) {
+	s := NewCachingStore(NewMemoryStore(), CacheOptions{Size: 10, TTL: time.Hour})
+	defer s.Close()
+
+	assert.NoError(t, s.Create("/key", Value{Count: 1, AccessKey: uuid.New(), Expires: time.Now().Add(time.Second).Unix()}))
+	v, err := s.Get("/key")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, v.Count)
+
+	// Cached values that expired aren't returned
+	assert.Eventually(t, func() bool {
+		v, err := s.Get("/key")
+		return err == nil && v == Value{}
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+func TestCachingStore_Watch(t *testing.T) {
+	next := NewMemoryStore()
+	s := NewCachingStore(next, CacheOptions{Size: 10, TTL: time.Hour, Watch: true})
+	defer s.Close()
+
+	accessKey := uuid.New()
+	assert.NoError(t, s.Create("/key", Value{Count: 1, AccessKey: accessKey}))
+	v, err := s.Get("/key")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, v.Count)
+
+	// Changes that didn't go through the cache, like the ones of other replicas, are noticed by watching
+	assert.NoError(t, next.Increment("/key"))
+	assert.Eventually(t, func() bool {
+		v, err := s.Get("/key")
+		return err == nil && v.Count == 2
+	}, time.Second, 10*time.Millisecond)
+
+	// Without watching they are only noticed once the TTL is over
+	unwatched := NewCachingStore(next, CacheOptions{Size: 10, TTL: time.Hour})
+	defer unwatched.Close()
+	v, err = unwatched.Get("/key")
+	assert.NoError(t, err)
+	assert.NoError(t, next.Increment("/key"))
+	time.Sleep(50 * time.Millisecond)
+	v, err = unwatched.Get("/key")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, v.Count)
+}
+
+func TestCachingStore_PendingReads(t *testing.T) {
+	next := &countingStore{Repository: NewMemoryStore()}
+	s := NewCachingStore(next, CacheOptions{Size: 10, TTL: time.Hour})
+	defer s.Close()
+
+	assert.NoError(t, s.Create("/a", Value{Count: 1, AccessKey: uuid.New()}))
+
+	// Writes of other keys while reading don't keep the read value from being cached
+	_, ok, gen := s.lookup("/a")
+	assert.False(t, ok)
+	assert.NoError(t, s.Increment("/b"))
+	s.store("/a", Value{Count: 1}, gen)
+	v, err := s.Get("/a")
+	assert.NoError(t, err)
+	assert.Equal(t, Value{Count: 1}, v)
+	assert.Equal(t, 0, next.count())
+
+	// But writes of the key itself do
+	s.invalidate("/a")
+	_, ok, gen = s.lookup("/a")
+	assert.False(t, ok)
+	assert.NoError(t, s.Increment("/a"))
+	s.store("/a", Value{Count: 1}, gen)
+	v, err = s.Get("/a")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, v.Count)
+	assert.Equal(t, 1, next.count())
+
+	// Reads are only tracked while they are in progress
+	assert.Empty(t, s.pending)
+}
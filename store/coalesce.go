@@ -0,0 +1,305 @@
+package store
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CoalesceOptions configures when a CoalescingStore flushes
+type CoalesceOptions struct {
+	// Interval is how often pending deltas are flushed
+	Interval time.Duration
+	// MaxPending is the amount of keys with pending deltas that triggers a flush before the interval is over
+	MaxPending int
+	// Passthrough is a key prefix for records that aren't counters, like idempotency records. They are created
+	// and deleted without flushing first, as their order relative to the pending deltas doesn't matter.
+	Passthrough string
+}
+
+// CoalescingStore is a Repository decorator summing increments and decrements per key in memory, the sums are
+// written to the wrapped store with a single batch on every flush.
+//
+// Pending deltas are lost if the process dies before they are flushed, so up to Interval of increments and
+// decrements can be lost. They are flushed when the store is closed. Reads add pending deltas to the count,
+// such values have version 0 as they haven't been written yet. Watchers only see changes once they are flushed.
+// All other writes flush first, so they are applied in order. Deltas of counters that have been deleted or have
+// expired by the time they are flushed are dropped.
+type CoalescingStore struct {
+	next Repository
+	opts CoalesceOptions
+
+	// flushLock is held for reading while reading from next and for writing while flushing,
+	// so pending deltas are never counted twice
+	flushLock sync.RWMutex
+	// mutex guards pending and err
+	mutex   sync.Mutex
+	pending map[string]int
+	// err is the error of the last flush, whose deltas are retried with the next flush
+	err error
+
+	kick      chan struct{}
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// NewCoalescingStore wraps next, flushing in the background until it is closed
+func NewCoalescingStore(next Repository, opts CoalesceOptions) *CoalescingStore {
+	s := &CoalescingStore{
+		next:    next,
+		opts:    opts,
+		pending: make(map[string]int),
+		kick:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.run()
+	return s
+}
+
+// run flushes on every interval and whenever too many keys are pending
+func (s *CoalescingStore) run() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		case <-s.kick:
+		}
+		_ = s.Flush()
+	}
+}
+
+// Flush writes all pending deltas to the wrapped store. If the batch fails they all stay pending, otherwise only
+// the deltas of ops which failed for another reason than their counter not existing anymore.
+func (s *CoalescingStore) Flush() error {
+	s.flushLock.Lock()
+	defer s.flushLock.Unlock()
+
+	s.mutex.Lock()
+	deltas := s.pending
+	s.pending = make(map[string]int)
+	s.mutex.Unlock()
+
+	ops := make([]Op, 0, len(deltas))
+	for key, delta := range deltas {
+		if delta > 0 {
+			ops = append(ops, Op{Key: key, Kind: OpIncrement, Amount: delta})
+		} else if delta < 0 {
+			ops = append(ops, Op{Key: key, Kind: OpDecrement, Amount: -delta})
+		}
+	}
+
+	var results []OpResult
+	var err error
+	if len(ops) > 0 {
+		// Every key is applied on its own, counters that don't exist anymore fail with ErrNotFound
+		results, err = s.next.Batch(ops, false)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err != nil {
+		for key, delta := range deltas {
+			s.pending[key] += delta
+		}
+	} else {
+		for i, result := range results {
+			if result.Err != nil && result.Err != ErrNotFound {
+				s.pending[ops[i].Key] += deltas[ops[i].Key]
+				err = result.Err
+			}
+		}
+	}
+	s.err = err
+	return err
+}
+
+// add adds delta to the pending delta of key and kicks off a flush if too many keys are pending
+func (s *CoalescingStore) add(key string, delta int) {
+	s.mutex.Lock()
+	s.pending[key] += delta
+	full := s.opts.MaxPending > 0 && len(s.pending) >= s.opts.MaxPending
+	s.mutex.Unlock()
+
+	if full {
+		select {
+		case s.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// withPending adds the pending delta of key to the value, s.flushLock has to be held
+func (s *CoalescingStore) withPending(key string, v Value) Value {
+	s.mutex.Lock()
+	delta, ok := s.pending[key]
+	s.mutex.Unlock()
+
+	if ok && v.AccessKey != uuid.Nil {
+		v.Count += delta
+		v.Version = 0
+	}
+	return v
+}
+
+func (s *CoalescingStore) Get(key string) (Value, error) {
+	s.flushLock.RLock()
+	defer s.flushLock.RUnlock()
+
+	v, err := s.next.Get(key)
+	if err != nil {
+		return Value{}, err
+	}
+	return s.withPending(key, v), nil
+}
+
+func (s *CoalescingStore) GetMany(keys []string) ([]Value, error) {
+	s.flushLock.RLock()
+	defer s.flushLock.RUnlock()
+
+	values, err := s.next.GetMany(keys)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		values[i] = s.withPending(key, values[i])
+	}
+	return values, nil
+}
+
+// Scan reads all matching counters before calling fn, so fn can use the store
+func (s *CoalescingStore) Scan(prefix string, fn func(key string, value Value) error) error {
+	var keys []string
+	var values []Value
+	s.flushLock.RLock()
+	err := s.next.Scan(prefix, func(key string, value Value) error {
+		keys, values = append(keys, key), append(values, s.withPending(key, value))
+		return nil
+	})
+	s.flushLock.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	for i, key := range keys {
+		if err := fn(key, values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// passthrough reports whether key is below the Passthrough prefix
+func (s *CoalescingStore) passthrough(key string) bool {
+	return s.opts.Passthrough != "" && strings.HasPrefix(key, s.opts.Passthrough)
+}
+
+func (s *CoalescingStore) Create(key string, value Value) error {
+	if !s.passthrough(key) {
+		if err := s.Flush(); err != nil {
+			return err
+		}
+	}
+	return s.next.Create(key, value)
+}
+
+func (s *CoalescingStore) Delete(key string) error {
+	if !s.passthrough(key) {
+		if err := s.Flush(); err != nil {
+			return err
+		}
+	}
+	return s.next.Delete(key)
+}
+
+func (s *CoalescingStore) Increment(key string) error {
+	s.add(key, 1)
+	return nil
+}
+
+func (s *CoalescingStore) Decrement(key string) error {
+	s.add(key, -1)
+	return nil
+}
+
+// Apply only adds increments and decrements without versions to the pending deltas after checking the access key,
+// other ops are applied to the wrapped store after flushing. Ops on records below the Passthrough prefix are
+// applied right away.
+func (s *CoalescingStore) Apply(op Op) (Value, error) {
+	if s.passthrough(op.Key) {
+		return s.next.Apply(op)
+	}
+	if (op.Kind != OpIncrement && op.Kind != OpDecrement) || len(op.Versions) != 0 {
+		if err := s.Flush(); err != nil {
+			return Value{}, err
+		}
+		return s.next.Apply(op)
+	}
+
+	v, err := s.Get(op.Key)
+	if err != nil {
+		return Value{}, err
+	}
+	if err := op.apply(&v); err != nil {
+		return Value{}, err
+	}
+
+	delta := op.Amount
+	if op.Kind == OpDecrement {
+		delta = -delta
+	}
+	s.add(op.Key, delta)
+	// The value isn't written yet, so it has no version
+	v.Version = 0
+	return v, nil
+}
+
+func (s *CoalescingStore) Batch(ops []Op, atomic bool) ([]OpResult, error) {
+	if err := s.Flush(); err != nil {
+		return nil, err
+	}
+	return s.next.Batch(ops, atomic)
+}
+
+func (s *CoalescingStore) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	return s.next.Watch(ctx, prefix)
+}
+
+// Ping fails if the last flush failed, otherwise it forwards to the wrapped store if it is a Pinger
+func (s *CoalescingStore) Ping(ctx context.Context) error {
+	s.mutex.Lock()
+	err := s.err
+	s.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if pinger, ok := s.next.(Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+// Close flushes the pending deltas and closes the wrapped store, which is closed even if flushing fails
+func (s *CoalescingStore) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		s.wg.Wait()
+
+		err = s.Flush()
+		if closeErr := s.next.Close(); err == nil {
+			err = closeErr
+		}
+	})
+	return err
+}
@@ -0,0 +1,288 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failingBatchStore fails all batches while err is set and the ops of the keys in opErrs
+type failingBatchStore struct {
+	Repository
+	mutex  sync.Mutex
+	err    error
+	opErrs map[string]error
+}
+
+func (s *failingBatchStore) Batch(ops []Op, atomic bool) ([]OpResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	results := make([]OpResult, len(ops))
+	var applied []Op
+	var indexes []int
+	for i, op := range ops {
+		if err, ok := s.opErrs[op.Key]; ok {
+			results[i].Err = err
+		} else {
+			applied, indexes = append(applied, op), append(indexes, i)
+		}
+	}
+	appliedResults, err := s.Repository.Batch(applied, atomic)
+	if err != nil {
+		return nil, err
+	}
+	for i, result := range appliedResults {
+		results[indexes[i]] = result
+	}
+	return results, nil
+}
+
+func (s *failingBatchStore) setErr(err error) {
+	s.mutex.Lock()
+	s.err = err
+	s.mutex.Unlock()
+}
+
+func TestCoalescingStore(t *testing.T) {
+	next := NewMemoryStore()
+	s := NewCoalescingStore(next, CoalesceOptions{Interval: time.Hour})
+	defer s.Close()
+
+	accessKey := uuid.New()
+	assert.NoError(t, s.Create("/key", Value{Count: 10, AccessKey: accessKey}))
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, s.Increment("/key"))
+	}
+	assert.NoError(t, s.Decrement("/key"))
+
+	// Nothing has been written yet, but reads include the pending deltas
+	v, err := next.Get("/key")
+	assert.NoError(t, err)
+	assert.Equal(t, Value{Count: 10, AccessKey: accessKey, Version: 1}, v)
+
+	v, err = s.Get("/key")
+	assert.NoError(t, err)
+	assert.Equal(t, Value{Count: 14, AccessKey: accessKey}, v)
+	values, err := s.GetMany([]string{"/key", "/missing"})
+	assert.NoError(t, err)
+	assert.Equal(t, []Value{{Count: 14, AccessKey: accessKey}, {}}, values)
+
+	// All deltas are written at once
+	assert.NoError(t, s.Flush())
+	v, err = next.Get("/key")
+	assert.NoError(t, err)
+	assert.Equal(t, Value{Count: 14, AccessKey: accessKey, Version: 2}, v)
+	v, err = s.Get("/key")
+	assert.NoError(t, err)
+	assert.Equal(t, Value{Count: 14, AccessKey: accessKey, Version: 2}, v)
+}
+
+func TestCoalescingStore_Order(t *testing.T) {
+	next := NewMemoryStore()
+	s := NewCoalescingStore(next, CoalesceOptions{Interval: time.Hour})
+	defer s.Close()
+
+	accessKey := uuid.New()
+	assert.NoError(t, s.Create("/key", Value{AccessKey: accessKey}))
+	assert.NoError(t, s.Increment("/key"))
+
+	// Other writes are applied after the pending deltas
+	results, err := s.Batch([]Op{{Key: "/key", Kind: OpSet, Amount: 5}}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, Value{Count: 5, AccessKey: accessKey, Version: 3}, results[0].Value)
+
+	assert.NoError(t, s.Increment("/key"))
+	assert.NoError(t, s.Delete("/key"))
+	v, err := next.Get("/key")
+	assert.NoError(t, err)
+	assert.Equal(t, Value{}, v)
+
+	// Deltas of counters that don't exist anymore are dropped
+	assert.NoError(t, s.Increment("/key"))
+	assert.NoError(t, s.Flush())
+	v, err = s.Get("/key")
+	assert.NoError(t, err)
+	assert.Equal(t, Value{}, v)
+}
+
+func TestCoalescingStore_Scan(t *testing.T) {
+	s := NewCoalescingStore(NewMemoryStore(), CoalesceOptions{Interval: time.Hour})
+	defer s.Close()
+
+	assert.NoError(t, s.Create("/a", Value{Count: 1, AccessKey: uuid.New()}))
+	assert.NoError(t, s.Create("/b", Value{Count: 2, AccessKey: uuid.New()}))
+	assert.NoError(t, s.Increment("/a"))
+
+	counts := make(map[string]int)
+	assert.NoError(t, s.Scan("/", func(key string, value Value) error {
+		counts[key] = value.Count
+		// The store can be used while scanning
+		return s.Increment(key)
+	}))
+	assert.Equal(t, map[string]int{"/a": 2, "/b": 2}, counts)
+}
+
+func TestCoalescingStore_FlushFailure(t *testing.T) {
+	next := &failingBatchStore{Repository: NewMemoryStore()}
+	s := NewCoalescingStore(next, CoalesceOptions{Interval: time.Hour})
+	defer s.Close()
+
+	accessKey := uuid.New()
+	assert.NoError(t, s.Create("/key", Value{AccessKey: accessKey}))
+	assert.NoError(t, s.Increment("/key"))
+
+	// The deltas stay pending until a flush succeeds, which is reported by Ping
+	next.setErr(errors.New("connection refused"))
+	assert.Error(t, s.Flush())
+	assert.Error(t, s.Ping(context.Background()))
+	assert.NoError(t, s.Increment("/key"))
+	v, err := s.Get("/key")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, v.Count)
+
+	next.setErr(nil)
+	assert.NoError(t, s.Flush())
+	assert.NoError(t, s.Ping(context.Background()))
+	v, err = next.Get("/key")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, v.Count)
+}
+
+func TestCoalescingStore_FlushOpFailure(t *testing.T) {
+	next := &failingBatchStore{Repository: NewMemoryStore()}
+	s := NewCoalescingStore(next, CoalesceOptions{Interval: time.Hour})
+	defer s.Close()
+
+	assert.NoError(t, s.Create("/a", Value{AccessKey: uuid.New()}))
+	assert.NoError(t, s.Create("/b", Value{AccessKey: uuid.New()}))
+	assert.NoError(t, s.Increment("/a"))
+	assert.NoError(t, s.Increment("/b"))
+
+	// Only the deltas of failed ops stay pending
+	next.opErrs = map[string]error{"/b": errors.New("conflict")}
+	assert.Error(t, s.Flush())
+	next.opErrs = nil
+	assert.NoError(t, s.Flush())
+
+	values, err := next.GetMany([]string{"/a", "/b"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, values[0].Count)
+	assert.Equal(t, 1, values[1].Count)
+}
+
+func TestCoalescingStore_Passthrough(t *testing.T) {
+	next := NewMemoryStore()
+	s := NewCoalescingStore(next, CoalesceOptions{Interval: time.Hour, Passthrough: "/_"})
+	defer s.Close()
+
+	assert.NoError(t, s.Create("/key", Value{AccessKey: uuid.New()}))
+	assert.NoError(t, s.Increment("/key"))
+
+	// Records below the prefix are written without flushing
+	assert.NoError(t, s.Create("/_record", Value{Count: 1, AccessKey: uuid.New()}))
+	v, err := next.Get("/_record")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, v.Count)
+	v, err = next.Get("/key")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, v.Count)
+
+	assert.NoError(t, s.Delete("/_record"))
+	v, err = next.Get("/key")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, v.Count)
+
+	// Including ops applied to them
+	accessKey := uuid.New()
+	_, err = s.Apply(Op{Key: "/_reserved", Kind: OpCreate, AccessKey: accessKey, Amount: 2})
+	assert.NoError(t, err)
+	v, err = next.Get("/_reserved")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, v.Count)
+	_, err = s.Apply(Op{Key: "/_reserved", Kind: OpDelete, AccessKey: accessKey})
+	assert.NoError(t, err)
+	v, err = next.Get("/_reserved")
+	assert.NoError(t, err)
+	assert.Equal(t, Value{}, v)
+	v, err = next.Get("/key")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, v.Count)
+
+	// Other keys still flush first
+	assert.NoError(t, s.Create("/other", Value{AccessKey: uuid.New()}))
+	v, err = next.Get("/key")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, v.Count)
+}
+
+func TestCoalescingStore_Triggers(t *testing.T) {
+	next := NewMemoryStore()
+	s := NewCoalescingStore(next, CoalesceOptions{Interval: time.Hour, MaxPending: 3})
+
+	for _, key := range []string{"/a", "/b", "/c", "/d"} {
+		assert.NoError(t, s.Create(key, Value{AccessKey: uuid.New()}))
+	}
+
+	// Flushes once enough keys are pending
+	assert.NoError(t, s.Increment("/a"))
+	assert.NoError(t, s.Increment("/b"))
+	assert.NoError(t, s.Increment("/c"))
+	assert.Eventually(t, func() bool {
+		v, err := next.Get("/c")
+		return err == nil && v.Count == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// And when closed
+	assert.NoError(t, s.Increment("/d"))
+	assert.NoError(t, s.Close())
+	v, err := next.Get("/d")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, v.Count)
+
+	// Or on every interval
+	next = NewMemoryStore()
+	s = NewCoalescingStore(next, CoalesceOptions{Interval: 10 * time.Millisecond})
+	defer s.Close()
+	assert.NoError(t, s.Create("/a", Value{AccessKey: uuid.New()}))
+	assert.NoError(t, s.Increment("/a"))
+	assert.Eventually(t, func() bool {
+		v, err := next.Get("/a")
+		return err == nil && v.Count == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestCoalescingStore_Concurrent(t *testing.T) {
+	next := NewMemoryStore()
+	s := NewCoalescingStore(next, CoalesceOptions{Interval: time.Millisecond, MaxPending: 2})
+
+	assert.NoError(t, s.Create("/key", Value{AccessKey: uuid.New()}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				assert.NoError(t, s.Increment("/key"))
+				// Reads never count a delta twice while it is being flushed
+				v, err := s.Get("/key")
+				assert.NoError(t, err)
+				assert.LessOrEqual(t, v.Count, 1000)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.NoError(t, s.Close())
+
+	v, err := next.Get("/key")
+	assert.NoError(t, err)
+	assert.Equal(t, 1000, v.Count)
+}
@@ -0,0 +1,46 @@
+package store
+
+import (
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestData(t *testing.T) {
+	forEachStore(t, testData)
+}
+
+func testData(t *testing.T, s Repository) {
+	accessKey := uuid.New()
+	// Including characters that have to be escaped in JSON
+	data := `{"url": "https://example.com/a?b=c&d=é"}` + "\n"
+
+	assert.NoError(t, s.Create("/data", Value{Count: 1, AccessKey: accessKey, Data: data}))
+	v, err := s.Get("/data")
+	assert.NoError(t, err)
+	assert.Equal(t, data, v.Data)
+
+	// The data is kept by ops changing the count
+	v, err = s.Apply(Op{Key: "/data", Kind: OpIncrement, Amount: 2, AccessKey: accessKey})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, v.Count)
+	results, err := s.Batch([]Op{{Key: "/data", Kind: OpDecrement, Amount: 1}}, true)
+	assert.NoError(t, err)
+	assert.NoError(t, results[0].Err)
+	assert.NoError(t, s.Increment("/data"))
+
+	values, err := s.GetMany([]string{"/data"})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, values[0].Count)
+	assert.Equal(t, data, values[0].Data)
+	assert.NoError(t, s.Scan("/data", func(key string, value Value) error {
+		assert.Equal(t, data, value.Data)
+		return nil
+	}))
+
+	// And replaced by Create
+	assert.NoError(t, s.Create("/data", Value{AccessKey: accessKey}))
+	v, err = s.Get("/data")
+	assert.NoError(t, err)
+	assert.Equal(t, "", v.Data)
+}
@@ -1,34 +1,103 @@
 package store
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
 	"github.com/peterbourgon/diskv"
+	"hash/fnv"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 type DiskvStore struct {
 	d *diskv.Diskv
+	// mutex serializes read-modify-write cycles, diskv only locks single reads and writes
+	mutex  sync.Mutex
+	events broadcaster
 }
 
-func makeKeyPathFriendly(s string) string {
-	s = strings.TrimPrefix(s, "/")
-	s = strings.ReplaceAll(s, "/", "-")
-	return s
+// pingName is the file written and read back by Ping, it can't collide with a counter as '!' is always escaped
+const pingName = "!ping"
+
+// maxFileNameLength is the longest file name most filesystems support
+const maxFileNameLength = 255
+
+// encodeKey reversibly encodes a key into a file name.
+// Slashes become '+', unreserved characters are kept and everything else (including '+' and '%') is
+// percent escaped. A leading '.' is escaped as well, so a key can never turn into "." or "..".
+func encodeKey(key string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		switch {
+		case c == '/':
+			b.WriteByte('+')
+		case c == '.' && i == 0:
+			b.WriteString("%2E")
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', strings.IndexByte("-._~", c) >= 0:
+			b.WriteByte(c)
+		default:
+			_, _ = fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	if b.Len() == 0 || b.Len() > maxFileNameLength {
+		return "", fmt.Errorf("key %q can not be stored on disk", key)
+	}
+
+	return b.String(), nil
 }
 
-func NewDiskvStore(path string) *DiskvStore {
-	transform := func(s string) []string {
-		return strings.Split(s, "-")[0:1]
+// decodeKey is the inverse of encodeKey
+func decodeKey(name string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; c {
+		case '+':
+			b.WriteByte('/')
+		case '%':
+			if i+2 >= len(name) {
+				return "", fmt.Errorf("invalid escape in file name %q", name)
+			}
+			n, err := strconv.ParseUint(name[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", fmt.Errorf("invalid escape in file name %q", name)
+			}
+			b.WriteByte(byte(n))
+			i += 2
+		default:
+			b.WriteByte(c)
+		}
 	}
 
-	d := diskv.New(diskv.Options{
+	return b.String(), nil
+}
+
+// shard spreads the files over 256*256 directories based on a hash of the file name
+func shard(name string) []string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(name))
+	sum := fmt.Sprintf("%08x", h.Sum32())
+	return []string{sum[0:2], sum[2:4]}
+}
+
+func newDiskv(path string) *diskv.Diskv {
+	return diskv.New(diskv.Options{
 		BasePath:     path,
-		Transform:    transform,
+		Transform:    shard,
 		CacheSizeMax: 1024 * 1024,
 	})
+}
 
-	return &DiskvStore{d}
+func NewDiskvStore(path string) *DiskvStore {
+	return &DiskvStore{d: newDiskv(path)}
 }
 
 func (s *DiskvStore) write(key string, value Value) error {
@@ -41,18 +110,51 @@ func (s *DiskvStore) write(key string, value Value) error {
 }
 
 func (s *DiskvStore) Create(key string, value Value) error {
-	key = makeKeyPathFriendly(key)
-	return s.write(key, value)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	name, err := encodeKey(key)
+	if err != nil {
+		return err
+	}
+	old, err := s.read(name)
+	if err != nil {
+		return err
+	}
+
+	value.Version = old.Version + 1
+
+	if err := s.write(name, value); err != nil {
+		return err
+	}
+
+	s.events.publish(newEvent(key, old, value))
+	return nil
 }
 
 func (s *DiskvStore) Delete(key string) error {
-	key = makeKeyPathFriendly(key)
-	return s.d.Erase(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	name, err := encodeKey(key)
+	if err != nil {
+		return err
+	}
+	old, err := s.read(name)
+	if err != nil {
+		return err
+	}
+	if err := s.d.Erase(name); err != nil {
+		return err
+	}
+
+	s.events.publish(newEvent(key, old, Value{}))
+	return nil
 }
 
-func (s *DiskvStore) Get(key string) (Value, error) {
-	key = makeKeyPathFriendly(key)
-	val, err := s.d.Read(key)
+// load reads the value stored in a file, including expired ones
+func (s *DiskvStore) load(name string) (Value, error) {
+	val, err := s.d.Read(name)
 	if err != nil {
 		if _, ok := err.(*os.PathError); ok {
 			return Value{}, nil
@@ -65,34 +167,333 @@ func (s *DiskvStore) Get(key string) (Value, error) {
 	if err := json.Unmarshal(val, &v); err != nil {
 		return Value{}, err
 	}
+	return v, nil
+}
 
+// read reads the value stored in a file, expired values are reported as missing. s.mutex has to be held, so the
+// value can't change until it is written back.
+func (s *DiskvStore) read(name string) (Value, error) {
+	v, err := s.load(name)
+	if err != nil || v.expired() {
+		return Value{}, err
+	}
 	return v, nil
 }
 
+// get reads the value stored in a file without holding s.mutex, expired values are reported as missing and erased
+// unless they have been replaced in between
+func (s *DiskvStore) get(name string) (Value, error) {
+	v, err := s.load(name)
+	if err != nil {
+		return Value{}, err
+	} else if !v.expired() {
+		return v, nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if v, err := s.load(name); err == nil && v.expired() {
+		_ = s.d.Erase(name)
+	}
+	return Value{}, nil
+}
+
+func (s *DiskvStore) Get(key string) (Value, error) {
+	name, err := encodeKey(key)
+	if err != nil {
+		return Value{}, err
+	}
+	return s.get(name)
+}
+
+// maxParallelReads is the maximum amount of files GetMany reads at the same time
+const maxParallelReads = 16
+
+func (s *DiskvStore) GetMany(keys []string) ([]Value, error) {
+	values := make([]Value, len(keys))
+	errs := make([]error, len(keys))
+	sem := make(chan struct{}, maxParallelReads)
+
+	var wg sync.WaitGroup
+	for i := range keys {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			values[i], errs[i] = s.Get(keys[i])
+			<-sem
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+func (s *DiskvStore) Scan(prefix string, fn func(key string, value Value) error) error {
+	cancel := make(chan struct{})
+	defer close(cancel)
+
+	// The file names are sharded by hash, so all of them have to be listed
+	for name := range s.d.Keys(cancel) {
+		key, err := decodeKey(name)
+		if err != nil || name == pingName || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		v, err := s.get(name)
+		if err != nil {
+			return err
+		} else if v == (Value{}) {
+			continue
+		}
+
+		if err := fn(key, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *DiskvStore) Increment(key string) error {
-	key = makeKeyPathFriendly(key)
-	val, err := s.Get(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	name, err := encodeKey(key)
+	if err != nil {
+		return err
+	}
+	old, err := s.read(name)
 	if err != nil {
 		return err
 	}
 
+	val := old
 	val.Count++
+	val.Version++
 
-	return s.write(key, val)
+	if err := s.write(name, val); err != nil {
+		return err
+	}
+
+	s.events.publish(newEvent(key, old, val))
+	return nil
 }
 
 func (s *DiskvStore) Decrement(key string) error {
-	key = makeKeyPathFriendly(key)
-	val, err := s.Get(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	name, err := encodeKey(key)
+	if err != nil {
+		return err
+	}
+	old, err := s.read(name)
 	if err != nil {
 		return err
 	}
 
+	val := old
 	val.Count--
+	val.Version++
+
+	if err := s.write(name, val); err != nil {
+		return err
+	}
+
+	s.events.publish(newEvent(key, old, val))
+	return nil
+}
+
+func (s *DiskvStore) Apply(op Op) (Value, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	name, err := encodeKey(op.Key)
+	if err != nil {
+		return Value{}, err
+	}
+	old, err := s.read(name)
+	if err != nil {
+		return Value{}, err
+	}
+	v, err := applyOp(op, old)
+	if err != nil {
+		return Value{}, err
+	}
+
+	if v == (Value{}) {
+		err = s.d.Erase(name)
+	} else {
+		err = s.write(name, v)
+	}
+	if err != nil {
+		return Value{}, err
+	}
 
-	return s.write(key, val)
+	s.events.publish(newEvent(op.Key, old, v))
+	return v, nil
+}
+
+func (s *DiskvStore) Batch(ops []Op, atomic bool) ([]OpResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	old := make(map[string]Value)
+	results, changed, err := applyBatch(ops, atomic, func(key string) (Value, error) {
+		name, err := encodeKey(key)
+		if err != nil {
+			return Value{}, err
+		}
+		v, err := s.read(name)
+		old[key] = v
+		return v, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for key, v := range changed {
+		name, err := encodeKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.write(name, v); err != nil {
+			return nil, err
+		}
+		s.events.publish(newEvent(key, old[key], v))
+	}
+
+	return results, nil
+}
+
+func (s *DiskvStore) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	return s.events.watch(ctx, prefix), nil
+}
+
+// Ping writes a sentinel file and reads it back from disk, bypassing the cache
+func (s *DiskvStore) Ping(ctx context.Context) error {
+	sentinel := []byte(uuid.New().String())
+	if err := s.d.Write(pingName, sentinel); err != nil {
+		return err
+	}
+	defer s.d.Erase(pingName)
+
+	r, err := s.d.ReadStream(pingName, true)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	val, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	} else if !bytes.Equal(val, sentinel) {
+		return errPingMismatch
+	}
+	return nil
 }
 
 func (s *DiskvStore) Close() error {
 	return nil
 }
+
+// DiskvMigration is the outcome of MigrateDiskv
+type DiskvMigration struct {
+	// Migrated is the amount of migrated counters
+	Migrated int
+	// Ambiguous is the amount of counters whose legacy file name contained a dash
+	Ambiguous int
+	// Mapping is the file listing the legacy file name and new key of the ambiguous counters, empty without them
+	Mapping string
+}
+
+// MigrateDiskv rewrites a data directory written with the legacy key format, where slashes were replaced by
+// dashes and files were sharded by their first segment, to the current format. The legacy format was lossy:
+// every dash is assumed to have been a slash, so "/a-b" will be migrated as "/a/b". The file names and new keys of
+// those counters are written to path.mapping, so they can be renamed afterwards.
+// The new data is written next to path and swapped in once complete, the old data is kept at path.legacy.
+// Directories containing anything but legacy files, like data already in the current format, are refused.
+func MigrateDiskv(path string) (DiskvMigration, error) {
+	var m DiskvMigration
+	path = filepath.Clean(path)
+	tmp := path + ".migrating"
+	legacy := path + ".legacy"
+	mapping := path + ".mapping"
+
+	for _, p := range []string{tmp, legacy, mapping} {
+		if _, err := os.Stat(p); err == nil {
+			return m, fmt.Errorf("%v already exists, remove it first", p)
+		}
+	}
+
+	// Legacy files are stored in a directory named after the first dash separated segment of their name,
+	// the current format uses two levels of hash directories
+	var files []string
+	err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(path, file)
+		if err != nil {
+			return err
+		}
+		parts := strings.Split(rel, string(filepath.Separator))
+		if len(parts) != 2 || parts[0] != strings.SplitN(parts[1], "-", 2)[0] {
+			return fmt.Errorf("%v is not in the legacy format, %v may already have been migrated", file, path)
+		}
+		files = append(files, file)
+		return nil
+	})
+	if err != nil {
+		return m, err
+	}
+	if len(files) == 0 {
+		return m, nil
+	}
+
+	var ambiguous bytes.Buffer
+	s := NewDiskvStore(tmp)
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return m, err
+		}
+
+		var v Value
+		if err := json.Unmarshal(b, &v); err != nil {
+			return m, fmt.Errorf("%v is not a counter: %w", file, err)
+		}
+
+		name := filepath.Base(file)
+		key := "/" + strings.ReplaceAll(name, "-", "/")
+		if err := s.Create(key, v); err != nil {
+			return m, err
+		}
+		if strings.Contains(name, "-") {
+			_, _ = fmt.Fprintf(&ambiguous, "%v\t%v\n", name, key)
+			m.Ambiguous++
+		}
+	}
+	m.Migrated = len(files)
+
+	if m.Ambiguous > 0 {
+		if err := ioutil.WriteFile(mapping, ambiguous.Bytes(), 0644); err != nil {
+			return m, err
+		}
+		m.Mapping = mapping
+	}
+
+	if err := os.Rename(path, legacy); err != nil {
+		return m, err
+	}
+
+	return m, os.Rename(tmp, path)
+}
@@ -0,0 +1,174 @@
+package store
+
+import (
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEncodeKey(t *testing.T) {
+	keys := []string{"/a/b", "/a-b", "a/b", "a-b", "/a+b", "/a%2Fb", "/.", "..", "/ü/ç", "/A/a"}
+	names := make(map[string]string)
+
+	for _, key := range keys {
+		name, err := encodeKey(key)
+		assert.NoError(t, err)
+		assert.NotContains(t, name, "/")
+		assert.NotEqual(t, ".", name)
+		assert.NotEqual(t, "..", name)
+
+		other, exists := names[name]
+		assert.False(t, exists, "%v collides with %v", key, other)
+		names[name] = key
+
+		decoded, err := decodeKey(name)
+		assert.NoError(t, err)
+		assert.Equal(t, key, decoded)
+	}
+}
+
+func TestEncodeKey_TooLong(t *testing.T) {
+	_, err := encodeKey("/" + strings.Repeat("a", maxFileNameLength))
+	assert.Error(t, err)
+
+	_, err = encodeKey("")
+	assert.Error(t, err)
+}
+
+func TestDecodeKey_Invalid(t *testing.T) {
+	_, err := decodeKey("%2")
+	assert.Error(t, err)
+	_, err = decodeKey("%ZZ")
+	assert.Error(t, err)
+}
+
+func TestDiskvStore_NoCollisions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "counter-diskv")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s := NewDiskvStore(dir)
+
+	assert.NoError(t, s.Create("/a/b", Value{Count: 1, AccessKey: uuid.New()}))
+	assert.NoError(t, s.Create("/a-b", Value{Count: 2, AccessKey: uuid.New()}))
+	assert.NoError(t, s.Increment("/a/b"))
+
+	v, err := s.Get("/a/b")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, v.Count)
+
+	v, err = s.Get("/a-b")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, v.Count)
+
+	assert.NoError(t, s.Delete("/a/b"))
+
+	v, err = s.Get("/a/b")
+	assert.NoError(t, err)
+	assert.Equal(t, Value{}, v)
+
+	v, err = s.Get("/a-b")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, v.Count)
+}
+
+func TestDiskvStore_Expired(t *testing.T) {
+	dir, err := ioutil.TempDir("", "counter-diskv")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s := NewDiskvStore(dir)
+	name, err := encodeKey("/a")
+	assert.NoError(t, err)
+
+	// Expired values are missing for writes, which replace them
+	assert.NoError(t, s.Create("/a", Value{Count: 1, AccessKey: uuid.New(), Expires: time.Now().Add(-time.Second).Unix()}))
+	_, err = s.Apply(Op{Key: "/a", Kind: OpCreate, AccessKey: uuid.New(), Amount: 2})
+	assert.NoError(t, err)
+	v, err := s.Get("/a")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, v.Count)
+
+	// And erased by reads
+	assert.NoError(t, s.Create("/a", Value{Count: 1, AccessKey: uuid.New(), Expires: time.Now().Add(-time.Second).Unix()}))
+	v, err = s.Get("/a")
+	assert.NoError(t, err)
+	assert.Equal(t, Value{}, v)
+	assert.False(t, s.d.Has(name))
+}
+
+func TestMigrateDiskv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "counter-diskv-migrate")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "data")
+	key := uuid.New()
+
+	// Legacy layout: <first segment>/<key with dashes>
+	assert.NoError(t, os.MkdirAll(filepath.Join(path, "some"), os.ModePerm))
+	assert.NoError(t, os.MkdirAll(filepath.Join(path, "plain"), os.ModePerm))
+	content := []byte(`{"Count":42,"AccessKey":"` + key.String() + `"}`)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(path, "some", "some-path"), content, 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(path, "plain", "plain"), content, 0644))
+
+	m, err := MigrateDiskv(path)
+	assert.NoError(t, err)
+	assert.Equal(t, DiskvMigration{Migrated: 2, Ambiguous: 1, Mapping: path + ".mapping"}, m)
+
+	s := NewDiskvStore(path)
+	v, err := s.Get("/some/path")
+	assert.NoError(t, err)
+	assert.Equal(t, Value{Count: 42, AccessKey: key, Version: 1}, v)
+	v, err = s.Get("/plain")
+	assert.NoError(t, err)
+	assert.Equal(t, Value{Count: 42, AccessKey: key, Version: 1}, v)
+
+	// The keys that had dashes are listed
+	mapping, err := ioutil.ReadFile(m.Mapping)
+	assert.NoError(t, err)
+	assert.Equal(t, "some-path\t/some/path\n", string(mapping))
+
+	_, err = os.Stat(path + ".legacy")
+	assert.NoError(t, err)
+
+	// Migrated data is refused
+	assert.NoError(t, os.RemoveAll(path+".legacy"))
+	assert.NoError(t, os.Remove(m.Mapping))
+	_, err = MigrateDiskv(path)
+	assert.Error(t, err)
+	v, err = s.Get("/some/path")
+	assert.NoError(t, err)
+	assert.Equal(t, 42, v.Count)
+
+	// An empty directory has nothing to migrate
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "empty"), os.ModePerm))
+	m, err = MigrateDiskv(filepath.Join(dir, "empty"))
+	assert.NoError(t, err)
+	assert.Equal(t, DiskvMigration{}, m)
+}
+
+func TestMigrateDiskv_Mixed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "counter-diskv-migrate")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "data")
+	content := []byte(`{"Count":1,"AccessKey":"` + uuid.New().String() + `"}`)
+	assert.NoError(t, os.MkdirAll(filepath.Join(path, "some"), os.ModePerm))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(path, "some", "some-path"), content, 0644))
+	// Written by the current version next to the legacy data
+	assert.NoError(t, NewDiskvStore(path).Create("/new", Value{Count: 1, AccessKey: uuid.New()}))
+
+	_, err = MigrateDiskv(path)
+	assert.Error(t, err)
+	for _, p := range []string{path + ".migrating", path + ".legacy", path + ".mapping"} {
+		_, err = os.Stat(p)
+		assert.True(t, os.IsNotExist(err), p)
+	}
+}
@@ -3,7 +3,12 @@ package store
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/clientv3/namespace"
+	"go.etcd.io/etcd/mvcc/mvccpb"
+	"strings"
 	"time"
 )
 
@@ -20,27 +25,91 @@ func NewEtcdStore(endpoints []string) (*EtcdStore, error) {
 }
 
 func NewEtcdStoreFromConfig(cfg clientv3.Config) (*EtcdStore, error) {
-	cli, err := clientv3.New(cfg)
+	return NewEtcdStoreFromOptions(EtcdOptions{Config: cfg})
+}
+
+// EtcdOptions configures an EtcdStore
+type EtcdOptions struct {
+	// Config configures the client, which includes TLS and authentication
+	Config clientv3.Config
+	// Namespace is put in front of every key, so counters can share a cluster with other applications.
+	// A trailing slash is dropped, as keys already start with one.
+	Namespace string
+}
+
+// NewEtcdStoreFromOptions creates an EtcdStore whose keys, watches and leases are all within opts.Namespace
+func NewEtcdStoreFromOptions(opts EtcdOptions) (*EtcdStore, error) {
+	cli, err := clientv3.New(opts.Config)
 	if err != nil {
 		return nil, err
 	}
 
+	if prefix := strings.TrimSuffix(opts.Namespace, "/"); prefix != "" {
+		cli.KV = namespace.NewKV(cli.KV, prefix)
+		cli.Watcher = namespace.NewWatcher(cli.Watcher, prefix)
+		cli.Lease = namespace.NewLease(cli.Lease, prefix)
+	}
+
 	return &EtcdStore{
 		cli,
 		context.Background(),
 	}, nil
 }
 
-func (etcd *EtcdStore) put(key string, value Value) error {
+func encodeEtcd(value Value) (string, error) {
+	// The version is the ModRevision of the key
+	value.Version = 0
 	b, err := json.Marshal(&value)
+	return string(b), err
+}
+
+func decodeEtcd(kv *mvccpb.KeyValue) (Value, error) {
+	var v Value
+	if err := json.Unmarshal(kv.Value, &v); err != nil {
+		return Value{}, err
+	}
+	v.Version = uint64(kv.ModRevision)
+
+	return v, nil
+}
+
+func (etcd *EtcdStore) put(key string, value Value) error {
+	b, err := encodeEtcd(value)
+	if err != nil {
+		return err
+	}
+
+	opts, err := etcd.leaseOptions(value)
 	if err != nil {
 		return err
 	}
 
-	_, err = etcd.cli.Put(etcd.ctx, key, string(b))
+	_, err = etcd.cli.Put(etcd.ctx, key, b, opts...)
 	return err
 }
 
+// leaseOptions grants a lease for values that expire and returns the options attaching it to a put
+func (etcd *EtcdStore) leaseOptions(value Value) ([]clientv3.OpOption, error) {
+	lease, err := etcd.grant(value)
+	if err != nil || lease == clientv3.NoLease {
+		return nil, err
+	}
+	return []clientv3.OpOption{clientv3.WithLease(lease)}, nil
+}
+
+// grant grants a lease for values that expire, values that don't expire get clientv3.NoLease
+func (etcd *EtcdStore) grant(value Value) (clientv3.LeaseID, error) {
+	if value.Expires == 0 {
+		return clientv3.NoLease, nil
+	}
+
+	lease, err := etcd.cli.Grant(etcd.ctx, int64(value.ttl()/time.Second))
+	if err != nil {
+		return clientv3.NoLease, err
+	}
+	return lease.ID, nil
+}
+
 func (etcd *EtcdStore) Create(key string, value Value) error {
 	return etcd.put(key, value)
 }
@@ -59,12 +128,89 @@ func (etcd *EtcdStore) Get(key string) (Value, error) {
 		return Value{}, nil
 	}
 
-	var v Value
-	if err := json.Unmarshal(gr.Kvs[0].Value, &v); err != nil {
-		return Value{}, err
+	return decodeEtcd(gr.Kvs[0])
+}
+
+// Scan reads the keys in pages of scanPageSize, every page is read at the revision of the first one
+func (etcd *EtcdStore) Scan(prefix string, fn func(key string, value Value) error) error {
+	end := clientv3.GetPrefixRangeEnd(prefix)
+	from := prefix
+	if prefix == "" {
+		// An empty prefix and range end are interpreted as a single key
+		from, end = "\x00", "\x00"
 	}
 
-	return v, nil
+	var rev int64
+	for {
+		opts := []clientv3.OpOption{clientv3.WithRange(end), clientv3.WithLimit(scanPageSize)}
+		if rev != 0 {
+			opts = append(opts, clientv3.WithRev(rev))
+		}
+		gr, err := etcd.cli.Get(etcd.ctx, from, opts...)
+		if err != nil {
+			return err
+		}
+		rev = gr.Header.Revision
+
+		for _, kv := range gr.Kvs {
+			v, err := decodeEtcd(kv)
+			if err != nil {
+				return err
+			}
+			if err := fn(string(kv.Key), v); err != nil {
+				return err
+			}
+		}
+
+		if !gr.More || len(gr.Kvs) == 0 {
+			return nil
+		}
+		from = string(gr.Kvs[len(gr.Kvs)-1].Key) + "\x00"
+	}
+}
+
+// maxTxnOps is the default limit of operations in a single etcd transaction
+const maxTxnOps = 128
+
+// GetMany reads the keys in transactions of at most maxTxnOps gets,
+// all reading at the revision of the first one so the result is a consistent snapshot
+func (etcd *EtcdStore) GetMany(keys []string) ([]Value, error) {
+	values := make([]Value, len(keys))
+	var rev int64
+
+	for start := 0; start < len(keys); start += maxTxnOps {
+		end := start + maxTxnOps
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		gets := make([]clientv3.Op, 0, end-start)
+		for _, key := range keys[start:end] {
+			if rev == 0 {
+				gets = append(gets, clientv3.OpGet(key))
+			} else {
+				gets = append(gets, clientv3.OpGet(key, clientv3.WithRev(rev)))
+			}
+		}
+
+		tr, err := etcd.cli.Txn(etcd.ctx).Then(gets...).Commit()
+		if err != nil {
+			return nil, err
+		}
+		if rev == 0 {
+			rev = tr.Header.Revision
+		}
+
+		for i, resp := range tr.Responses {
+			if kvs := resp.GetResponseRange().Kvs; len(kvs) > 0 {
+				if values[start+i], err = decodeEtcd(kvs[0]); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	return values, nil
 }
 
 func (etcd *EtcdStore) Increment(key string) error {
@@ -89,6 +235,197 @@ func (etcd *EtcdStore) Decrement(key string) error {
 	return etcd.put(key, val)
 }
 
+// Apply reads the counter and writes it in a transaction that only succeeds if it wasn't modified in between.
+// Otherwise the transaction returns the current value, so conflicts are retried without reading again.
+// Counters created with an expiry get a lease, which is revoked again if the op fails.
+func (etcd *EtcdStore) Apply(op Op) (_ Value, err error) {
+	gr, err := etcd.cli.Get(etcd.ctx, op.Key)
+	if err != nil {
+		return Value{}, err
+	}
+	kvs := gr.Kvs
+
+	lease := clientv3.NoLease
+	if op.Kind == OpCreate {
+		if lease, err = etcd.grant(Value{Expires: op.Expires}); err != nil {
+			return Value{}, err
+		}
+		defer func() {
+			if err != nil && lease != clientv3.NoLease {
+				_, _ = etcd.cli.Revoke(etcd.ctx, lease)
+			}
+		}()
+	}
+
+	for i := 0; i < maxBatchRetries; i++ {
+		var old Value
+		var rev int64
+		if len(kvs) > 0 {
+			if old, err = decodeEtcd(kvs[0]); err != nil {
+				return Value{}, err
+			}
+			rev = kvs[0].ModRevision
+		}
+
+		v, err := applyOp(op, old)
+		if err != nil {
+			return Value{}, err
+		}
+
+		write := clientv3.OpDelete(op.Key)
+		if v != (Value{}) {
+			b, err := encodeEtcd(v)
+			if err != nil {
+				return Value{}, err
+			}
+			// The counter keeps its lease, so it still expires, new counters get one like with Create
+			opt := clientv3.WithIgnoreLease()
+			if op.Kind == OpCreate {
+				opt = clientv3.WithLease(lease)
+			}
+			write = clientv3.OpPut(op.Key, b, opt)
+		}
+
+		tr, err := etcd.cli.Txn(etcd.ctx).
+			If(clientv3.Compare(clientv3.ModRevision(op.Key), "=", rev)).
+			Then(write).
+			Else(clientv3.OpGet(op.Key)).
+			Commit()
+		if err != nil {
+			return Value{}, err
+		} else if tr.Succeeded {
+			if v != (Value{}) {
+				v.Version = uint64(tr.Header.Revision)
+			}
+			return v, nil
+		}
+		kvs = tr.Responses[0].GetResponseRange().Kvs
+	}
+
+	return Value{}, errTooManyConflicts
+}
+
+// Batch reads all keys in one transaction and writes the changes in a second one,
+// which only succeeds if none of the keys was modified in between
+func (etcd *EtcdStore) Batch(ops []Op, atomic bool) ([]OpResult, error) {
+	keys := batchKeys(ops)
+	gets := make([]clientv3.Op, len(keys))
+	for i, key := range keys {
+		gets[i] = clientv3.OpGet(key)
+	}
+
+	for i := 0; i < maxBatchRetries; i++ {
+		tr, err := etcd.cli.Txn(etcd.ctx).Then(gets...).Commit()
+		if err != nil {
+			return nil, err
+		}
+
+		values := make(map[string]Value, len(keys))
+		revisions := make(map[string]int64, len(keys))
+		for i, resp := range tr.Responses {
+			if kvs := resp.GetResponseRange().Kvs; len(kvs) > 0 {
+				if values[keys[i]], err = decodeEtcd(kvs[0]); err != nil {
+					return nil, err
+				}
+				revisions[keys[i]] = kvs[0].ModRevision
+			}
+		}
+
+		results, changed, err := applyBatch(ops, atomic, func(key string) (Value, error) {
+			return values[key], nil
+		})
+		if err != nil || len(changed) == 0 {
+			return results, err
+		}
+
+		var cmps []clientv3.Cmp
+		var puts []clientv3.Op
+		for key, v := range changed {
+			b, err := encodeEtcd(v)
+			if err != nil {
+				return nil, err
+			}
+			cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(key), "=", revisions[key]))
+			// Counters keep their leases, so they still expire
+			puts = append(puts, clientv3.OpPut(key, b, clientv3.WithIgnoreLease()))
+		}
+
+		tr, err = etcd.cli.Txn(etcd.ctx).If(cmps...).Then(puts...).Commit()
+		if err != nil {
+			return nil, err
+		} else if !tr.Succeeded {
+			continue
+		}
+
+		for i := range results {
+			if results[i].Err == nil {
+				results[i].Value.Version = uint64(tr.Header.Revision)
+			}
+		}
+		return results, nil
+	}
+
+	return nil, errTooManyConflicts
+}
+
+func (etcd *EtcdStore) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	wch := etcd.cli.Watch(ctx, prefix, clientv3.WithPrefix(), clientv3.WithPrevKV())
+	ch := make(chan Event, watchBuffer)
+
+	go func() {
+		defer close(ch)
+		defer cancel()
+
+		for resp := range wch {
+			if resp.Err() != nil {
+				return
+			}
+
+			for _, ev := range resp.Events {
+				var old, value Value
+				var err error
+				if ev.PrevKv != nil {
+					if old, err = decodeEtcd(ev.PrevKv); err != nil {
+						continue
+					}
+				}
+				if ev.Type == clientv3.EventTypePut {
+					if value, err = decodeEtcd(ev.Kv); err != nil {
+						continue
+					}
+				}
+				e := newEvent(string(ev.Kv.Key), old, value)
+
+				select {
+				case ch <- e:
+				default:
+					// The receiver can't keep up
+					return
+				}
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+// Ping succeeds if any endpoint reports its status without errors
+func (etcd *EtcdStore) Ping(ctx context.Context) error {
+	err := errors.New("no endpoints")
+	for _, endpoint := range etcd.cli.Endpoints() {
+		var status *clientv3.StatusResponse
+		if status, err = etcd.cli.Status(ctx, endpoint); err != nil {
+			continue
+		} else if len(status.Errors) > 0 {
+			err = fmt.Errorf("%v: %v", endpoint, strings.Join(status.Errors, ", "))
+			continue
+		}
+		return nil
+	}
+	return err
+}
+
 func (etcd *EtcdStore) Close() error {
 	return etcd.cli.Close()
 }
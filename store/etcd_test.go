@@ -0,0 +1,103 @@
+package store
+
+import (
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/clientv3"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestEtcdStore_Namespace(t *testing.T) {
+	host := os.Getenv("ETCDHOST")
+	if host == "" {
+		t.Skip("Skipping etcd test as ETCDHOST is not set up")
+	}
+
+	s, err := NewEtcdStoreFromOptions(EtcdOptions{
+		Config:    clientv3.Config{Endpoints: []string{host}, DialTimeout: 5 * time.Second},
+		Namespace: "/counter-test/",
+	})
+	assert.NoError(t, err)
+	defer s.Close()
+	defer s.Delete("/a")
+	defer s.Delete("/b")
+	defer s.Delete("/watch/a")
+	defer s.Delete("/watched")
+	defer s.Delete("/other")
+
+	testApply(t, s)
+	testWatch(t, s)
+
+	// Counters are stored below the namespace
+	plain, err := NewEtcdStore([]string{host})
+	assert.NoError(t, err)
+	defer plain.Close()
+
+	v, err := plain.Get("/a")
+	assert.NoError(t, err)
+	assert.Equal(t, Value{}, v)
+	v, err = plain.Get("/counter-test/a")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, v.Count)
+
+	// And their keys are returned without it
+	var keys []string
+	assert.NoError(t, s.Scan("", func(key string, _ Value) error {
+		keys = append(keys, key)
+		return nil
+	}))
+	assert.ElementsMatch(t, []string{"/a", "/watched", "/other"}, keys)
+}
+
+func TestEtcdStore_BatchKeepsLease(t *testing.T) {
+	host := os.Getenv("ETCDHOST")
+	if host == "" {
+		t.Skip("Skipping etcd test as ETCDHOST is not set up")
+	}
+
+	s, err := NewEtcdStore([]string{host})
+	assert.NoError(t, err)
+	defer s.Close()
+	defer s.Delete("/a")
+
+	assert.NoError(t, s.Create("/a", Value{Count: 1, AccessKey: uuid.New(), Expires: time.Now().Add(time.Hour).Unix()}))
+	results, err := s.Batch([]Op{{Key: "/a", Kind: OpIncrement, Amount: 1}}, true)
+	assert.NoError(t, err)
+	assert.NoError(t, results[0].Err)
+
+	gr, err := s.cli.Get(s.ctx, "/a")
+	assert.NoError(t, err)
+	assert.Len(t, gr.Kvs, 1)
+	assert.NotZero(t, gr.Kvs[0].Lease)
+}
+
+func TestEtcdStore_CreateLease(t *testing.T) {
+	host := os.Getenv("ETCDHOST")
+	if host == "" {
+		t.Skip("Skipping etcd test as ETCDHOST is not set up")
+	}
+
+	s, err := NewEtcdStore([]string{host})
+	assert.NoError(t, err)
+	defer s.Close()
+	defer s.Delete("/a")
+
+	leases := func() int {
+		lr, err := s.cli.Leases(s.ctx)
+		assert.NoError(t, err)
+		return len(lr.Leases)
+	}
+
+	expires := time.Now().Add(time.Hour).Unix()
+	before := leases()
+	_, err = s.Apply(Op{Key: "/a", Kind: OpCreate, AccessKey: uuid.New(), Expires: expires})
+	assert.NoError(t, err)
+	assert.Equal(t, before+1, leases())
+
+	// Counters that exist already don't leave a lease behind
+	_, err = s.Apply(Op{Key: "/a", Kind: OpCreate, AccessKey: uuid.New(), Expires: expires})
+	assert.Equal(t, ErrExists, err)
+	assert.Equal(t, before+1, leases())
+}
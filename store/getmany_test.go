@@ -0,0 +1,36 @@
+package store
+
+import (
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+)
+
+func TestGetMany(t *testing.T) {
+	forEachStore(t, testGetMany)
+}
+
+func testGetMany(t *testing.T, s Repository) {
+	// More keys than fit in a single etcd transaction
+	keys := make([]string, 2*maxTxnOps+1)
+	for i := range keys {
+		keys[i] = "/getmany/" + strconv.Itoa(i)
+		if i%2 == 0 {
+			assert.NoError(t, s.Create(keys[i], Value{Count: i, AccessKey: uuid.New()}))
+			defer s.Delete(keys[i])
+		}
+	}
+
+	values, err := s.GetMany(keys)
+	assert.NoError(t, err)
+	assert.Len(t, values, len(keys))
+	for i, v := range values {
+		if i%2 == 0 {
+			assert.Equal(t, i, v.Count)
+			assert.NotEqual(t, uuid.Nil, v.AccessKey)
+		} else {
+			assert.Equal(t, uuid.Nil, v.AccessKey)
+		}
+	}
+}
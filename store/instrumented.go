@@ -0,0 +1,140 @@
+package store
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+// InstrumentedStore is a Repository decorator recording the latency and errors of every operation
+type InstrumentedStore struct {
+	next     Repository
+	duration *prometheus.HistogramVec
+	errors   *prometheus.CounterVec
+}
+
+// NewInstrumentedStore wraps next, the metrics are labeled with the name of the backend and registered with reg
+func NewInstrumentedStore(next Repository, backend string, reg prometheus.Registerer) *InstrumentedStore {
+	labels := prometheus.Labels{"backend": backend}
+	s := &InstrumentedStore{
+		next: next,
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:        "counter_store_operation_duration_seconds",
+			Help:        "Latency of database operations.",
+			ConstLabels: labels,
+			Buckets:     []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		}, []string{"op"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "counter_store_operation_errors_total",
+			Help:        "Amount of database operations that failed.",
+			ConstLabels: labels,
+		}, []string{"op"}),
+	}
+	reg.MustRegister(s.duration, s.errors)
+
+	return s
+}
+
+// observe records an operation that started at start and failed if err is not nil
+func (s *InstrumentedStore) observe(op string, start time.Time, err error) {
+	s.duration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	if err != nil {
+		s.errors.WithLabelValues(op).Inc()
+	}
+}
+
+func (s *InstrumentedStore) Get(key string) (Value, error) {
+	start := time.Now()
+	v, err := s.next.Get(key)
+	s.observe("get", start, err)
+	return v, err
+}
+
+func (s *InstrumentedStore) GetMany(keys []string) ([]Value, error) {
+	start := time.Now()
+	values, err := s.next.GetMany(keys)
+	s.observe("get_many", start, err)
+	return values, err
+}
+
+func (s *InstrumentedStore) Create(key string, value Value) error {
+	start := time.Now()
+	err := s.next.Create(key, value)
+	s.observe("create", start, err)
+	return err
+}
+
+func (s *InstrumentedStore) Delete(key string) error {
+	start := time.Now()
+	err := s.next.Delete(key)
+	s.observe("delete", start, err)
+	return err
+}
+
+func (s *InstrumentedStore) Increment(key string) error {
+	start := time.Now()
+	err := s.next.Increment(key)
+	s.observe("increment", start, err)
+	return err
+}
+
+func (s *InstrumentedStore) Decrement(key string) error {
+	start := time.Now()
+	err := s.next.Decrement(key)
+	s.observe("decrement", start, err)
+	return err
+}
+
+func (s *InstrumentedStore) Apply(op Op) (Value, error) {
+	start := time.Now()
+	v, err := s.next.Apply(op)
+	// Failed checks are answers, not failures of the backend
+	if err == ErrNotFound || err == ErrWrongAccessKey || err == ErrVersionMismatch || err == ErrExists {
+		s.observe("apply", start, nil)
+	} else {
+		s.observe("apply", start, err)
+	}
+	return v, err
+}
+
+func (s *InstrumentedStore) Batch(ops []Op, atomic bool) ([]OpResult, error) {
+	start := time.Now()
+	results, err := s.next.Batch(ops, atomic)
+	s.observe("batch", start, err)
+	return results, err
+}
+
+func (s *InstrumentedStore) Scan(prefix string, fn func(key string, value Value) error) error {
+	start := time.Now()
+	err := s.next.Scan(prefix, fn)
+	s.observe("scan", start, err)
+	return err
+}
+
+// Watch only records the latency of establishing the watch
+func (s *InstrumentedStore) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	start := time.Now()
+	events, err := s.next.Watch(ctx, prefix)
+	s.observe("watch", start, err)
+	return events, err
+}
+
+// Ping forwards to the wrapped store if it is a Pinger, otherwise the store is assumed to be available
+func (s *InstrumentedStore) Ping(ctx context.Context) error {
+	pinger, ok := s.next.(Pinger)
+	if !ok {
+		return nil
+	}
+
+	start := time.Now()
+	err := pinger.Ping(ctx)
+	s.observe("ping", start, err)
+	return err
+}
+
+func (s *InstrumentedStore) Close() error {
+	start := time.Now()
+	err := s.next.Close()
+	s.observe("close", start, err)
+	return err
+}
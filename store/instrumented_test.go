@@ -0,0 +1,50 @@
+package store
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestInstrumentedStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "counter-instrumented")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	reg := prometheus.NewRegistry()
+	s := NewInstrumentedStore(NewDiskvStore(dir), "disk", reg)
+
+	assert.NoError(t, s.Create("/yeet", Value{Count: 1}))
+	assert.NoError(t, s.Increment("/yeet"))
+	v, err := s.Get("/yeet")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, v.Count)
+
+	// Keys that can't be stored on disk are errors
+	_, err = s.Get(strings.Repeat("a", 300))
+	assert.Error(t, err)
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(s.errors.WithLabelValues("get")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(s.errors.WithLabelValues("create")))
+
+	families, err := reg.Gather()
+	assert.NoError(t, err)
+	counts := make(map[string]uint64)
+	for _, family := range families {
+		if family.GetName() != "counter_store_operation_duration_seconds" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "op" {
+					counts[label.GetValue()] = m.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	assert.Equal(t, map[string]uint64{"create": 1, "increment": 1, "get": 2}, counts)
+}
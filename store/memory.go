@@ -1,11 +1,19 @@
 package store
 
-import "sync"
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
 
 // MemoryStore is a simple in memory and thread-safe implementation of the Repository interface
 type MemoryStore struct {
-	data  map[string]Value
-	mutex sync.RWMutex
+	data   map[string]Value
+	mutex  sync.RWMutex
+	events broadcaster
+	// log is set if the store is persistent, mutations are written to it while holding the write lock
+	log *appendLog
 }
 
 // NewMemoryStore creates a new store to save your date
@@ -16,44 +24,203 @@ func NewMemoryStore() *MemoryStore {
 	}
 }
 
+// persist writes the values of keys after a mutation to the log before they are applied
+func (s *MemoryStore) persist(entries ...logEntry) error {
+	if s.log == nil {
+		return nil
+	}
+	return s.log.append(entries...)
+}
+
+// expireAfter deletes the key once value expires, unless it has been replaced by then
+func (s *MemoryStore) expireAfter(key string, value Value) {
+	time.AfterFunc(value.ttl(), func() {
+		s.mutex.Lock()
+		if old := s.data[key]; old.Expires == value.Expires {
+			delete(s.data, key)
+			s.events.publish(newEvent(key, old, Value{}))
+		}
+		s.mutex.Unlock()
+	})
+}
+
 func (s *MemoryStore) Get(key string) (Value, error) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
-	return s.data[key], nil
+	if v := s.data[key]; !v.expired() {
+		return v, nil
+	}
+	return Value{}, nil
+}
+
+func (s *MemoryStore) GetMany(keys []string) ([]Value, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	values := make([]Value, len(keys))
+	for i, key := range keys {
+		if v := s.data[key]; !v.expired() {
+			values[i] = v
+		}
+	}
+	return values, nil
+}
+
+func (s *MemoryStore) Scan(prefix string, fn func(key string, value Value) error) error {
+	// fn is called without holding the lock, so it can use the store
+	s.mutex.RLock()
+	keys := make([]string, 0)
+	values := make([]Value, 0)
+	for key, v := range s.data {
+		if strings.HasPrefix(key, prefix) && !v.expired() {
+			keys = append(keys, key)
+			values = append(values, v)
+		}
+	}
+	s.mutex.RUnlock()
+
+	for i, key := range keys {
+		if err := fn(key, values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (s *MemoryStore) Create(key string, value Value) error {
 	s.mutex.Lock()
+	old := s.data[key]
+	value.Version = old.Version + 1
+	if err := s.persist(logEntry{Key: key, Value: value}); err != nil {
+		s.mutex.Unlock()
+		return err
+	}
 	s.data[key] = value
+	s.events.publish(newEvent(key, old, value))
 	s.mutex.Unlock()
+
+	if value.Expires != 0 {
+		s.expireAfter(key, value)
+	}
 	return nil
 }
 
 func (s *MemoryStore) Delete(key string) error {
 	s.mutex.Lock()
-	delete(s.data, key)
-	s.mutex.Unlock()
+	defer s.mutex.Unlock()
+	if old, ok := s.data[key]; ok {
+		if err := s.persist(logEntry{Key: key}); err != nil {
+			return err
+		}
+		delete(s.data, key)
+		s.events.publish(newEvent(key, old, Value{}))
+	}
 	return nil
 }
 
-func (s *MemoryStore) Increment(key string) error {
+// add adds delta to the count of a key
+func (s *MemoryStore) add(key string, delta int) error {
 	s.mutex.Lock()
-	d := s.data[key]
-	d.Count++
+	defer s.mutex.Unlock()
+	old := s.data[key]
+	d := old
+	d.Count += delta
+	d.Version++
+	if err := s.persist(logEntry{Key: key, Value: d}); err != nil {
+		return err
+	}
 	s.data[key] = d
-	s.mutex.Unlock()
+	s.events.publish(newEvent(key, old, d))
 	return nil
 }
 
+func (s *MemoryStore) Increment(key string) error {
+	return s.add(key, 1)
+}
+
 func (s *MemoryStore) Decrement(key string) error {
+	return s.add(key, -1)
+}
+
+func (s *MemoryStore) Apply(op Op) (Value, error) {
 	s.mutex.Lock()
-	d := s.data[key]
-	d.Count--
-	s.data[key] = d
-	s.mutex.Unlock()
-	return nil
+	defer s.mutex.Unlock()
+
+	old := s.data[op.Key]
+	if old.expired() {
+		old = Value{}
+	}
+	v, err := applyOp(op, old)
+	if err != nil {
+		return Value{}, err
+	}
+
+	if err := s.persist(logEntry{Key: op.Key, Value: v}); err != nil {
+		return Value{}, err
+	}
+	if v == (Value{}) {
+		delete(s.data, op.Key)
+	} else {
+		s.data[op.Key] = v
+	}
+	s.events.publish(newEvent(op.Key, old, v))
+	if op.Kind == OpCreate && v.Expires != 0 {
+		s.expireAfter(op.Key, v)
+	}
+	return v, nil
+}
+
+func (s *MemoryStore) Batch(ops []Op, atomic bool) ([]OpResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	get := func(key string) (Value, error) {
+		if v := s.data[key]; !v.expired() {
+			return v, nil
+		}
+		return Value{}, nil
+	}
+	results, changed, err := applyBatch(ops, atomic, get)
+	if err != nil {
+		return nil, err
+	}
+
+	// The changes are logged as a single record, so they are restored all or nothing
+	entries := make([]logEntry, 0, len(changed))
+	for key, v := range changed {
+		entries = append(entries, logEntry{Key: key, Value: v})
+	}
+	if len(entries) > 0 {
+		if err := s.persist(entries...); err != nil {
+			return nil, err
+		}
+	}
+
+	for key, v := range changed {
+		old, _ := get(key)
+		s.data[key] = v
+		s.events.publish(newEvent(key, old, v))
+	}
+
+	return results, nil
 }
 
+func (s *MemoryStore) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	return s.events.watch(ctx, prefix), nil
+}
+
+// Ping reports the last error flushing or compacting the log of a persistent store
+func (s *MemoryStore) Ping(ctx context.Context) error {
+	if s.log == nil {
+		return nil
+	}
+	return s.log.lastErr()
+}
+
+// Close flushes and closes the log of a persistent store
 func (s *MemoryStore) Close() error {
-	return nil
+	if s.log == nil {
+		return nil
+	}
+	return s.log.close()
 }
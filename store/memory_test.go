@@ -4,6 +4,7 @@ import (
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 func TestNewMemoryStore(t *testing.T) {
@@ -23,6 +24,7 @@ func TestMemoryStore_Create(t *testing.T) {
 	s := NewMemoryStore()
 	err := s.Create(key, val)
 	assert.NoError(t, err)
+	val.Version = 1
 
 	assert.Equal(t, s.data[key], val)
 }
@@ -38,6 +40,7 @@ func TestMemoryStore_Get(t *testing.T) {
 
 	err := s.Create(key, val)
 	assert.NoError(t, err)
+	val.Version = 1
 
 	gv, err := s.Get(key)
 	assert.NoError(t, err)
@@ -56,6 +59,7 @@ func TestMemoryStore_Delete(t *testing.T) {
 
 	err := s.Create(key, val)
 	assert.NoError(t, err)
+	val.Version = 1
 
 	nv, err := s.Get(key)
 	assert.NoError(t, err)
@@ -80,10 +84,12 @@ func TestMemoryStore_Increment(t *testing.T) {
 
 	err := s.Create(key, val)
 	assert.NoError(t, err)
+	val.Version = 1
 
 	assert.NoError(t, s.Increment(key))
 
 	val.Count++
+	val.Version++
 
 	nv, err := s.Get(key)
 	assert.NoError(t, err)
@@ -101,12 +107,42 @@ func TestMemoryStore_Decrement(t *testing.T) {
 
 	err := s.Create(key, val)
 	assert.NoError(t, err)
+	val.Version = 1
 
 	assert.NoError(t, s.Decrement(key))
 
 	val.Count--
+	val.Version++
 
 	nv, err := s.Get(key)
 	assert.NoError(t, err)
 	assert.Equal(t, val, nv)
 }
+
+func TestMemoryStore_Expires(t *testing.T) {
+	key := "key"
+	val := Value{
+		Count:     42,
+		AccessKey: uuid.New(),
+		Expires:   time.Now().Add(-time.Second).Unix(),
+	}
+
+	s := NewMemoryStore()
+
+	err := s.Create(key, val)
+	assert.NoError(t, err)
+	val.Version = 1
+
+	nv, err := s.Get(key)
+	assert.NoError(t, err)
+	assert.Equal(t, Value{}, nv)
+
+	val.Expires = time.Now().Add(time.Hour).Unix()
+	err = s.Create(key, val)
+	assert.NoError(t, err)
+	val.Version = 2
+
+	nv, err = s.Get(key)
+	assert.NoError(t, err)
+	assert.Equal(t, val, nv)
+}
@@ -5,6 +5,7 @@
 package mock_store
 
 import (
+	context "context"
 	store "counter/store"
 	gomock "github.com/golang/mock/gomock"
 	reflect "reflect"
@@ -33,6 +34,36 @@ func (m *MockRepository) EXPECT() *MockRepositoryMockRecorder {
 	return m.recorder
 }
 
+// Apply mocks base method
+func (m *MockRepository) Apply(arg0 store.Op) (store.Value, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Apply", arg0)
+	ret0, _ := ret[0].(store.Value)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Apply indicates an expected call of Apply
+func (mr *MockRepositoryMockRecorder) Apply(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Apply", reflect.TypeOf((*MockRepository)(nil).Apply), arg0)
+}
+
+// Batch mocks base method
+func (m *MockRepository) Batch(arg0 []store.Op, arg1 bool) ([]store.OpResult, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Batch", arg0, arg1)
+	ret0, _ := ret[0].([]store.OpResult)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Batch indicates an expected call of Batch
+func (mr *MockRepositoryMockRecorder) Batch(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Batch", reflect.TypeOf((*MockRepository)(nil).Batch), arg0, arg1)
+}
+
 // Close mocks base method
 func (m *MockRepository) Close() error {
 	m.ctrl.T.Helper()
@@ -104,6 +135,21 @@ func (mr *MockRepositoryMockRecorder) Get(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockRepository)(nil).Get), arg0)
 }
 
+// GetMany mocks base method
+func (m *MockRepository) GetMany(arg0 []string) ([]store.Value, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetMany", arg0)
+	ret0, _ := ret[0].([]store.Value)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetMany indicates an expected call of GetMany
+func (mr *MockRepositoryMockRecorder) GetMany(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetMany", reflect.TypeOf((*MockRepository)(nil).GetMany), arg0)
+}
+
 // Increment mocks base method
 func (m *MockRepository) Increment(arg0 string) error {
 	m.ctrl.T.Helper()
@@ -117,3 +163,32 @@ func (mr *MockRepositoryMockRecorder) Increment(arg0 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Increment", reflect.TypeOf((*MockRepository)(nil).Increment), arg0)
 }
+
+// Scan mocks base method
+func (m *MockRepository) Scan(arg0 string, arg1 func(string, store.Value) error) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Scan", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Scan indicates an expected call of Scan
+func (mr *MockRepositoryMockRecorder) Scan(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Scan", reflect.TypeOf((*MockRepository)(nil).Scan), arg0, arg1)
+}
+
+// Watch mocks base method
+func (m *MockRepository) Watch(arg0 context.Context, arg1 string) (<-chan store.Event, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Watch", arg0, arg1)
+	ret0, _ := ret[0].(<-chan store.Event)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Watch indicates an expected call of Watch
+func (mr *MockRepositoryMockRecorder) Watch(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Watch", reflect.TypeOf((*MockRepository)(nil).Watch), arg0, arg1)
+}
@@ -1,6 +1,9 @@
 package store
 
-import "go/types"
+import (
+	"context"
+	"go/types"
+)
 
 // nullStore is a store that doesn't do anything, why? That's a good question.
 type nullStore types.Nil
@@ -11,6 +14,9 @@ func NewNullStore() *nullStore {
 func (nullStore) Get(string) (Value, error) {
 	return Value{}, nil
 }
+func (nullStore) GetMany(keys []string) ([]Value, error) {
+	return make([]Value, len(keys)), nil
+}
 func (nullStore) Create(string, Value) error {
 	return nil
 }
@@ -23,6 +29,28 @@ func (nullStore) Increment(string) error {
 func (nullStore) Decrement(string) error {
 	return nil
 }
+func (nullStore) Apply(Op) (Value, error) {
+	return Value{}, ErrNotFound
+}
+func (nullStore) Batch(ops []Op, _ bool) ([]OpResult, error) {
+	results := make([]OpResult, len(ops))
+	for i := range results {
+		results[i].Err = ErrNotFound
+	}
+	return results, nil
+}
+func (nullStore) Scan(string, func(string, Value) error) error {
+	return nil
+}
+func (nullStore) Watch(ctx context.Context, _ string) (<-chan Event, error) {
+	// Nothing ever changes
+	ch := make(chan Event)
+	go func() {
+		<-ctx.Done()
+		close(ch)
+	}()
+	return ch, nil
+}
 func (nullStore) Close() error {
 	return nil
 }
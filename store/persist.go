@@ -0,0 +1,470 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FsyncPolicy decides when the log of a persistent MemoryStore is flushed to disk
+type FsyncPolicy string
+
+const (
+	// FsyncAlways flushes every mutation before it is applied, nothing that was acknowledged is lost
+	FsyncAlways FsyncPolicy = "always"
+	// FsyncInterval flushes periodically, on power loss the mutations of the last interval can be lost
+	FsyncInterval FsyncPolicy = "interval"
+	// FsyncNever leaves flushing to the operating system, which survives crashes of the process but not of the machine
+	FsyncNever FsyncPolicy = "never"
+)
+
+// PersistOptions configures how a persistent MemoryStore writes to disk
+type PersistOptions struct {
+	// Fsync decides when the log is flushed to disk
+	Fsync FsyncPolicy
+	// FsyncInterval is how often the log is flushed with FsyncInterval
+	FsyncInterval time.Duration
+	// SnapshotInterval is how often all counters are written to a snapshot, after which the log is discarded
+	SnapshotInterval time.Duration
+}
+
+const (
+	logPrefix      = "log-"
+	snapshotPrefix = "snapshot-"
+	snapshotTemp   = "snapshot.tmp"
+	// lockName is the file locked while a store uses the directory
+	lockName = "LOCK"
+)
+
+var (
+	// errCorruptRecord is returned when a record other than the last one of a file can't be read
+	errCorruptRecord = errors.New("corrupt record")
+	// errDirLocked is returned when another process uses the directory
+	errDirLocked = errors.New("directory is used by another process")
+)
+
+// crcTable is used for the checksums of records
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// logEntry is the value of a key after a mutation, the zero Value if it was deleted
+type logEntry struct {
+	Key   string `json:"k"`
+	Value Value  `json:"v"`
+}
+
+// encodeRecord frames entries as a record: the length and CRC-32C of the payload as big endian uint32s,
+// followed by the entries as JSON. The entries of a record are applied together.
+func encodeRecord(entries []logEntry) ([]byte, error) {
+	payload, err := json.Marshal(entries)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(b[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(b[4:8], crc32.Checksum(payload, crcTable))
+	return append(b, payload...), nil
+}
+
+// readRecords calls fn for every record in the file. A torn final record, which was only partially written
+// when the process or machine crashed, ends the file. Unless tolerateTorn is set it is an error as well.
+func readRecords(path string, tolerateTorn bool, fn func(entries []logEntry)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			return nil
+		} else if err == io.ErrUnexpectedEOF {
+			return tornRecord(path, tolerateTorn)
+		} else if err != nil {
+			return err
+		}
+
+		payload := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+		if _, err := io.ReadFull(r, payload); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return tornRecord(path, tolerateTorn)
+		} else if err != nil {
+			return err
+		}
+
+		if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+			// Only the last record can be torn, anything after it means the file is corrupt
+			if _, err := r.Peek(1); err == io.EOF {
+				return tornRecord(path, tolerateTorn)
+			}
+			return fmt.Errorf("%v: %w", path, errCorruptRecord)
+		}
+
+		var entries []logEntry
+		if err := json.Unmarshal(payload, &entries); err != nil {
+			return fmt.Errorf("%v: %w: %v", path, errCorruptRecord, err)
+		}
+		fn(entries)
+	}
+}
+
+func tornRecord(path string, tolerate bool) error {
+	if tolerate {
+		return nil
+	}
+	return fmt.Errorf("%v: %w: truncated", path, errCorruptRecord)
+}
+
+// fileSeq parses the sequence number of a log or snapshot file name
+func fileSeq(name, prefix string) (uint64, bool) {
+	if !strings.HasPrefix(name, prefix) {
+		return 0, false
+	}
+	var seq uint64
+	_, err := fmt.Sscanf(strings.TrimPrefix(name, prefix), "%d", &seq)
+	return seq, err == nil
+}
+
+func fileName(prefix string, seq uint64) string {
+	return fmt.Sprintf("%v%016d", prefix, seq)
+}
+
+// syncDir flushes the directory, so files that were created, renamed or removed in it are persisted
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// appendLog is the write-ahead log of a persistent MemoryStore. It is split into segments numbered by a sequence,
+// snapshot N contains all mutations of the segments before N, so those can be removed once it is written.
+type appendLog struct {
+	dir  string
+	opts PersistOptions
+	// lock is the locked file, which is held until the log is closed
+	lock *os.File
+	// mutex guards f and seq, the segment that is appended to
+	mutex sync.Mutex
+	f     *os.File
+	seq   uint64
+	// compactMutex serializes compactions
+	compactMutex sync.Mutex
+	// err is the last error of a background flush or compaction
+	err error
+
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// append writes the entries as a single record, which is flushed right away with FsyncAlways
+func (l *appendLog) append(entries ...logEntry) error {
+	b, err := encodeRecord(entries)
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if _, err := l.f.Write(b); err != nil {
+		return err
+	}
+	if l.opts.Fsync == FsyncAlways {
+		return l.f.Sync()
+	}
+	return nil
+}
+
+// rotate starts a new segment and returns its sequence number, the previous segment is flushed and closed
+func (l *appendLog) rotate() (uint64, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	f, err := os.OpenFile(filepath.Join(l.dir, fileName(logPrefix, l.seq+1)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	if err := syncDir(l.dir); err != nil {
+		_ = f.Close()
+		return 0, err
+	}
+
+	if l.f != nil {
+		if err := l.f.Sync(); err != nil {
+			_ = f.Close()
+			return 0, err
+		}
+		_ = l.f.Close()
+	}
+
+	l.f = f
+	l.seq++
+	return l.seq, nil
+}
+
+func (l *appendLog) sync() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.f.Sync()
+}
+
+// setErr records the result of a background flush or compaction
+func (l *appendLog) setErr(err error) {
+	l.mutex.Lock()
+	l.err = err
+	l.mutex.Unlock()
+}
+
+func (l *appendLog) lastErr() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.err
+}
+
+// writeSnapshot writes the data to snapshot seq and removes the files it replaces
+func (l *appendLog) writeSnapshot(seq uint64, data map[string]Value) error {
+	tmp := filepath.Join(l.dir, snapshotTemp)
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for key, v := range data {
+		b, err := encodeRecord([]logEntry{{Key: key, Value: v}})
+		if err != nil {
+			_ = f.Close()
+			return err
+		}
+		if _, err := w.Write(b); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, filepath.Join(l.dir, fileName(snapshotPrefix, seq))); err != nil {
+		return err
+	}
+	if err := syncDir(l.dir); err != nil {
+		return err
+	}
+
+	// The older snapshots and the segments they were built from aren't needed anymore
+	files, err := ioutil.ReadDir(l.dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		logSeq, isLog := fileSeq(file.Name(), logPrefix)
+		snapshotSeq, isSnapshot := fileSeq(file.Name(), snapshotPrefix)
+		if (isLog && logSeq < seq) || (isSnapshot && snapshotSeq < seq) {
+			if err := os.Remove(filepath.Join(l.dir, file.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// close stops flushing and compacting in the background, closes the log and unlocks the directory,
+// closing it again does nothing
+func (l *appendLog) close() error {
+	l.closeOnce.Do(func() {
+		close(l.stop)
+		l.wg.Wait()
+
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		defer l.lock.Close()
+		if l.closeErr = l.f.Sync(); l.closeErr != nil {
+			_ = l.f.Close()
+			return
+		}
+		l.closeErr = l.f.Close()
+	})
+	return l.closeErr
+}
+
+// lockDir locks dir, so no other process can use it at the same time
+func lockDir(dir string) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, lockName), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("%v: %w", dir, err)
+	}
+	return f, nil
+}
+
+// NewPersistentMemoryStore creates a MemoryStore which writes every mutation to a log in dir before applying it.
+// The counters are restored from the latest snapshot and the log when starting, after which a new snapshot is
+// written. Expiry isn't logged, expired counters are dropped when restoring. The directory is locked until the store
+// is closed, so it fails if another process uses it.
+func NewPersistentMemoryStore(dir string, opts PersistOptions) (*MemoryStore, error) {
+	switch opts.Fsync {
+	case FsyncAlways, FsyncNever:
+	case FsyncInterval:
+		if opts.FsyncInterval <= 0 {
+			return nil, fmt.Errorf("invalid fsync interval: %v", opts.FsyncInterval)
+		}
+	default:
+		return nil, fmt.Errorf("invalid fsync policy: %q", opts.Fsync)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	lock, err := lockDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s, err := restoreMemoryStore(dir, opts, lock)
+	if err != nil {
+		_ = lock.Close()
+		return nil, err
+	}
+
+	if opts.Fsync == FsyncInterval {
+		s.log.every(opts.FsyncInterval, s.log.sync)
+	}
+	if opts.SnapshotInterval > 0 {
+		s.log.every(opts.SnapshotInterval, s.compact)
+	}
+
+	return s, nil
+}
+
+// restoreMemoryStore restores the counters from the files in the locked dir and writes a new snapshot
+func restoreMemoryStore(dir string, opts PersistOptions, lock *os.File) (*MemoryStore, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Restore the latest snapshot, followed by the segments written after it in order
+	var snapshot uint64
+	var segments []uint64
+	for _, file := range files {
+		if seq, ok := fileSeq(file.Name(), snapshotPrefix); ok && seq > snapshot {
+			snapshot = seq
+		} else if seq, ok := fileSeq(file.Name(), logPrefix); ok {
+			segments = append(segments, seq)
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+
+	s := NewMemoryStore()
+	restore := func(entries []logEntry) {
+		for _, e := range entries {
+			if e.Value == (Value{}) {
+				delete(s.data, e.Key)
+			} else {
+				s.data[e.Key] = e.Value
+			}
+		}
+	}
+	if snapshot != 0 {
+		if err := readRecords(filepath.Join(dir, fileName(snapshotPrefix, snapshot)), false, restore); err != nil {
+			return nil, err
+		}
+	}
+
+	last := snapshot
+	for _, seq := range segments {
+		if seq < snapshot {
+			continue
+		}
+		if err := readRecords(filepath.Join(dir, fileName(logPrefix, seq)), true, restore); err != nil {
+			return nil, err
+		}
+		last = seq
+	}
+
+	for key, v := range s.data {
+		if v.expired() {
+			delete(s.data, key)
+		} else if v.Expires != 0 {
+			s.expireAfter(key, v)
+		}
+	}
+
+	s.log = &appendLog{dir: dir, opts: opts, lock: lock, seq: last, stop: make(chan struct{})}
+	if err := s.compact(); err != nil {
+		if s.log.f != nil {
+			_ = s.log.f.Close()
+		}
+		return nil, err
+	}
+	return s, nil
+}
+
+// every calls fn periodically until the log is closed, its errors are reported by Ping
+func (l *appendLog) every(interval time.Duration, fn func() error) {
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-l.stop:
+				return
+			case <-ticker.C:
+				l.setErr(fn())
+			}
+		}
+	}()
+}
+
+// compact starts a new log segment and writes a snapshot of all counters, replacing the previous segments
+func (s *MemoryStore) compact() error {
+	s.log.compactMutex.Lock()
+	defer s.log.compactMutex.Unlock()
+
+	s.mutex.RLock()
+	data := make(map[string]Value, len(s.data))
+	for key, v := range s.data {
+		if !v.expired() {
+			data[key] = v
+		}
+	}
+	// Mutations hold the write lock, so all of them are either in the copy or in the new segment
+	seq, err := s.log.rotate()
+	s.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	return s.log.writeSnapshot(seq, data)
+}
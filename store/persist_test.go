@@ -0,0 +1,209 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestPersistentMemoryStore(t *testing.T, opts PersistOptions) (*MemoryStore, string, func()) {
+	dir, err := ioutil.TempDir("", "counter-memory")
+	assert.NoError(t, err)
+
+	s, err := NewPersistentMemoryStore(dir, opts)
+	assert.NoError(t, err)
+
+	return s, dir, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// lastSegment returns the path of the log segment that is appended to
+func lastSegment(t *testing.T, dir string) string {
+	segments, err := filepath.Glob(filepath.Join(dir, logPrefix+"*"))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, segments)
+	return segments[len(segments)-1]
+}
+
+func appendToFile(t *testing.T, path string, b []byte) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	_, err = f.Write(b)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+}
+
+func TestPersistentMemoryStore(t *testing.T) {
+	s, dir, cleanup := newTestPersistentMemoryStore(t, PersistOptions{Fsync: FsyncAlways})
+	defer cleanup()
+
+	accessKey := uuid.New()
+	expires := time.Now().Add(time.Hour).Unix()
+	assert.NoError(t, s.Create("/key", Value{Count: 42, AccessKey: accessKey}))
+	assert.NoError(t, s.Increment("/key"))
+	assert.NoError(t, s.Decrement("/key"))
+	assert.NoError(t, s.Increment("/key"))
+	assert.NoError(t, s.Create("/expires", Value{Count: 1, AccessKey: accessKey, Expires: expires}))
+	assert.NoError(t, s.Create("/expired", Value{Count: 1, AccessKey: accessKey, Expires: time.Now().Add(-time.Second).Unix()}))
+	assert.NoError(t, s.Create("/deleted", Value{Count: 1, AccessKey: accessKey}))
+	assert.NoError(t, s.Delete("/deleted"))
+	_, err := s.Batch([]Op{
+		{Key: "/key", Kind: OpIncrement, Amount: 2},
+		{Key: "/expires", Kind: OpDecrement, Amount: 1},
+	}, true)
+	assert.NoError(t, err)
+
+	// The counters survive reopening the store
+	assert.NoError(t, s.Close())
+	s, err = NewPersistentMemoryStore(dir, PersistOptions{Fsync: FsyncAlways})
+	assert.NoError(t, err)
+	defer s.Close()
+
+	values, err := s.GetMany([]string{"/key", "/expires", "/expired", "/deleted"})
+	assert.NoError(t, err)
+	assert.Equal(t, []Value{
+		{Count: 45, AccessKey: accessKey, Version: 5},
+		{Count: 0, AccessKey: accessKey, Version: 2, Expires: expires},
+		{},
+		{},
+	}, values)
+
+	// Restoring wrote a snapshot and started a new segment
+	snapshots, err := filepath.Glob(filepath.Join(dir, snapshotPrefix+"*"))
+	assert.NoError(t, err)
+	assert.Len(t, snapshots, 1)
+	segments, err := filepath.Glob(filepath.Join(dir, logPrefix+"*"))
+	assert.NoError(t, err)
+	assert.Len(t, segments, 1)
+}
+
+func TestPersistentMemoryStore_TornRecord(t *testing.T) {
+	s, dir, cleanup := newTestPersistentMemoryStore(t, PersistOptions{Fsync: FsyncNever})
+	defer cleanup()
+
+	accessKey := uuid.New()
+	assert.NoError(t, s.Create("/key", Value{Count: 1, AccessKey: accessKey}))
+	assert.NoError(t, s.Increment("/key"))
+	assert.NoError(t, s.Close())
+
+	// The process crashed while writing the next record
+	record, err := encodeRecord([]logEntry{{Key: "/key", Value: Value{Count: 100, AccessKey: accessKey, Version: 3}}})
+	assert.NoError(t, err)
+	appendToFile(t, lastSegment(t, dir), record[:len(record)-3])
+
+	s, err = NewPersistentMemoryStore(dir, PersistOptions{Fsync: FsyncNever})
+	assert.NoError(t, err)
+	v, err := s.Get("/key")
+	assert.NoError(t, err)
+	assert.Equal(t, Value{Count: 2, AccessKey: accessKey, Version: 2}, v)
+
+	// A final record that was completely written but not flushed fails its checksum
+	assert.NoError(t, s.Increment("/key"))
+	assert.NoError(t, s.Close())
+	record[len(record)-2] ^= 0xff
+	appendToFile(t, lastSegment(t, dir), record)
+
+	s, err = NewPersistentMemoryStore(dir, PersistOptions{Fsync: FsyncNever})
+	assert.NoError(t, err)
+	defer s.Close()
+	v, err = s.Get("/key")
+	assert.NoError(t, err)
+	assert.Equal(t, Value{Count: 3, AccessKey: accessKey, Version: 3}, v)
+}
+
+func TestPersistentMemoryStore_Corrupt(t *testing.T) {
+	s, dir, cleanup := newTestPersistentMemoryStore(t, PersistOptions{Fsync: FsyncNever})
+	defer cleanup()
+
+	assert.NoError(t, s.Create("/key", Value{Count: 1, AccessKey: uuid.New()}))
+	assert.NoError(t, s.Increment("/key"))
+	assert.NoError(t, s.Close())
+
+	// Records that are followed by others weren't torn, they are corrupt
+	path := lastSegment(t, dir)
+	b, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	b[10] ^= 0xff
+	assert.NoError(t, ioutil.WriteFile(path, b, 0644))
+
+	_, err = NewPersistentMemoryStore(dir, PersistOptions{Fsync: FsyncNever})
+	assert.True(t, errors.Is(err, errCorruptRecord))
+}
+
+func TestPersistentMemoryStore_Compaction(t *testing.T) {
+	s, dir, cleanup := newTestPersistentMemoryStore(t, PersistOptions{Fsync: FsyncInterval, FsyncInterval: 10 * time.Millisecond})
+	defer cleanup()
+
+	accessKey := uuid.New()
+	assert.NoError(t, s.Create("/a", Value{Count: 1, AccessKey: accessKey}))
+	first := lastSegment(t, dir)
+
+	assert.NoError(t, s.compact())
+	assert.NoError(t, s.Create("/b", Value{Count: 2, AccessKey: accessKey}))
+	assert.NoError(t, s.Delete("/a"))
+
+	// The snapshot replaced the segment it was built from
+	assert.NotEqual(t, first, lastSegment(t, dir))
+	_, err := os.Stat(first)
+	assert.True(t, os.IsNotExist(err))
+
+	// A leftover segment covered by the snapshot isn't restored
+	record, err := encodeRecord([]logEntry{{Key: "/a", Value: Value{Count: 1, AccessKey: accessKey, Version: 1}}})
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(first, record, 0644))
+
+	assert.NoError(t, s.Close())
+	s, err = NewPersistentMemoryStore(dir, PersistOptions{Fsync: FsyncNever})
+	assert.NoError(t, err)
+	defer s.Close()
+
+	values, err := s.GetMany([]string{"/a", "/b"})
+	assert.NoError(t, err)
+	assert.Equal(t, []Value{{}, {Count: 2, AccessKey: accessKey, Version: 1}}, values)
+}
+
+func TestPersistentMemoryStore_SnapshotInterval(t *testing.T) {
+	s, dir, cleanup := newTestPersistentMemoryStore(t, PersistOptions{Fsync: FsyncNever, SnapshotInterval: 10 * time.Millisecond})
+	defer cleanup()
+
+	first := lastSegment(t, dir)
+	assert.Eventually(t, func() bool {
+		return lastSegment(t, dir) != first
+	}, time.Second, 10*time.Millisecond)
+	assert.NoError(t, s.Ping(context.Background()))
+}
+
+func TestPersistentMemoryStore_Lock(t *testing.T) {
+	s, dir, cleanup := newTestPersistentMemoryStore(t, PersistOptions{Fsync: FsyncNever})
+	defer cleanup()
+
+	// Only one store can use the directory at a time
+	_, err := NewPersistentMemoryStore(dir, PersistOptions{Fsync: FsyncNever})
+	assert.True(t, errors.Is(err, errDirLocked))
+
+	assert.NoError(t, s.Close())
+	s, err = NewPersistentMemoryStore(dir, PersistOptions{Fsync: FsyncNever})
+	assert.NoError(t, err)
+	assert.NoError(t, s.Close())
+}
+
+func TestPersistentMemoryStore_Options(t *testing.T) {
+	dir, err := ioutil.TempDir("", "counter-memory")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = NewPersistentMemoryStore(dir, PersistOptions{})
+	assert.Error(t, err)
+	_, err = NewPersistentMemoryStore(dir, PersistOptions{Fsync: "sometimes"})
+	assert.Error(t, err)
+	_, err = NewPersistentMemoryStore(dir, PersistOptions{Fsync: FsyncInterval})
+	assert.Error(t, err)
+}
@@ -0,0 +1,47 @@
+package store
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestPing_Unavailable(t *testing.T) {
+	s := NewRedisStore("127.0.0.1:1")
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Error(t, s.Ping(ctx))
+}
+
+func TestPing(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Repository) {
+		pinger, ok := s.(Pinger)
+		if !ok {
+			t.Skip("Skipping as the store isn't a Pinger")
+		}
+		testPing(t, s, pinger)
+	})
+}
+
+// testPing checks that pinging works and that the sentinel written by some stores doesn't show up as a counter
+func testPing(t *testing.T, s Repository, pinger Pinger) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	assert.NoError(t, s.Create("/ping", Value{Count: 1, AccessKey: uuid.New()}))
+	assert.NoError(t, pinger.Ping(ctx))
+	assert.NoError(t, pinger.Ping(ctx))
+
+	var keys []string
+	assert.NoError(t, s.Scan("", func(key string, value Value) error {
+		keys = append(keys, key)
+		return nil
+	}))
+	assert.NotContains(t, keys, pingKey)
+	assert.NotContains(t, keys, pingName)
+	assert.Contains(t, keys, "/ping")
+}
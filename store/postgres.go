@@ -0,0 +1,466 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"strings"
+	"sync"
+	"time"
+)
+
+// postgresMigrations are applied in order, the applied versions are recorded in counter_schema_migrations
+var postgresMigrations = []string{
+	`CREATE TABLE counters (
+		key        TEXT COLLATE "C" PRIMARY KEY,
+		count      BIGINT NOT NULL,
+		access_key UUID NOT NULL,
+		version    BIGINT NOT NULL,
+		expires    BIGINT NOT NULL DEFAULT 0
+	)`,
+	// Every change is sent to the listeners of the counter_events channel once committed
+	`CREATE FUNCTION counters_notify() RETURNS trigger AS $$
+	BEGIN
+		PERFORM pg_notify('counter_events', json_build_object(
+			'key', COALESCE(NEW.key, OLD.key),
+			'old', CASE WHEN TG_OP = 'INSERT' THEN NULL ELSE row_to_json(OLD) END,
+			'new', CASE WHEN TG_OP = 'DELETE' THEN NULL ELSE row_to_json(NEW) END
+		)::text);
+		RETURN NULL;
+	END;
+	$$ LANGUAGE plpgsql;
+
+	CREATE TRIGGER counters_notify AFTER INSERT OR UPDATE OR DELETE ON counters
+		FOR EACH ROW EXECUTE FUNCTION counters_notify()`,
+	// Expired counters are purged periodically
+	`CREATE INDEX counters_expires ON counters (expires) WHERE expires != 0`,
+	// Records that aren't counters keep a payload
+	`ALTER TABLE counters ADD COLUMN data TEXT NOT NULL DEFAULT ''`,
+}
+
+// postgresMigrationLock is the key of the advisory lock held while migrating, so replicas don't migrate concurrently
+const postgresMigrationLock = 0x636f756e746572
+
+// postgresChannel is the channel changes are notified on
+const postgresChannel = "counter_events"
+
+// PostgresStore keeps the counters in a PostgreSQL table, changes are watched with LISTEN/NOTIFY.
+// Expired counters are purged periodically by every replica.
+type PostgresStore struct {
+	pool   *pgxpool.Pool
+	ctx    context.Context
+	cancel context.CancelFunc
+	events broadcaster
+	// mutex guards listening, which is set while a connection listens for notifications
+	mutex     sync.Mutex
+	listening bool
+	wg        sync.WaitGroup
+}
+
+// NewPostgresStore connects to the database described by dsn and migrates its schema.
+// The pool can be configured in the dsn, e.g. with pool_max_conns.
+func NewPostgresStore(dsn string) (*PostgresStore, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	if err := migratePostgres(ctx, pool); err != nil {
+		pool.Close()
+		cancel()
+		return nil, err
+	}
+
+	s := &PostgresStore{pool: pool, ctx: ctx, cancel: cancel}
+	purgeEvery(ctx, &s.wg, purgeInterval, s.purge)
+	return s, nil
+}
+
+// migratePostgres applies all migrations that haven't been applied yet in a single transaction
+func migratePostgres(ctx context.Context, pool *pgxpool.Pool) error {
+	return pgx.BeginFunc(ctx, pool, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", postgresMigrationLock); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, "CREATE TABLE IF NOT EXISTS counter_schema_migrations (version INTEGER PRIMARY KEY)"); err != nil {
+			return err
+		}
+
+		var version int
+		if err := tx.QueryRow(ctx, "SELECT COALESCE(MAX(version), 0) FROM counter_schema_migrations").Scan(&version); err != nil {
+			return err
+		} else if version > len(postgresMigrations) {
+			return fmt.Errorf("database schema version %v is newer than the supported version %v", version, len(postgresMigrations))
+		}
+
+		for i, migration := range postgresMigrations[version:] {
+			if _, err := tx.Exec(ctx, migration); err != nil {
+				return fmt.Errorf("migration %v failed: %w", version+i+1, err)
+			}
+			if _, err := tx.Exec(ctx, "INSERT INTO counter_schema_migrations (version) VALUES ($1)", version+i+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// postgresAlive is true for rows of the counters table that haven't expired, $2 is the current unix time
+const postgresAlive = "(expires = 0 OR expires > $2)"
+
+func (s *PostgresStore) Get(key string) (Value, error) {
+	var v Value
+	err := s.pool.QueryRow(s.ctx,
+		"SELECT count, access_key, version, expires, data FROM counters WHERE key = $1 AND "+postgresAlive,
+		key, time.Now().Unix()).Scan(&v.Count, &v.AccessKey, &v.Version, &v.Expires, &v.Data)
+	if err == pgx.ErrNoRows {
+		return Value{}, nil
+	}
+	return v, err
+}
+
+// collectValues reads rows of key, count, access_key, version, expires and data
+func collectValues(rows pgx.Rows, fn func(key string, value Value)) error {
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var v Value
+		if err := rows.Scan(&key, &v.Count, &v.AccessKey, &v.Version, &v.Expires, &v.Data); err != nil {
+			return err
+		}
+		fn(key, v)
+	}
+	return rows.Err()
+}
+
+func (s *PostgresStore) GetMany(keys []string) ([]Value, error) {
+	rows, err := s.pool.Query(s.ctx,
+		"SELECT key, count, access_key, version, expires, data FROM counters WHERE key = ANY($1) AND "+postgresAlive,
+		keys, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]Value, len(keys))
+	if err := collectValues(rows, func(key string, v Value) { found[key] = v }); err != nil {
+		return nil, err
+	}
+
+	values := make([]Value, len(keys))
+	for i, key := range keys {
+		values[i] = found[key]
+	}
+	return values, nil
+}
+
+// likeEscaper escapes the wildcards of LIKE patterns
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// Scan reads the counters in pages ordered by key, fn is called between pages so it can use the store
+func (s *PostgresStore) Scan(prefix string, fn func(key string, value Value) error) error {
+	pattern := likeEscaper.Replace(prefix) + "%"
+	after := ""
+	for {
+		rows, err := s.pool.Query(s.ctx, `SELECT key, count, access_key, version, expires, data FROM counters
+			WHERE key LIKE $1 AND `+postgresAlive+` AND key > $3 ORDER BY key LIMIT $4`,
+			pattern, time.Now().Unix(), after, scanPageSize)
+		if err != nil {
+			return err
+		}
+
+		var keys []string
+		var values []Value
+		err = collectValues(rows, func(key string, v Value) {
+			keys, values = append(keys, key), append(values, v)
+		})
+		if err != nil {
+			return err
+		}
+
+		for i, key := range keys {
+			if err := fn(key, values[i]); err != nil {
+				return err
+			}
+		}
+		if len(keys) < scanPageSize {
+			return nil
+		}
+		after = keys[len(keys)-1]
+	}
+}
+
+func (s *PostgresStore) Create(key string, value Value) error {
+	_, err := s.pool.Exec(s.ctx, `INSERT INTO counters AS c (key, count, access_key, version, expires, data)
+		VALUES ($1, $2, $3, 1, $4, $5)
+		ON CONFLICT (key) DO UPDATE SET
+			count = excluded.count, access_key = excluded.access_key, version = c.version + 1, expires = excluded.expires,
+			data = excluded.data`,
+		key, value.Count, value.AccessKey, value.Expires, value.Data)
+	return err
+}
+
+func (s *PostgresStore) Delete(key string) error {
+	_, err := s.pool.Exec(s.ctx, "DELETE FROM counters WHERE key = $1", key)
+	return err
+}
+
+// add atomically adds delta to the count of a key. Like in the other stores keys that don't exist are created,
+// expired counters start over.
+func (s *PostgresStore) add(key string, delta int) error {
+	_, err := s.pool.Exec(s.ctx, `INSERT INTO counters AS c (key, count, access_key, version) VALUES ($1, $3, $4, 1)
+		ON CONFLICT (key) DO UPDATE SET
+			count = CASE WHEN c.expires = 0 OR c.expires > $2 THEN c.count + excluded.count ELSE excluded.count END,
+			access_key = CASE WHEN c.expires = 0 OR c.expires > $2 THEN c.access_key ELSE excluded.access_key END,
+			expires = CASE WHEN c.expires = 0 OR c.expires > $2 THEN c.expires ELSE 0 END,
+			data = CASE WHEN c.expires = 0 OR c.expires > $2 THEN c.data ELSE '' END,
+			version = c.version + 1`,
+		key, time.Now().Unix(), delta, uuid.Nil)
+	return err
+}
+
+func (s *PostgresStore) Increment(key string) error {
+	return s.add(key, 1)
+}
+
+func (s *PostgresStore) Decrement(key string) error {
+	return s.add(key, -1)
+}
+
+// postgresApply locks and reads the counter and updates or deletes it if the checks of the op pass, all in a
+// single statement. $1 is the key, $2 the current unix time, $3 the access key, $4 the versions and $5 and $6 the
+// kind and amount of the op.
+const postgresApply = `WITH cur AS (
+		SELECT key, count, access_key, version, expires, data FROM counters
+		WHERE key = $1 AND ` + postgresAlive + ` FOR UPDATE
+	), checked AS (
+		SELECT key FROM cur
+		WHERE access_key <> '00000000-0000-0000-0000-000000000000'
+			AND ($3::uuid = '00000000-0000-0000-0000-000000000000' OR access_key = $3::uuid)
+			AND (cardinality($4::bigint[]) = 0 OR version = ANY($4::bigint[]))
+	), updated AS (
+		UPDATE counters c SET
+			count = CASE $5::text WHEN 'increment' THEN c.count + $6 WHEN 'decrement' THEN c.count - $6 ELSE $6 END,
+			version = c.version + 1
+		FROM checked WHERE c.key = checked.key AND $5::text <> 'delete'
+		RETURNING c.count, c.version
+	), deleted AS (
+		DELETE FROM counters c USING checked WHERE c.key = checked.key AND $5::text = 'delete'
+		RETURNING c.key
+	)
+	SELECT count, access_key, version, expires, data,
+		(SELECT count FROM updated), (SELECT version FROM updated)
+	FROM cur`
+
+// Apply takes a single round trip, the outcome of the checks is derived from the counter as it was read
+func (s *PostgresStore) Apply(op Op) (Value, error) {
+	switch op.Kind {
+	case OpCreate:
+		return s.create(op)
+	case OpIncrement, OpDecrement, OpSet, OpDelete:
+	default:
+		return Value{}, fmt.Errorf("invalid op: %v", op.Kind)
+	}
+
+	versions := make([]int64, len(op.Versions))
+	for i, version := range op.Versions {
+		versions[i] = int64(version)
+	}
+
+	var old Value
+	var count *int
+	var version *uint64
+	err := s.pool.QueryRow(s.ctx, postgresApply, op.Key, time.Now().Unix(), op.AccessKey, versions, string(op.Kind), op.Amount).
+		Scan(&old.Count, &old.AccessKey, &old.Version, &old.Expires, &old.Data, &count, &version)
+	if err == pgx.ErrNoRows {
+		return Value{}, ErrNotFound
+	} else if err != nil {
+		return Value{}, err
+	}
+
+	if err := op.check(&old); err != nil {
+		return Value{}, err
+	} else if op.Kind == OpDelete {
+		return Value{}, nil
+	} else if count == nil || version == nil {
+		return Value{}, fmt.Errorf("counter %v wasn't updated", op.Key)
+	}
+
+	v := old
+	v.Count, v.Version = *count, *version
+	return v, nil
+}
+
+// create applies an OpCreate with a single insert, which only replaces rows of counters that expired or were never
+// created
+func (s *PostgresStore) create(op Op) (Value, error) {
+	v, err := applyOp(op, Value{})
+	if err != nil {
+		return Value{}, err
+	}
+
+	err = s.pool.QueryRow(s.ctx, `INSERT INTO counters AS c (key, count, access_key, version, expires)
+		VALUES ($1, $3, $4, 1, $5)
+		ON CONFLICT (key) DO UPDATE SET
+			count = excluded.count, access_key = excluded.access_key, version = c.version + 1, expires = excluded.expires,
+			data = excluded.data
+		WHERE c.access_key = $6 OR NOT (c.expires = 0 OR c.expires > $2)
+		RETURNING version`,
+		op.Key, time.Now().Unix(), v.Count, v.AccessKey, v.Expires, uuid.Nil).Scan(&v.Version)
+	if err == pgx.ErrNoRows {
+		return Value{}, ErrExists
+	} else if err != nil {
+		return Value{}, err
+	}
+	return v, nil
+}
+
+// Batch locks the rows of all keys in a transaction, in order of their keys so concurrent batches can't deadlock
+func (s *PostgresStore) Batch(ops []Op, atomic bool) (results []OpResult, err error) {
+	err = pgx.BeginFunc(s.ctx, s.pool, func(tx pgx.Tx) error {
+		rows, err := tx.Query(s.ctx, `SELECT key, count, access_key, version, expires, data FROM counters
+			WHERE key = ANY($1) AND `+postgresAlive+` ORDER BY key FOR UPDATE`,
+			batchKeys(ops), time.Now().Unix())
+		if err != nil {
+			return err
+		}
+
+		values := make(map[string]Value)
+		if err := collectValues(rows, func(key string, v Value) { values[key] = v }); err != nil {
+			return err
+		}
+
+		var changed map[string]Value
+		results, changed, err = applyBatch(ops, atomic, func(key string) (Value, error) {
+			return values[key], nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// Only counters that exist can be changed, so their rows are locked
+		for key, v := range changed {
+			_, err := tx.Exec(s.ctx, "UPDATE counters SET count = $2, version = $3 WHERE key = $1", key, v.Count, v.Version)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// postgresRow is a row of the counters table as sent by the notify trigger
+type postgresRow struct {
+	Count     int       `json:"count"`
+	AccessKey uuid.UUID `json:"access_key"`
+	Version   uint64    `json:"version"`
+	Expires   int64     `json:"expires"`
+	Data      string    `json:"data"`
+}
+
+func (r *postgresRow) value() Value {
+	if r == nil {
+		return Value{}
+	}
+	v := Value{Count: r.Count, AccessKey: r.AccessKey, Version: r.Version, Expires: r.Expires, Data: r.Data}
+	if v.expired() {
+		return Value{}
+	}
+	return v
+}
+
+// decodeNotification decodes the payload of a notification sent by the notify trigger
+func decodeNotification(payload string) (Event, error) {
+	var n struct {
+		Key string       `json:"key"`
+		Old *postgresRow `json:"old"`
+		New *postgresRow `json:"new"`
+	}
+	if err := json.Unmarshal([]byte(payload), &n); err != nil {
+		return Event{}, err
+	}
+
+	return newEvent(n.Key, n.Old.value(), n.New.value()), nil
+}
+
+// listen starts listening for notifications if no connection is listening yet, s.mutex has to be held
+func (s *PostgresStore) listen() error {
+	if s.listening {
+		return nil
+	}
+
+	c, err := s.pool.Acquire(s.ctx)
+	if err != nil {
+		return err
+	}
+	// The connection is taken out of the pool, as it is busy for as long as it listens
+	conn := c.Hijack()
+	if _, err := conn.Exec(s.ctx, "LISTEN "+postgresChannel); err != nil {
+		_ = conn.Close(context.Background())
+		return err
+	}
+
+	s.listening = true
+	s.wg.Add(1)
+	go s.receive(conn)
+	return nil
+}
+
+// receive publishes the notifications received on conn until the store is closed or the connection fails
+func (s *PostgresStore) receive(conn *pgx.Conn) {
+	defer s.wg.Done()
+	defer conn.Close(context.Background())
+
+	for {
+		n, err := conn.WaitForNotification(s.ctx)
+		if err != nil {
+			// Events may have been missed, watchers have to start over
+			s.mutex.Lock()
+			s.listening = false
+			s.events.closeAll()
+			s.mutex.Unlock()
+			return
+		}
+
+		// Purging expired counters changes nothing for watchers
+		if e, err := decodeNotification(n.Payload); err == nil && (e.Old != Value{} || e.Value != Value{}) {
+			s.events.publish(e)
+		}
+	}
+}
+
+// Watch shares a single listening connection between all watchers
+func (s *PostgresStore) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.listen(); err != nil {
+		return nil, err
+	}
+	return s.events.watch(ctx, prefix), nil
+}
+
+// purge deletes the counters that have expired
+func (s *PostgresStore) purge() error {
+	_, err := s.pool.Exec(s.ctx, "DELETE FROM counters WHERE expires != 0 AND expires <= $1", time.Now().Unix())
+	return err
+}
+
+func (s *PostgresStore) Ping(ctx context.Context) error {
+	return s.pool.Ping(ctx)
+}
+
+func (s *PostgresStore) Close() error {
+	s.cancel()
+	s.wg.Wait()
+	s.pool.Close()
+	return nil
+}
@@ -0,0 +1,125 @@
+package store
+
+import (
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLikeEscaper(t *testing.T) {
+	assert.Equal(t, `/a\_b\%c\\d`, likeEscaper.Replace(`/a_b%c\d`))
+}
+
+func TestDecodeNotification(t *testing.T) {
+	accessKey := uuid.New()
+
+	e, err := decodeNotification(`{"key": "/a", "old": null, "new": {"key": "/a", "count": 1, "access_key": "` +
+		accessKey.String() + `", "version": 1, "expires": 0}}`)
+	assert.NoError(t, err)
+	assert.Equal(t, Event{Key: "/a", Op: EventCreate, Value: Value{Count: 1, AccessKey: accessKey, Version: 1}}, e)
+
+	e, err = decodeNotification(`{"key": "/a", "old": {"key": "/a", "count": 1, "access_key": "` +
+		accessKey.String() + `", "version": 1, "expires": 0}, "new": null}`)
+	assert.NoError(t, err)
+	assert.Equal(t, EventDelete, e.Op)
+	assert.Equal(t, 1, e.Old.Count)
+
+	// Expired values are treated like values that do not exist
+	e, err = decodeNotification(`{"key": "/a", "old": {"key": "/a", "count": 1, "access_key": "` +
+		accessKey.String() + `", "version": 1, "expires": 1}, "new": {"key": "/a", "count": 1, "access_key": "` +
+		accessKey.String() + `", "version": 2, "expires": 0}}`)
+	assert.NoError(t, err)
+	assert.Equal(t, EventCreate, e.Op)
+
+	// Including the data of records
+	e, err = decodeNotification(`{"key": "/_a", "old": null, "new": {"key": "/_a", "count": 0, "access_key": "` +
+		accessKey.String() + `", "version": 1, "expires": 0, "data": "{\"url\": \"https://example.com\"}"}}`)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"url": "https://example.com"}`, e.Value.Data)
+
+	_, err = decodeNotification(`not json`)
+	assert.Error(t, err)
+}
+
+func TestPostgresStore_Unavailable(t *testing.T) {
+	_, err := NewPostgresStore("postgres://127.0.0.1:1/counter?connect_timeout=1")
+	assert.Error(t, err)
+}
+
+func TestPostgresStore(t *testing.T) {
+	dsn := os.Getenv("POSTGRESDSN")
+	if dsn == "" {
+		t.Skip("Skipping postgres test as POSTGRESDSN is not set up")
+	}
+
+	// Replicas starting at the same time migrate the schema only once
+	var wg sync.WaitGroup
+	stores := make([]*PostgresStore, 3)
+	errs := make([]error, len(stores))
+	for i := range stores {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			stores[i], errs[i] = NewPostgresStore(dsn)
+		}(i)
+	}
+	wg.Wait()
+	for i := range stores {
+		assert.NoError(t, errs[i])
+		defer stores[i].Close()
+	}
+	s := stores[0]
+
+	accessKey := uuid.New()
+	assert.NoError(t, s.Create("/postgres", Value{Count: 42, AccessKey: accessKey}))
+	defer s.Delete("/postgres")
+	assert.NoError(t, s.Increment("/postgres"))
+	assert.NoError(t, s.Increment("/postgres"))
+	assert.NoError(t, s.Decrement("/postgres"))
+
+	v, err := s.Get("/postgres")
+	assert.NoError(t, err)
+	assert.Equal(t, Value{Count: 43, AccessKey: accessKey, Version: 4}, v)
+
+	// Creating an existing counter replaces it
+	assert.NoError(t, s.Create("/postgres", Value{Count: 1, AccessKey: accessKey}))
+	v, err = s.Get("/postgres")
+	assert.NoError(t, err)
+	assert.Equal(t, Value{Count: 1, AccessKey: accessKey, Version: 5}, v)
+
+	// Expired counters start over
+	assert.NoError(t, s.Create("/postgres", Value{Count: 1, AccessKey: accessKey, Expires: time.Now().Add(-time.Second).Unix()}))
+	v, err = s.Get("/postgres")
+	assert.NoError(t, err)
+	assert.Equal(t, Value{}, v)
+	assert.NoError(t, s.Increment("/postgres"))
+	v, err = s.Get("/postgres")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, v.Count)
+	assert.Equal(t, uuid.Nil, v.AccessKey)
+}
+
+func TestPostgresStore_Purge(t *testing.T) {
+	dsn := os.Getenv("POSTGRESDSN")
+	if dsn == "" {
+		t.Skip("Skipping postgres test as POSTGRESDSN is not set up")
+	}
+
+	s, err := NewPostgresStore(dsn)
+	assert.NoError(t, err)
+	defer s.Close()
+	defer s.Delete("/purge/expires")
+
+	accessKey := uuid.New()
+	assert.NoError(t, s.Create("/purge/expired", Value{Count: 1, AccessKey: accessKey, Expires: time.Now().Add(-time.Second).Unix()}))
+	assert.NoError(t, s.Create("/purge/expires", Value{Count: 2, AccessKey: accessKey, Expires: time.Now().Add(time.Hour).Unix()}))
+
+	// Expired counters are removed from the table
+	assert.NoError(t, s.purge())
+	var n int
+	assert.NoError(t, s.pool.QueryRow(s.ctx, "SELECT count(*) FROM counters WHERE key LIKE '/purge/%'").Scan(&n))
+	assert.Equal(t, 1, n)
+}
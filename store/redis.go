@@ -1,22 +1,78 @@
 package store
 
 import (
+	"container/list"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 type RedisStore struct {
-	rdb *redis.Client
+	rdb redis.UniversalClient
 	ctx context.Context
+	// db is the selected database, keyspace notifications are published per database
+	db int
+	// prefix is the hash tag put in front of every key, if any
+	prefix string
+}
+
+// defaultRedisHashTag is the hash tag used with Redis Cluster if none is configured
+const defaultRedisHashTag = "counter"
+
+// RedisOptions configures a RedisStore connected to a single server, a Sentinel-managed master or a Redis Cluster
+type RedisOptions struct {
+	// Client configures the connection, a Sentinel-managed master is used if MasterName is set, a cluster if
+	// there are multiple addresses and otherwise the single address is connected to directly
+	Client redis.UniversalOptions
+	// Cluster connects to a Redis Cluster even with a single seed address
+	Cluster bool
+	// HashTag is put in braces in front of every key, so all keys map to the same cluster slot and multi-key
+	// operations like batches work. It defaults to "counter" with Redis Cluster and is empty otherwise.
+	HashTag string
 }
 
 func NewRedisStoreWithOptions(ctx context.Context, opts *redis.Options) *RedisStore {
 	return &RedisStore{
 		rdb: redis.NewClient(opts),
 		ctx: ctx,
+		db:  opts.DB,
+	}
+}
+
+// NewRedisStoreFromOptions creates a RedisStore with a redis.UniversalClient. With Redis Cluster all counters are
+// kept on the node owning the slot of the hash tag, the other nodes only provide failover.
+func NewRedisStoreFromOptions(ctx context.Context, opts RedisOptions) *RedisStore {
+	cluster := opts.Cluster || (opts.Client.MasterName == "" && len(opts.Client.Addrs) > 1)
+
+	var rdb redis.UniversalClient
+	if cluster {
+		rdb = redis.NewClusterClient(opts.Client.Cluster())
+		if opts.HashTag == "" {
+			opts.HashTag = defaultRedisHashTag
+		}
+	} else {
+		rdb = redis.NewUniversalClient(&opts.Client)
+	}
+
+	s := &RedisStore{
+		rdb: rdb,
+		ctx: ctx,
 	}
+	if !cluster {
+		// Clusters only have database 0
+		s.db = opts.Client.DB
+	}
+	if opts.HashTag != "" {
+		s.prefix = "{" + opts.HashTag + "}"
+	}
+	return s
 }
 
 func NewRedisStore(addr string) *RedisStore {
@@ -29,32 +85,91 @@ func NewRedisStore(addr string) *RedisStore {
 	)
 }
 
+// key returns the redis key of a counter
+func (rs *RedisStore) key(key string) string {
+	return rs.prefix + key
+}
+
+// counterKey returns the key of the counter stored at a redis key
+func (rs *RedisStore) counterKey(key string) string {
+	return strings.TrimPrefix(key, rs.prefix)
+}
+
+// keys returns the redis keys of counters
+func (rs *RedisStore) keys(keys []string) []string {
+	if rs.prefix == "" {
+		return keys
+	}
+
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = rs.key(key)
+	}
+	return prefixed
+}
+
+// shards returns a client for every cluster master, or the client itself if it isn't connected to a cluster
+func (rs *RedisStore) shards(ctx context.Context) ([]redis.UniversalClient, error) {
+	cluster, ok := rs.rdb.(*redis.ClusterClient)
+	if !ok {
+		return []redis.UniversalClient{rs.rdb}, nil
+	}
+
+	var mutex sync.Mutex
+	var shards []redis.UniversalClient
+	err := cluster.ForEachMaster(ctx, func(_ context.Context, client *redis.Client) error {
+		mutex.Lock()
+		shards = append(shards, client)
+		mutex.Unlock()
+		return nil
+	})
+	return shards, err
+}
+
 func (rs *RedisStore) set(key string, value Value) error {
 	b, err := json.Marshal(&value)
 	if err != nil {
 		return err
 	}
 
-	return rs.rdb.Set(rs.ctx, key, string(b), 0).Err()
+	return rs.rdb.Set(rs.ctx, rs.key(key), string(b), value.ttl()).Err()
+}
+
+// decode decodes a value as returned by MGET, nil means the key doesn't exist
+func decode(val interface{}) (Value, error) {
+	var v Value
+	if s, ok := val.(string); ok {
+		if err := json.Unmarshal([]byte(s), &v); err != nil {
+			return Value{}, err
+		}
+	}
+	return v, nil
 }
 
 func (rs *RedisStore) Create(key string, value Value) error {
+	old, err := rs.Get(key)
+	if err != nil {
+		return err
+	}
+
+	value.Version = old.Version + 1
+
 	return rs.set(key, value)
 }
 
 func (rs *RedisStore) Delete(key string) error {
-	return rs.rdb.Del(rs.ctx, key).Err()
+	return rs.rdb.Del(rs.ctx, rs.key(key)).Err()
 }
 
 func (rs *RedisStore) Get(key string) (Value, error) {
-	n, err := rs.rdb.Exists(rs.ctx, key).Result()
+	n, err := rs.rdb.Exists(rs.ctx, rs.key(key)).Result()
 	if err != nil {
 		return Value{}, err
 	} else if n == 0 {
 		return Value{}, nil
 	}
 
-	val, err := rs.rdb.Get(rs.ctx, key).Result()
+	val, err := rs.rdb.Get(rs.ctx, rs.key(key)).Result()
 	if err != nil {
 		return Value{}, err
 	}
@@ -67,6 +182,71 @@ func (rs *RedisStore) Get(key string) (Value, error) {
 	return v, nil
 }
 
+func (rs *RedisStore) GetMany(keys []string) ([]Value, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	vals, err := rs.rdb.MGet(rs.ctx, rs.keys(keys)...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]Value, len(keys))
+	for i, val := range vals {
+		if values[i], err = decode(val); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// Scan iterates the keys with SCAN and reads every page of keys with MGET,
+// keys that are deleted in between are skipped. With Redis Cluster every master is scanned.
+func (rs *RedisStore) Scan(prefix string, fn func(key string, value Value) error) error {
+	shards, err := rs.shards(rs.ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, shard := range shards {
+		if err := rs.scan(shard, prefix, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rs *RedisStore) scan(shard redis.UniversalClient, prefix string, fn func(key string, value Value) error) error {
+	var cursor uint64
+	for {
+		keys, next, err := shard.Scan(rs.ctx, cursor, globEscaper.Replace(rs.key(prefix))+"*", scanPageSize).Result()
+		if err != nil {
+			return err
+		}
+
+		for i, key := range keys {
+			keys[i] = rs.counterKey(key)
+		}
+		values, err := rs.GetMany(keys)
+		if err != nil {
+			return err
+		}
+		for i, key := range keys {
+			if values[i] == (Value{}) {
+				continue
+			}
+			if err := fn(key, values[i]); err != nil {
+				return err
+			}
+		}
+
+		if cursor = next; cursor == 0 {
+			return nil
+		}
+	}
+}
+
 func (rs *RedisStore) Increment(key string) error {
 	val, err := rs.Get(key)
 	if err != nil {
@@ -74,6 +254,7 @@ func (rs *RedisStore) Increment(key string) error {
 	}
 
 	val.Count++
+	val.Version++
 
 	return rs.set(key, val)
 }
@@ -85,10 +266,406 @@ func (rs *RedisStore) Decrement(key string) error {
 	}
 
 	val.Count--
+	val.Version++
 
 	return rs.set(key, val)
 }
 
+// applyScript applies an op to the counter KEYS[1] in a single round trip. ARGV are the kind and amount of the op,
+// the access key to check or "" and the versions to check. It returns the outcome of the checks and the fields of
+// the new value, numbers as integer replies, the remaining time to live of the key is kept. The value is encoded with
+// string.format as cjson writes large numbers in exponent notation.
+var applyScript = redis.NewScript(`
+local raw = redis.call('GET', KEYS[1])
+if not raw then
+	return {'not found'}
+end
+
+local v = cjson.decode(raw)
+if v.AccessKey == nil or v.AccessKey == '00000000-0000-0000-0000-000000000000' then
+	return {'not found'}
+elseif ARGV[3] ~= '' and ARGV[3] ~= v.AccessKey then
+	return {'wrong access key'}
+end
+
+local version = v.Version or 0
+if #ARGV > 3 then
+	local match = false
+	for i = 4, #ARGV do
+		if tonumber(ARGV[i]) == version then
+			match = true
+		end
+	end
+	if not match then
+		return {'version mismatch'}
+	end
+end
+
+if ARGV[1] == 'delete' then
+	redis.call('DEL', KEYS[1])
+	return {'ok'}
+end
+
+local count = v.Count or 0
+local amount = tonumber(ARGV[2])
+if ARGV[1] == 'increment' then
+	count = count + amount
+elseif ARGV[1] == 'decrement' then
+	count = count - amount
+else
+	count = amount
+end
+version = version + 1
+local expires = v.Expires or 0
+
+local encoded = string.format('{"Count":%d,"AccessKey":"%s","Version":%d', count, v.AccessKey, version)
+if expires ~= 0 then
+	encoded = encoded .. string.format(',"Expires":%d', expires)
+end
+local data = v.Data or ''
+if data ~= '' then
+	encoded = encoded .. ',"Data":' .. cjson.encode(data)
+end
+encoded = encoded .. '}'
+
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl > 0 then
+	redis.call('SET', KEYS[1], encoded, 'PX', ttl)
+else
+	redis.call('SET', KEYS[1], encoded)
+end
+return {'ok', count, v.AccessKey, version, expires, data}
+`)
+
+// applyScriptErrors are the errors of the failed checks reported by applyScript
+var applyScriptErrors = map[string]error{
+	"not found":        ErrNotFound,
+	"wrong access key": ErrWrongAccessKey,
+	"version mismatch": ErrVersionMismatch,
+}
+
+// Apply runs applyScript, which is sent with EVALSHA so only the first call transfers the script
+func (rs *RedisStore) Apply(op Op) (Value, error) {
+	switch op.Kind {
+	case OpCreate:
+		return rs.create(op)
+	case OpIncrement, OpDecrement, OpSet, OpDelete:
+	default:
+		return Value{}, fmt.Errorf("invalid op: %v", op.Kind)
+	}
+
+	accessKey := ""
+	if op.AccessKey != uuid.Nil {
+		accessKey = op.AccessKey.String()
+	}
+	args := []interface{}{string(op.Kind), op.Amount, accessKey}
+	for _, version := range op.Versions {
+		args = append(args, strconv.FormatUint(version, 10))
+	}
+
+	res, err := applyScript.Run(rs.ctx, rs.rdb, []string{rs.key(op.Key)}, args...).Result()
+	if err != nil {
+		return Value{}, err
+	}
+	reply, ok := res.([]interface{})
+	if !ok || len(reply) == 0 {
+		return Value{}, fmt.Errorf("unexpected reply: %v", res)
+	}
+
+	if status, _ := reply[0].(string); status != "ok" {
+		if err, ok := applyScriptErrors[status]; ok {
+			return Value{}, err
+		}
+		return Value{}, fmt.Errorf("unexpected reply: %v", res)
+	} else if op.Kind == OpDelete {
+		return Value{}, nil
+	}
+	return decodeApplyReply(reply)
+}
+
+// create applies an OpCreate with SET NX, keys that expired are already gone
+func (rs *RedisStore) create(op Op) (Value, error) {
+	v, err := applyOp(op, Value{})
+	if err != nil {
+		return Value{}, err
+	}
+	b, err := json.Marshal(&v)
+	if err != nil {
+		return Value{}, err
+	}
+
+	created, err := rs.rdb.SetNX(rs.ctx, rs.key(op.Key), string(b), v.ttl()).Result()
+	if err != nil {
+		return Value{}, err
+	} else if !created {
+		return Value{}, ErrExists
+	}
+	return v, nil
+}
+
+// decodeApplyReply decodes the count, access key, version, expiry time and data returned by applyScript
+func decodeApplyReply(reply []interface{}) (Value, error) {
+	if len(reply) != 6 {
+		return Value{}, fmt.Errorf("unexpected reply: %v", reply)
+	}
+	count, ok1 := reply[1].(int64)
+	accessKey, ok2 := reply[2].(string)
+	version, ok3 := reply[3].(int64)
+	expires, ok4 := reply[4].(int64)
+	data, ok5 := reply[5].(string)
+	if !ok1 || !ok2 || !ok3 || !ok4 || !ok5 {
+		return Value{}, fmt.Errorf("unexpected reply: %v", reply)
+	}
+
+	key, err := uuid.Parse(accessKey)
+	if err != nil {
+		return Value{}, err
+	}
+	return Value{Count: int(count), AccessKey: key, Version: uint64(version), Expires: expires, Data: data}, nil
+}
+
+// Batch watches all keys, reads them with MGET and writes the changes in a MULTI/EXEC pipeline,
+// which is retried when any of the keys was modified in between. With Redis Cluster all keys have to map to the
+// same slot, which the hash tag ensures.
+func (rs *RedisStore) Batch(ops []Op, atomic bool) ([]OpResult, error) {
+	keys := rs.keys(batchKeys(ops))
+
+	var results []OpResult
+	txf := func(tx *redis.Tx) error {
+		vals, err := tx.MGet(rs.ctx, keys...).Result()
+		if err != nil {
+			return err
+		}
+
+		values := make(map[string]Value, len(keys))
+		for i, val := range vals {
+			if values[rs.counterKey(keys[i])], err = decode(val); err != nil {
+				return err
+			}
+		}
+
+		var changed map[string]Value
+		results, changed, err = applyBatch(ops, atomic, func(key string) (Value, error) {
+			return values[key], nil
+		})
+		if err != nil || len(changed) == 0 {
+			return err
+		}
+
+		_, err = tx.TxPipelined(rs.ctx, func(pipe redis.Pipeliner) error {
+			for key, v := range changed {
+				b, err := json.Marshal(&v)
+				if err != nil {
+					return err
+				}
+				pipe.Set(rs.ctx, rs.key(key), string(b), v.ttl())
+			}
+			return nil
+		})
+		return err
+	}
+
+	for i := 0; i < maxBatchRetries; i++ {
+		err := rs.rdb.Watch(rs.ctx, txf, keys...)
+		if err != redis.TxFailedErr {
+			return results, err
+		}
+	}
+
+	return nil, errTooManyConflicts
+}
+
+// keyspaceEvents are the keyspace notifications Watch needs: keyspace events (K) of generic commands (g),
+// string commands ($) and expired keys (x)
+const keyspaceEvents = "Kg$x"
+
+// ErrKeyspaceEventsDisabled is returned by Watch if keyspace notifications are disabled and can't be enabled
+var ErrKeyspaceEventsDisabled = errors.New("redis keyspace notifications are disabled")
+
+// enableKeyspaceEvents makes sure the keyspace notifications needed by Watch are enabled on every cluster master.
+// Servers that don't allow CONFIG SET have to be configured with notify-keyspace-events set to at least Kg$x,
+// as do replicas that may be promoted by Sentinel or the cluster.
+func (rs *RedisStore) enableKeyspaceEvents(ctx context.Context) error {
+	shards, err := rs.shards(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrKeyspaceEventsDisabled, err)
+	}
+
+	for _, shard := range shards {
+		if err := enableKeyspaceEvents(ctx, shard); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func enableKeyspaceEvents(ctx context.Context, rdb redis.UniversalClient) error {
+	cfg, err := rdb.ConfigGet(ctx, "notify-keyspace-events").Result()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrKeyspaceEventsDisabled, err)
+	}
+
+	var current string
+	if len(cfg) == 2 {
+		current, _ = cfg[1].(string)
+	}
+
+	missing := ""
+	for _, c := range keyspaceEvents {
+		// A is an alias for all event classes
+		if !strings.ContainsRune(current, c) && (c == 'K' || !strings.ContainsRune(current, 'A')) {
+			missing += string(c)
+		}
+	}
+	if missing == "" {
+		return nil
+	}
+
+	if err := rdb.ConfigSet(ctx, "notify-keyspace-events", current+missing).Err(); err != nil {
+		return fmt.Errorf("%w: %v", ErrKeyspaceEventsDisabled, err)
+	}
+	return nil
+}
+
+// globEscaper escapes the characters with a special meaning in PSUBSCRIBE patterns
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+// redisWatchRecent is the amount of keys a watch remembers the last value of
+const redisWatchRecent = 10000
+
+// recentValues remembers the last values of the most recently changed keys
+type recentValues struct {
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type recentValue struct {
+	key   string
+	value Value
+}
+
+func newRecentValues(size int) *recentValues {
+	return &recentValues{size: size, entries: make(map[string]*list.Element), lru: list.New()}
+}
+
+// get returns the remembered value of a key
+func (r *recentValues) get(key string) (Value, bool) {
+	el, ok := r.entries[key]
+	if !ok {
+		return Value{}, false
+	}
+	r.lru.MoveToFront(el)
+	return el.Value.(*recentValue).value, true
+}
+
+// set remembers the value of a key, evicting the least recently changed key if there are too many. The zero Value
+// forgets the key.
+func (r *recentValues) set(key string, value Value) {
+	if el, ok := r.entries[key]; ok {
+		if value == (Value{}) {
+			r.lru.Remove(el)
+			delete(r.entries, key)
+			return
+		}
+		el.Value.(*recentValue).value = value
+		r.lru.MoveToFront(el)
+		return
+	} else if value == (Value{}) {
+		return
+	}
+
+	r.entries[key] = r.lru.PushFront(&recentValue{key: key, value: value})
+	if r.lru.Len() > r.size {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.entries, oldest.Value.(*recentValue).key)
+	}
+}
+
+// Watch subscribes to the keyspace notifications of keys starting with prefix and reads the new value on every
+// notification. Notifications don't carry the old value, so it is remembered from the previous event for the
+// redisWatchRecent most recently changed keys.
+// With Redis Cluster the subscription is made on the node owning the slot of the hash tag, as keyspace
+// notifications are only published by the node the key is stored on.
+func (rs *RedisStore) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	if err := rs.enableKeyspaceEvents(ctx); err != nil {
+		return nil, err
+	}
+
+	channelPrefix := fmt.Sprintf("__keyspace@%d__:", rs.db)
+	sub := rs.rdb.PSubscribe(ctx, channelPrefix+globEscaper.Replace(rs.key(prefix))+"*")
+	// Wait for the subscription to be confirmed, so no changes are missed after returning
+	if _, err := sub.Receive(ctx); err != nil {
+		_ = sub.Close()
+		return nil, err
+	}
+
+	ch := make(chan Event, watchBuffer)
+	go func() {
+		defer close(ch)
+		defer sub.Close()
+
+		last := newRecentValues(redisWatchRecent)
+		msgs := sub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-msgs:
+				if !ok {
+					return
+				}
+
+				key := rs.counterKey(strings.TrimPrefix(msg.Channel, channelPrefix))
+				var value Value
+				switch msg.Payload {
+				case "del", "expired", "evicted":
+				case "set":
+					v, err := rs.Get(key)
+					if err != nil {
+						continue
+					}
+					value = v
+				default:
+					continue
+				}
+
+				old, known := last.get(key)
+				if known && old == value {
+					// Multiple notifications can be folded into a single read
+					continue
+				}
+				e := newEvent(key, old, value)
+				if !known {
+					switch {
+					case value == (Value{}):
+						e.Op = EventDelete
+					case value.Version > 1:
+						// The counter existed, but its old value is unknown
+						e.Op = EventSet
+					}
+				}
+
+				last.set(key, value)
+
+				select {
+				case ch <- e:
+				default:
+					// The receiver can't keep up
+					return
+				}
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+func (rs *RedisStore) Ping(ctx context.Context) error {
+	return rs.rdb.Ping(ctx).Err()
+}
+
 func (rs *RedisStore) Close() error {
 	return rs.rdb.Close()
 }
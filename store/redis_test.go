@@ -0,0 +1,129 @@
+package store
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRedisStore_Keys(t *testing.T) {
+	s := NewRedisStoreFromOptions(context.Background(), RedisOptions{HashTag: "tag"})
+	defer s.Close()
+
+	assert.Equal(t, "{tag}/a", s.key("/a"))
+	assert.Equal(t, "/a", s.counterKey("{tag}/a"))
+	assert.Equal(t, []string{"{tag}/a", "{tag}/b"}, s.keys([]string{"/a", "/b"}))
+
+	// Clusters always use a hash tag and have no databases
+	cluster := NewRedisStoreFromOptions(context.Background(), RedisOptions{
+		Client: redis.UniversalOptions{Addrs: []string{"127.0.0.1:1", "127.0.0.1:2"}, DB: 1},
+	})
+	defer cluster.Close()
+	assert.Equal(t, "{counter}/a", cluster.key("/a"))
+	assert.Equal(t, 0, cluster.db)
+
+	plain := NewRedisStoreFromOptions(context.Background(), RedisOptions{Client: redis.UniversalOptions{DB: 1}})
+	defer plain.Close()
+	assert.Equal(t, "/a", plain.key("/a"))
+	assert.Equal(t, 1, plain.db)
+}
+
+func TestRedisStore_HashTag(t *testing.T) {
+	host := os.Getenv("REDISHOST")
+	if host == "" {
+		t.Skip("Skipping redis test as REDISHOST is not set up")
+	}
+
+	s := NewRedisStoreFromOptions(context.Background(), RedisOptions{
+		Client:  redis.UniversalOptions{Addrs: []string{host}},
+		HashTag: "test",
+	})
+	defer s.Close()
+	defer s.Delete("/a")
+	defer s.Delete("/b")
+
+	testBatch(t, s)
+
+	// Counters are stored with the hash tag in front of their key
+	n, err := s.rdb.Exists(context.Background(), "{test}/a", "{test}/b").Result()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+
+	plain := NewRedisStore(host)
+	defer plain.Close()
+	v, err := plain.Get("/a")
+	assert.NoError(t, err)
+	assert.Equal(t, Value{}, v)
+
+	// And their keys are returned without it
+	var keys []string
+	assert.NoError(t, s.Scan("/", func(key string, _ Value) error {
+		keys = append(keys, key)
+		return nil
+	}))
+	assert.ElementsMatch(t, []string{"/a", "/b"}, keys)
+
+	v, err = s.Apply(Op{Key: "/a", Kind: OpIncrement, Amount: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, 7, v.Count)
+	assert.NoError(t, s.Create("/c", Value{AccessKey: uuid.New()}))
+	defer s.Delete("/c")
+	values, err := s.GetMany([]string{"/a", "/c"})
+	assert.NoError(t, err)
+	assert.Equal(t, 7, values[0].Count)
+	assert.NotEqual(t, uuid.Nil, values[1].AccessKey)
+}
+
+func TestRedisStore_ApplyLargeNumbers(t *testing.T) {
+	host := os.Getenv("REDISHOST")
+	if host == "" {
+		t.Skip("Skipping redis test as REDISHOST is not set up")
+	}
+
+	s := NewRedisStore(host)
+	defer s.Close()
+	defer s.Delete("/a")
+
+	// Numbers with more digits than cjson writes without an exponent
+	accessKey := uuid.New()
+	expires := time.Now().Add(time.Hour).Unix()
+	assert.NoError(t, s.set("/a", Value{Count: 1 << 50, AccessKey: accessKey, Version: 1 << 40, Expires: expires}))
+
+	want := Value{Count: 1<<50 + 1, AccessKey: accessKey, Version: 1<<40 + 1, Expires: expires}
+	v, err := s.Apply(Op{Key: "/a", Kind: OpIncrement, Amount: 1, AccessKey: accessKey, Versions: []uint64{1 << 40}})
+	assert.NoError(t, err)
+	assert.Equal(t, want, v)
+
+	v, err = s.Get("/a")
+	assert.NoError(t, err)
+	assert.Equal(t, want, v)
+}
+
+func TestRecentValues(t *testing.T) {
+	r := newRecentValues(2)
+	a, b, c := Value{Count: 1, AccessKey: uuid.New()}, Value{Count: 2, AccessKey: uuid.New()}, Value{Count: 3, AccessKey: uuid.New()}
+
+	r.set("/a", a)
+	r.set("/b", b)
+	v, ok := r.get("/a")
+	assert.True(t, ok)
+	assert.Equal(t, a, v)
+
+	// The least recently used key is evicted
+	r.set("/c", c)
+	_, ok = r.get("/b")
+	assert.False(t, ok)
+	v, ok = r.get("/c")
+	assert.True(t, ok)
+	assert.Equal(t, c, v)
+
+	// And deleted keys are forgotten
+	r.set("/a", Value{})
+	_, ok = r.get("/a")
+	assert.False(t, ok)
+	assert.Equal(t, 1, r.lru.Len())
+}
@@ -0,0 +1,48 @@
+package store
+
+import (
+	"errors"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestScan(t *testing.T) {
+	forEachStore(t, testScan)
+}
+
+func testScan(t *testing.T, s Repository) {
+	accessKey := uuid.New()
+	assert.NoError(t, s.Create("/scan/a", Value{Count: 1, AccessKey: accessKey}))
+	assert.NoError(t, s.Create("/scan/b", Value{Count: 2, AccessKey: accessKey}))
+	assert.NoError(t, s.Create("/scanned", Value{Count: 3, AccessKey: accessKey}))
+	assert.NoError(t, s.Create("/other", Value{Count: 4, AccessKey: accessKey}))
+
+	counts := make(map[string]int)
+	err := s.Scan("/scan", func(key string, value Value) error {
+		assert.Equal(t, accessKey, value.AccessKey)
+		counts[key] = value.Count
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"/scan/a": 1, "/scan/b": 2, "/scanned": 3}, counts)
+
+	// Deleted counters aren't scanned
+	assert.NoError(t, s.Delete("/scan/b"))
+	counts = make(map[string]int)
+	assert.NoError(t, s.Scan("/scan/", func(key string, value Value) error {
+		counts[key] = value.Count
+		return nil
+	}))
+	assert.Equal(t, map[string]int{"/scan/a": 1}, counts)
+
+	// Errors stop the scan
+	stop := errors.New("stop")
+	calls := 0
+	err = s.Scan("/", func(string, Value) error {
+		calls++
+		return stop
+	})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, 1, calls)
+}
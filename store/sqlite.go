@@ -0,0 +1,442 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/google/uuid"
+	_ "modernc.org/sqlite"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sqliteMigrations are applied in order, the amount of applied migrations is stored as user_version of the database
+var sqliteMigrations = []string{
+	`CREATE TABLE counters (
+		key        TEXT PRIMARY KEY,
+		count      INTEGER NOT NULL,
+		access_key TEXT NOT NULL,
+		version    INTEGER NOT NULL,
+		expires    INTEGER NOT NULL DEFAULT 0
+	) WITHOUT ROWID`,
+	// Expired counters are purged periodically
+	`CREATE INDEX counters_expires ON counters (expires) WHERE expires != 0`,
+	// Records that aren't counters keep a payload
+	`ALTER TABLE counters ADD COLUMN data TEXT NOT NULL DEFAULT ''`,
+}
+
+// sqliteBusyTimeout is how long a write waits for other processes holding a lock on the database
+const sqliteBusyTimeout = 5 * time.Second
+
+// SQLiteStore keeps all counters in a single SQLite database file in WAL mode, expired counters are purged
+// periodically
+type SQLiteStore struct {
+	db *sql.DB
+	// mutex serializes writes, so events are published in the order they were committed
+	mutex  sync.Mutex
+	events broadcaster
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	params := url.Values{}
+	params.Add("_pragma", "journal_mode(WAL)")
+	params.Add("_pragma", "synchronous(NORMAL)")
+	params.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", sqliteBusyTimeout.Milliseconds()))
+	// Write transactions take the lock right away instead of failing when upgrading a read lock
+	params.Set("_txlock", "immediate")
+
+	db, err := sql.Open("sqlite", "file:"+path+"?"+params.Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := migrateSQLite(db); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &SQLiteStore{db: db, cancel: cancel}
+	purgeEvery(ctx, &s.wg, purgeInterval, s.purge)
+	return s, nil
+}
+
+// migrateSQLite applies all migrations that haven't been applied yet in a single transaction
+func migrateSQLite(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var version int
+	if err := tx.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	} else if version > len(sqliteMigrations) {
+		return fmt.Errorf("database schema version %v is newer than the supported version %v", version, len(sqliteMigrations))
+	}
+
+	for i, migration := range sqliteMigrations[version:] {
+		if _, err := tx.Exec(migration); err != nil {
+			return fmt.Errorf("migration %v failed: %w", version+i+1, err)
+		}
+	}
+	if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", len(sqliteMigrations))); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanValue(row rowScanner, v *Value) error {
+	return row.Scan(&v.Count, &v.AccessKey, &v.Version, &v.Expires, &v.Data)
+}
+
+// getTx reads the value of a key, expired values are deleted
+func getTx(tx *sql.Tx, key string) (Value, error) {
+	var v Value
+	err := scanValue(tx.QueryRow("SELECT count, access_key, version, expires, data FROM counters WHERE key = ?", key), &v)
+	if err == sql.ErrNoRows {
+		return Value{}, nil
+	} else if err != nil {
+		return Value{}, err
+	}
+
+	if v.expired() {
+		_, err = tx.Exec("DELETE FROM counters WHERE key = ?", key)
+		return Value{}, err
+	}
+	return v, nil
+}
+
+func setTx(tx *sql.Tx, key string, v Value) error {
+	_, err := tx.Exec(`INSERT INTO counters (key, count, access_key, version, expires, data) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET
+			count = excluded.count, access_key = excluded.access_key, version = excluded.version, expires = excluded.expires,
+			data = excluded.data`,
+		key, v.Count, v.AccessKey, v.Version, v.Expires, v.Data)
+	return err
+}
+
+// update runs fn in a write transaction and publishes the events it returns once committed
+func (s *SQLiteStore) update(fn func(tx *sql.Tx) ([]Event, error)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	events, err := fn(tx)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, e := range events {
+		s.events.publish(e)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) Get(key string) (Value, error) {
+	var v Value
+	err := scanValue(s.db.QueryRow(
+		"SELECT count, access_key, version, expires, data FROM counters WHERE key = ? AND (expires = 0 OR expires > ?)",
+		key, time.Now().Unix()), &v)
+	if err == sql.ErrNoRows {
+		return Value{}, nil
+	}
+	return v, err
+}
+
+func (s *SQLiteStore) GetMany(keys []string) ([]Value, error) {
+	found := make(map[string]Value, len(keys))
+	for start := 0; start < len(keys); start += scanPageSize {
+		page := keys[start:]
+		if len(page) > scanPageSize {
+			page = page[:scanPageSize]
+		}
+
+		args := make([]interface{}, 0, len(page)+1)
+		for _, key := range page {
+			args = append(args, key)
+		}
+		args = append(args, time.Now().Unix())
+
+		query := "SELECT key, count, access_key, version, expires, data FROM counters WHERE key IN (?" +
+			strings.Repeat(", ?", len(page)-1) + ") AND (expires = 0 OR expires > ?)"
+		rows, err := s.db.Query(query, args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var key string
+			var v Value
+			if err := rows.Scan(&key, &v.Count, &v.AccessKey, &v.Version, &v.Expires, &v.Data); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			found[key] = v
+		}
+		if err := rows.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	values := make([]Value, len(keys))
+	for i, key := range keys {
+		values[i] = found[key]
+	}
+	return values, nil
+}
+
+// prefixEnd returns the smallest key greater than all keys starting with prefix, or "" if there is none
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// Scan reads the counters in pages ordered by key, fn is called between pages so it can use the store
+func (s *SQLiteStore) Scan(prefix string, fn func(key string, value Value) error) error {
+	end := prefixEnd(prefix)
+	after := ""
+	for {
+		rows, err := s.db.Query(`SELECT key, count, access_key, version, expires, data FROM counters
+			WHERE key >= ? AND (? = '' OR key < ?) AND key > ? AND (expires = 0 OR expires > ?)
+			ORDER BY key LIMIT ?`,
+			prefix, end, end, after, time.Now().Unix(), scanPageSize)
+		if err != nil {
+			return err
+		}
+
+		var keys []string
+		var values []Value
+		for rows.Next() {
+			var key string
+			var v Value
+			if err := rows.Scan(&key, &v.Count, &v.AccessKey, &v.Version, &v.Expires, &v.Data); err != nil {
+				rows.Close()
+				return err
+			}
+			keys, values = append(keys, key), append(values, v)
+		}
+		if err := rows.Close(); err != nil {
+			return err
+		}
+
+		for i, key := range keys {
+			if err := fn(key, values[i]); err != nil {
+				return err
+			}
+		}
+		if len(keys) < scanPageSize {
+			return nil
+		}
+		after = keys[len(keys)-1]
+	}
+}
+
+func (s *SQLiteStore) Create(key string, value Value) error {
+	return s.update(func(tx *sql.Tx) ([]Event, error) {
+		old, err := getTx(tx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		value.Version = old.Version + 1
+		if err := setTx(tx, key, value); err != nil {
+			return nil, err
+		}
+		return []Event{newEvent(key, old, value)}, nil
+	})
+}
+
+func (s *SQLiteStore) Delete(key string) error {
+	return s.update(func(tx *sql.Tx) ([]Event, error) {
+		old, err := getTx(tx, key)
+		if err != nil || old == (Value{}) {
+			return nil, err
+		}
+
+		if _, err := tx.Exec("DELETE FROM counters WHERE key = ?", key); err != nil {
+			return nil, err
+		}
+		return []Event{newEvent(key, old, Value{})}, nil
+	})
+}
+
+// add atomically adds delta to the count of a key, keys that don't exist are created like in the other stores
+func (s *SQLiteStore) add(key string, delta int) error {
+	return s.update(func(tx *sql.Tx) ([]Event, error) {
+		old, err := getTx(tx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		var v Value
+		err = scanValue(tx.QueryRow(`INSERT INTO counters (key, count, access_key, version) VALUES (?, ?, ?, 1)
+			ON CONFLICT (key) DO UPDATE SET count = count + excluded.count, version = version + 1
+			RETURNING count, access_key, version, expires, data`, key, delta, old.AccessKey), &v)
+		if err != nil {
+			return nil, err
+		}
+		return []Event{newEvent(key, old, v)}, nil
+	})
+}
+
+func (s *SQLiteStore) Increment(key string) error {
+	return s.add(key, 1)
+}
+
+func (s *SQLiteStore) Decrement(key string) error {
+	return s.add(key, -1)
+}
+
+func (s *SQLiteStore) Apply(op Op) (v Value, err error) {
+	if op.Kind == OpIncrement || op.Kind == OpDecrement {
+		return s.applyDelta(op)
+	}
+
+	err = s.update(func(tx *sql.Tx) ([]Event, error) {
+		old, err := getTx(tx, op.Key)
+		if err != nil {
+			return nil, err
+		}
+		if v, err = applyOp(op, old); err != nil {
+			return nil, err
+		}
+
+		if v == (Value{}) {
+			_, err = tx.Exec("DELETE FROM counters WHERE key = ?", op.Key)
+		} else {
+			err = setTx(tx, op.Key, v)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return []Event{newEvent(op.Key, old, v)}, nil
+	})
+	if err != nil {
+		return Value{}, err
+	}
+	return v, nil
+}
+
+// applyDelta applies an increment or decrement with a single update, which only matches the counter if the checks
+// of the op pass. Otherwise the counter is read to tell which check failed.
+func (s *SQLiteStore) applyDelta(op Op) (v Value, err error) {
+	delta := op.Amount
+	if op.Kind == OpDecrement {
+		delta = -delta
+	}
+
+	query := `UPDATE counters SET count = count + ?, version = version + 1
+		WHERE key = ? AND (expires = 0 OR expires > ?) AND access_key <> ? AND (? = ? OR access_key = ?)`
+	args := []interface{}{delta, op.Key, time.Now().Unix(), uuid.Nil, op.AccessKey, uuid.Nil, op.AccessKey}
+	if len(op.Versions) > 0 {
+		query += " AND version IN (?" + strings.Repeat(", ?", len(op.Versions)-1) + ")"
+		for _, version := range op.Versions {
+			args = append(args, version)
+		}
+	}
+	query += " RETURNING count, access_key, version, expires, data"
+
+	err = s.update(func(tx *sql.Tx) ([]Event, error) {
+		err := scanValue(tx.QueryRow(query, args...), &v)
+		if err == sql.ErrNoRows {
+			old, err := getTx(tx, op.Key)
+			if err != nil {
+				return nil, err
+			} else if err := op.check(&old); err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("counter %v wasn't updated", op.Key)
+		} else if err != nil {
+			return nil, err
+		}
+
+		old := v
+		old.Count -= delta
+		old.Version--
+		return []Event{newEvent(op.Key, old, v)}, nil
+	})
+	if err != nil {
+		return Value{}, err
+	}
+	return v, nil
+}
+
+func (s *SQLiteStore) Batch(ops []Op, atomic bool) (results []OpResult, err error) {
+	err = s.update(func(tx *sql.Tx) ([]Event, error) {
+		old := make(map[string]Value)
+		var changed map[string]Value
+		var err error
+		results, changed, err = applyBatch(ops, atomic, func(key string) (Value, error) {
+			v, err := getTx(tx, key)
+			old[key] = v
+			return v, err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		events := make([]Event, 0, len(changed))
+		for key, v := range changed {
+			if err := setTx(tx, key, v); err != nil {
+				return nil, err
+			}
+			events = append(events, newEvent(key, old[key], v))
+		}
+		return events, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// purge deletes the counters that have expired, without events as they already don't exist for readers
+func (s *SQLiteStore) purge() error {
+	return s.update(func(tx *sql.Tx) ([]Event, error) {
+		_, err := tx.Exec("DELETE FROM counters WHERE expires != 0 AND expires <= ?", time.Now().Unix())
+		return nil, err
+	})
+}
+
+func (s *SQLiteStore) Watch(ctx context.Context, prefix string) (<-chan Event, error) {
+	return s.events.watch(ctx, prefix), nil
+}
+
+// Ping reads from the counters table, which fails if the database file can't be read
+func (s *SQLiteStore) Ping(ctx context.Context) error {
+	var n int
+	return s.db.QueryRowContext(ctx, "SELECT count(*) FROM (SELECT 1 FROM counters LIMIT 1)").Scan(&n)
+}
+
+// Close stops purging and closes the database
+func (s *SQLiteStore) Close() error {
+	s.cancel()
+	s.wg.Wait()
+	return s.db.Close()
+}
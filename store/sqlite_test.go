@@ -0,0 +1,185 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestSQLiteStore(t *testing.T) (*SQLiteStore, string, func()) {
+	dir, err := ioutil.TempDir("", "counter-sqlite")
+	assert.NoError(t, err)
+	path := filepath.Join(dir, "counter.db")
+
+	s, err := NewSQLiteStore(path)
+	assert.NoError(t, err)
+
+	return s, path, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	assert.Equal(t, "/b", prefixEnd("/a"))
+	assert.Equal(t, "0", prefixEnd("/"))
+	assert.Equal(t, "/b", prefixEnd("/a\xff"))
+	assert.Equal(t, "", prefixEnd("\xff\xff"))
+	assert.Equal(t, "", prefixEnd(""))
+}
+
+func TestSQLiteStore(t *testing.T) {
+	s, path, cleanup := newTestSQLiteStore(t)
+	defer cleanup()
+
+	accessKey := uuid.New()
+	assert.NoError(t, s.Create("/key", Value{Count: 42, AccessKey: accessKey}))
+	assert.NoError(t, s.Increment("/key"))
+	assert.NoError(t, s.Increment("/key"))
+	assert.NoError(t, s.Decrement("/key"))
+
+	v, err := s.Get("/key")
+	assert.NoError(t, err)
+	assert.Equal(t, Value{Count: 43, AccessKey: accessKey, Version: 4}, v)
+
+	// The data survives reopening the database
+	assert.NoError(t, s.Close())
+	s, err = NewSQLiteStore(path)
+	assert.NoError(t, err)
+	defer s.Close()
+
+	v, err = s.Get("/key")
+	assert.NoError(t, err)
+	assert.Equal(t, 43, v.Count)
+
+	assert.NoError(t, s.Delete("/key"))
+	v, err = s.Get("/key")
+	assert.NoError(t, err)
+	assert.Equal(t, Value{}, v)
+
+	// Deleting a key that doesn't exist is not an error
+	assert.NoError(t, s.Delete("/key"))
+}
+
+func TestSQLiteStore_ConcurrentIncrements(t *testing.T) {
+	s, _, cleanup := newTestSQLiteStore(t)
+	defer cleanup()
+
+	assert.NoError(t, s.Create("/key", Value{AccessKey: uuid.New()}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				assert.NoError(t, s.Increment("/key"))
+			}
+		}()
+	}
+	wg.Wait()
+
+	v, err := s.Get("/key")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, v.Count)
+}
+
+func TestSQLiteStore_ApplyDelta(t *testing.T) {
+	s, _, cleanup := newTestSQLiteStore(t)
+	defer cleanup()
+
+	accessKey := uuid.New()
+	assert.NoError(t, s.Create("/key", Value{Count: 1, AccessKey: accessKey}))
+	events, err := s.Watch(context.Background(), "/key")
+	assert.NoError(t, err)
+
+	v, err := s.Apply(Op{Key: "/key", Kind: OpDecrement, Amount: 3, AccessKey: accessKey, Versions: []uint64{1}})
+	assert.NoError(t, err)
+	assert.Equal(t, Value{Count: -2, AccessKey: accessKey, Version: 2}, v)
+	e := <-events
+	assert.Equal(t, EventDecrement, e.Op)
+	assert.Equal(t, Value{Count: 1, AccessKey: accessKey, Version: 1}, e.Old)
+
+	// The failed check is told apart
+	_, err = s.Apply(Op{Key: "/key", Kind: OpIncrement, Amount: 1, AccessKey: uuid.New()})
+	assert.Equal(t, ErrWrongAccessKey, err)
+	_, err = s.Apply(Op{Key: "/key", Kind: OpIncrement, Amount: 1, Versions: []uint64{1}})
+	assert.Equal(t, ErrVersionMismatch, err)
+	// Counters only created by Increment have no access key, so they don't exist
+	assert.NoError(t, s.Increment("/other"))
+	_, err = s.Apply(Op{Key: "/other", Kind: OpIncrement, Amount: 1})
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestSQLiteStore_Expires(t *testing.T) {
+	s, _, cleanup := newTestSQLiteStore(t)
+	defer cleanup()
+
+	val := Value{Count: 42, AccessKey: uuid.New(), Expires: time.Now().Add(-time.Second).Unix()}
+	assert.NoError(t, s.Create("/key", val))
+
+	v, err := s.Get("/key")
+	assert.NoError(t, err)
+	assert.Equal(t, Value{}, v)
+
+	// Incrementing an expired counter starts over
+	assert.NoError(t, s.Increment("/key"))
+	v, err = s.Get("/key")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, v.Count)
+	assert.Equal(t, uint64(1), v.Version)
+}
+
+func TestSQLiteStore_Purge(t *testing.T) {
+	s, _, cleanup := newTestSQLiteStore(t)
+	defer cleanup()
+
+	accessKey := uuid.New()
+	assert.NoError(t, s.Create("/expired", Value{Count: 1, AccessKey: accessKey, Expires: time.Now().Add(-time.Second).Unix()}))
+	assert.NoError(t, s.Create("/expires", Value{Count: 2, AccessKey: accessKey, Expires: time.Now().Add(time.Hour).Unix()}))
+	assert.NoError(t, s.Create("/kept", Value{Count: 3, AccessKey: accessKey}))
+
+	// Expired counters are removed from the table
+	assert.NoError(t, s.purge())
+	rows, err := s.db.Query("SELECT key FROM counters ORDER BY key")
+	assert.NoError(t, err)
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var key string
+		assert.NoError(t, rows.Scan(&key))
+		keys = append(keys, key)
+	}
+	assert.Equal(t, []string{"/expires", "/kept"}, keys)
+}
+
+func TestSQLiteStore_Migrations(t *testing.T) {
+	s, path, cleanup := newTestSQLiteStore(t)
+	defer cleanup()
+	assert.NoError(t, s.Close())
+
+	db, err := sql.Open("sqlite", path)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	var version int
+	assert.NoError(t, db.QueryRow("PRAGMA user_version").Scan(&version))
+	assert.Equal(t, len(sqliteMigrations), version)
+
+	var mode string
+	assert.NoError(t, db.QueryRow("PRAGMA journal_mode").Scan(&mode))
+	assert.Equal(t, "wal", mode)
+
+	// Databases written by a newer version are refused
+	_, err = db.Exec("PRAGMA user_version = 1000")
+	assert.NoError(t, err)
+	_, err = NewSQLiteStore(path)
+	assert.Error(t, err)
+}
@@ -1,6 +1,44 @@
 package store
 
-import "github.com/google/uuid"
+import (
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	"sync"
+	"time"
+)
+
+// maxBatchRetries is how often a batch is retried when optimistic concurrency control detects a conflict
+const maxBatchRetries = 10
+
+// scanPageSize is the amount of keys read at once by backends that scan in pages
+const scanPageSize = 1000
+
+// purgeInterval is how often stores without native expiry delete the counters that have expired,
+// which are treated like counters that do not exist until then
+const purgeInterval = time.Minute
+
+// purgeEvery calls purge every interval until ctx is done, a failed purge is retried with the next one
+func purgeEvery(ctx context.Context, wg *sync.WaitGroup, interval time.Duration, purge func() error) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				_ = purge()
+			}
+		}
+	}()
+}
+
+// errTooManyConflicts is returned when a batch could not be applied within maxBatchRetries attempts
+var errTooManyConflicts = errors.New("too many conflicting writes, giving up")
 
 //go:generate mockgen -destination mock_store/mock_store.go  . Repository
 
@@ -10,12 +48,50 @@ type Value struct {
 	Count int
 	// AccessKey is the key required to modify this counter
 	AccessKey uuid.UUID
+	// Version changes on every write of the value, it is only comparable for the same key and backend.
+	// Backends with native revisions (etcd, badger) fill it in on reads and ignore it on writes,
+	// the other backends store it with the value and increase it by one on every write.
+	Version uint64 `json:",omitempty"`
+	// Expires is the unix time after which the value is discarded, zero means it never expires.
+	// Expired values are treated like values that do not exist.
+	Expires int64 `json:",omitempty"`
+	// Data is an opaque payload of records that aren't counters, like webhook registrations. It is written by
+	// Create and kept by the ops changing the count.
+	Data string `json:",omitempty"`
+}
+
+// expired reports whether the value has an expiry time which has passed
+func (v Value) expired() bool {
+	return v.Expires != 0 && time.Now().Unix() >= v.Expires
+}
+
+// ttl returns the time left until the value expires rounded up to whole seconds, or 0 if it never expires
+func (v Value) ttl() time.Duration {
+	if v.Expires == 0 {
+		return 0
+	}
+	ttl := time.Until(time.Unix(v.Expires, 0)).Truncate(time.Second) + time.Second
+	if ttl < time.Second {
+		return time.Second
+	}
+	return ttl
+}
+
+// errPingMismatch is returned by pings that read back a different sentinel than they wrote
+var errPingMismatch = errors.New("read back a different value than written")
+
+// Pinger is implemented by stores that can check whether their backend is available
+type Pinger interface {
+	// Ping returns an error if the backend can't currently serve requests
+	Ping(ctx context.Context) error
 }
 
 // Repository defines the interface for storage backends
 type Repository interface {
 	// Get gets the value of a specified key
 	Get(key string) (Value, error)
+	// GetMany gets the values of multiple keys, the values are in the same order as the keys
+	GetMany(keys []string) ([]Value, error)
 	// Create creates the value with a specified key and value
 	Create(key string, value Value) error
 	// Delete deletes the entry with the specified key
@@ -24,6 +100,19 @@ type Repository interface {
 	Increment(key string) error
 	// Decrement atomically decrements the value of the specified key
 	Decrement(key string) error
+	// Apply applies a single op to an existing counter atomically and returns the new value, the zero Value for
+	// OpDelete. It fails with ErrNotFound, ErrWrongAccessKey or ErrVersionMismatch if the checks of the op fail,
+	// OpCreate fails with ErrExists if the counter exists.
+	Apply(op Op) (Value, error)
+	// Batch applies multiple ops in order, returning a result for every op. In atomic mode either all ops are
+	// applied or none, otherwise every op is applied independently. The error is only set when the backend fails.
+	Batch(ops []Op, atomic bool) ([]OpResult, error)
+	// Scan calls fn for every counter whose key starts with prefix, in no particular order. Scanning stops at the
+	// first error returned by fn, which is returned by Scan. Changes made during a scan may or may not be seen.
+	Scan(prefix string, fn func(key string, value Value) error) error
+	// Watch sends an event for every change of a key starting with prefix, until ctx is done and the channel is
+	// closed. The channel is closed early if the receiver can't keep up or the connection to the backend is lost.
+	Watch(ctx context.Context, prefix string) (<-chan Event, error)
 	// Close is the destructor of a repository and should clean up any connection, write back to disk etc.
 	Close() error
 }
@@ -0,0 +1,157 @@
+package store
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testStore creates a store for a test and returns a function closing it and removing what it left behind
+type testStore func(t *testing.T) (Repository, func())
+
+// tempDir creates a temporary directory for a store and returns the function removing it
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "counter-store")
+	assert.NoError(t, err)
+	return dir, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+// closing returns a function closing s and calling cleanup after
+func closing(s Repository, cleanup func()) func() {
+	return func() {
+		s.Close()
+		cleanup()
+	}
+}
+
+// shared returns a function that deletes the counters created since it was called, for stores whose data outlives
+// the test, and closes the store
+func shared(t *testing.T, s Repository) func() {
+	existing := make(map[string]bool)
+	assert.NoError(t, s.Scan("", func(key string, _ Value) error {
+		existing[key] = true
+		return nil
+	}))
+
+	return func() {
+		var created []string
+		assert.NoError(t, s.Scan("", func(key string, _ Value) error {
+			if !existing[key] {
+				created = append(created, key)
+			}
+			return nil
+		}))
+		for _, key := range created {
+			assert.NoError(t, s.Delete(key))
+		}
+		s.Close()
+	}
+}
+
+// testStores are all stores that implement the Repository contract, the shared ones are skipped unless the
+// environment variable with their address is set
+var testStores = []struct {
+	name string
+	open testStore
+}{
+	{"Memory", func(t *testing.T) (Repository, func()) {
+		return NewMemoryStore(), func() {}
+	}},
+	{"Diskv", func(t *testing.T) (Repository, func()) {
+		dir, cleanup := tempDir(t)
+		return NewDiskvStore(dir), cleanup
+	}},
+	{"Badger", func(t *testing.T) (Repository, func()) {
+		dir, cleanup := tempDir(t)
+		s, err := NewBadgerStore(dir)
+		if err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+		return s, closing(s, cleanup)
+	}},
+	{"SQLite", func(t *testing.T) (Repository, func()) {
+		dir, cleanup := tempDir(t)
+		s, err := NewSQLiteStore(filepath.Join(dir, "counter.db"))
+		if err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+		return s, closing(s, cleanup)
+	}},
+	{"Bolt", func(t *testing.T) (Repository, func()) {
+		dir, cleanup := tempDir(t)
+		s, err := NewBoltStore(filepath.Join(dir, "counter.bolt"))
+		if err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+		return s, closing(s, cleanup)
+	}},
+	{"PersistentMemory", func(t *testing.T) (Repository, func()) {
+		dir, cleanup := tempDir(t)
+		s, err := NewPersistentMemoryStore(dir, PersistOptions{Fsync: FsyncNever})
+		if err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+		return s, closing(s, cleanup)
+	}},
+	{"Coalescing", func(t *testing.T) (Repository, func()) {
+		// Nothing is flushed in the background, so reads see the pending deltas
+		s := NewCoalescingStore(NewMemoryStore(), CoalesceOptions{Interval: time.Hour})
+		return s, closing(s, func() {})
+	}},
+	{"Caching", func(t *testing.T) (Repository, func()) {
+		s := NewCachingStore(NewMemoryStore(), CacheOptions{Size: 100, TTL: time.Minute, Watch: true})
+		return s, closing(s, func() {})
+	}},
+	{"Redis", func(t *testing.T) (Repository, func()) {
+		host := os.Getenv("REDISHOST")
+		if host == "" {
+			t.Skip("Skipping redis test as REDISHOST is not set up")
+		}
+		s := NewRedisStore(host)
+		return s, shared(t, s)
+	}},
+	{"Etcd", func(t *testing.T) (Repository, func()) {
+		host := os.Getenv("ETCDHOST")
+		if host == "" {
+			t.Skip("Skipping etcd test as ETCDHOST is not set up")
+		}
+		s, err := NewEtcdStore([]string{host})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s, shared(t, s)
+	}},
+	{"Postgres", func(t *testing.T) (Repository, func()) {
+		dsn := os.Getenv("POSTGRESDSN")
+		if dsn == "" {
+			t.Skip("Skipping postgres test as POSTGRESDSN is not set up")
+		}
+		s, err := NewPostgresStore(dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s, shared(t, s)
+	}},
+}
+
+// forEachStore runs fn as a subtest with a new instance of every store in testStores
+func forEachStore(t *testing.T, fn func(t *testing.T, s Repository)) {
+	for _, ts := range testStores {
+		ts := ts
+		t.Run(ts.name, func(t *testing.T) {
+			s, cleanup := ts.open(t)
+			defer cleanup()
+
+			fn(t, s)
+		})
+	}
+}
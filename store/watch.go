@@ -0,0 +1,132 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// EventOp describes how a counter changed
+type EventOp string
+
+const (
+	EventCreate    EventOp = "create"
+	EventIncrement EventOp = "increment"
+	EventDecrement EventOp = "decrement"
+	EventSet       EventOp = "set"
+	EventDelete    EventOp = "delete"
+)
+
+// Event describes a change of a counter
+type Event struct {
+	// Key is the key of the changed counter
+	Key string
+	// Op is derived from the old and new value: counts that went up or down are an increment or decrement,
+	// any other change of an existing counter is a set
+	Op EventOp
+	// Old is the value before the change, the zero Value if the counter didn't exist.
+	// Redis can't tell the old value of a key unless it has seen a recent change of it during the watch,
+	// otherwise Old is the zero Value and Op is create for new counters and set or delete for existing ones.
+	Old Value
+	// Value is the value after the change, the zero Value if the counter was deleted
+	Value Value
+}
+
+// newEvent creates the event for a change from old to value
+func newEvent(key string, old, value Value) Event {
+	e := Event{Key: key, Op: EventSet, Old: old, Value: value}
+	switch {
+	case old == Value{} && value != Value{}:
+		e.Op = EventCreate
+	case old != Value{} && value == Value{}:
+		e.Op = EventDelete
+	case value.Count > old.Count:
+		e.Op = EventIncrement
+	case value.Count < old.Count:
+		e.Op = EventDecrement
+	}
+	return e
+}
+
+// watchBuffer is the amount of events buffered for a single watcher
+const watchBuffer = 64
+
+// errSlowWatcher stops a watch whose receiver can't keep up
+var errSlowWatcher = errors.New("watcher can't keep up")
+
+type watcher struct {
+	prefix string
+	ch     chan Event
+}
+
+// broadcaster fans out events to watchers in the same process, the zero value is ready to use
+type broadcaster struct {
+	mutex    sync.Mutex
+	watchers map[*watcher]struct{}
+}
+
+func (b *broadcaster) watch(ctx context.Context, prefix string) <-chan Event {
+	w := &watcher{prefix: prefix, ch: make(chan Event, watchBuffer)}
+
+	b.mutex.Lock()
+	if b.watchers == nil {
+		b.watchers = make(map[*watcher]struct{})
+	}
+	b.watchers[w] = struct{}{}
+	b.mutex.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		b.remove(w)
+	}()
+
+	return w.ch
+}
+
+func (b *broadcaster) remove(w *watcher) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.watchers[w]; ok {
+		delete(b.watchers, w)
+		close(w.ch)
+	}
+}
+
+// closeAll closes the channels of all watchers, it is used when events may have been lost
+func (b *broadcaster) closeAll() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for w := range b.watchers {
+		delete(b.watchers, w)
+		close(w.ch)
+	}
+}
+
+// active reports whether there are any watchers
+func (b *broadcaster) active() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return len(b.watchers) > 0
+}
+
+// publish sends the event to all interested watchers, watchers that can't keep up are dropped
+func (b *broadcaster) publish(e Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for w := range b.watchers {
+		if !strings.HasPrefix(e.Key, w.prefix) {
+			continue
+		}
+		select {
+		case w.ch <- e:
+		default:
+			delete(b.watchers, w)
+			close(w.ch)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestBroadcaster(t *testing.T) {
+	var b broadcaster
+	assert.False(t, b.active())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	all := b.watch(ctx, "/")
+	some := b.watch(ctx, "/some")
+	assert.True(t, b.active())
+
+	b.publish(Event{Key: "/other", Value: Value{Count: 1}})
+	b.publish(Event{Key: "/some/key", Value: Value{Count: 2}})
+
+	assert.Equal(t, "/other", (<-all).Key)
+	assert.Equal(t, "/some/key", (<-all).Key)
+	assert.Equal(t, "/some/key", (<-some).Key)
+
+	cancel()
+	_, ok := <-all
+	assert.False(t, ok)
+	_, ok = <-some
+	assert.False(t, ok)
+	assert.False(t, b.active())
+}
+
+func TestBroadcaster_SlowWatcher(t *testing.T) {
+	var b broadcaster
+
+	ch := b.watch(context.Background(), "")
+	for i := 0; i <= watchBuffer; i++ {
+		b.publish(Event{Key: "/key", Value: Value{Count: i}})
+	}
+
+	// The buffered events can still be received, after which the channel is closed
+	for i := 0; i < watchBuffer; i++ {
+		e, ok := <-ch
+		assert.True(t, ok)
+		assert.Equal(t, i, e.Value.Count)
+	}
+	_, ok := <-ch
+	assert.False(t, ok)
+	assert.False(t, b.active())
+}
+
+func TestWatch_Null(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := NewNullStore().Watch(ctx, "/")
+	assert.NoError(t, err)
+
+	cancel()
+	_, ok := <-events
+	assert.False(t, ok)
+}
+
+// nextEvent receives the next event, failing the test if it doesn't arrive in time
+func nextEvent(t *testing.T, events <-chan Event) Event {
+	select {
+	case e, ok := <-events:
+		assert.True(t, ok)
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for an event")
+		return Event{}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Repository) {
+		if _, ok := s.(*CoalescingStore); ok {
+			t.Skip("Skipping as watchers only see coalesced changes once they are flushed")
+		}
+		testWatch(t, s)
+	})
+}
+
+func testWatch(t *testing.T, s Repository) {
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := s.Watch(ctx, "/watch")
+	// Servers like miniredis don't support keyspace notifications
+	if errors.Is(err, ErrKeyspaceEventsDisabled) {
+		cancel()
+		t.Skipf("Skipping watch test: %v", err)
+	}
+	assert.NoError(t, err)
+
+	accessKey := uuid.New()
+	assert.NoError(t, s.Create("/other", Value{Count: 100, AccessKey: accessKey}))
+	assert.NoError(t, s.Create("/watch/a", Value{Count: 1, AccessKey: accessKey}))
+	e := nextEvent(t, events)
+	assert.Equal(t, "/watch/a", e.Key)
+	assert.Equal(t, EventCreate, e.Op)
+	assert.Equal(t, Value{}, e.Old)
+	assert.Equal(t, 1, e.Value.Count)
+	assert.Equal(t, accessKey, e.Value.AccessKey)
+
+	assert.NoError(t, s.Increment("/watch/a"))
+	e = nextEvent(t, events)
+	assert.Equal(t, EventIncrement, e.Op)
+	assert.Equal(t, 1, e.Old.Count)
+	assert.Equal(t, 2, e.Value.Count)
+
+	assert.NoError(t, s.Decrement("/watch/a"))
+	e = nextEvent(t, events)
+	assert.Equal(t, EventDecrement, e.Op)
+	assert.Equal(t, 2, e.Old.Count)
+	assert.Equal(t, 1, e.Value.Count)
+
+	results, err := s.Batch([]Op{{Key: "/watch/a", Kind: OpSet, Amount: 1, AccessKey: accessKey}}, true)
+	assert.NoError(t, err)
+	assert.NoError(t, results[0].Err)
+	e = nextEvent(t, events)
+	assert.Equal(t, EventSet, e.Op)
+	assert.Equal(t, 1, e.Old.Count)
+	assert.Equal(t, 1, e.Value.Count)
+
+	// Keys only need to start with the prefix
+	assert.NoError(t, s.Create("/watched", Value{Count: 5, AccessKey: accessKey}))
+	e = nextEvent(t, events)
+	assert.Equal(t, "/watched", e.Key)
+	assert.Equal(t, EventCreate, e.Op)
+
+	assert.NoError(t, s.Delete("/watch/a"))
+	e = nextEvent(t, events)
+	assert.Equal(t, "/watch/a", e.Key)
+	assert.Equal(t, EventDelete, e.Op)
+	assert.Equal(t, 1, e.Old.Count)
+	assert.Equal(t, Value{}, e.Value)
+
+	cancel()
+	for range events {
+		// Events that were sent before cancelling can still be buffered
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"counter/store"
+	"fmt"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// keepAliveInterval is how often a comment is sent on idle event streams to keep proxies from closing them
+const keepAliveInterval = 15 * time.Second
+
+// wantsEventStream reports whether the client asked for a Server-Sent Events stream
+func wantsEventStream(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// writeEvent writes a change of a counter as a Server-Sent Event, deleted counters have a null count
+func writeEvent(w http.ResponseWriter, key string, v *store.Value) error {
+	var err error
+	if v.AccessKey == uuid.Nil {
+		_, err = fmt.Fprintf(w, "event: delete\ndata: { \"%v\": null }\n\n", key)
+	} else {
+		_, err = fmt.Fprintf(w, "id: %v\nevent: count\ndata: %v\n\n", v.Version, marshal(key, v))
+	}
+	return err
+}
+
+// stream sends every change of a counter matching the watched prefix as a Server-Sent Event. The events returned
+// by initial are read once watching, so no change is missed, and sent first. It returns when the client disconnects.
+func (rs *Routes) stream(w http.ResponseWriter, r *http.Request, prefix string, match func(key string) bool,
+	initial func() ([]store.Event, error)) {
+	events, err := rs.repo.Watch(r.Context(), prefix)
+	if err != nil {
+		http.Error(w, "Couldn't watch database", http.StatusInternalServerError)
+		return
+	}
+
+	var initialEvents []store.Event
+	if initial != nil {
+		if initialEvents, err = initial(); err != nil {
+			http.Error(w, "Couldn't get value from database", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Streams outlive the write timeout of the server
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	for i := range initialEvents {
+		if err := writeEvent(w, initialEvents[i].Key, &initialEvents[i].Value); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		log.Errorf("stream: flushing not supported: %v", err)
+		return
+	}
+
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-events:
+			if !ok {
+				// The watch ended, clients reconnect and resume from their current state
+				return
+			} else if !match(e.Key) {
+				continue
+			}
+			err = writeEvent(w, e.Key, &e.Value)
+		case <-ticker.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		}
+
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// streamCounter streams the changes of a single counter, starting with its current value
+func (rs *Routes) streamCounter(w http.ResponseWriter, r *http.Request, key string) {
+	log.Tracef("streamCounter on %v", key)
+
+	rs.stream(w, r, key, func(k string) bool {
+		return k == key
+	}, func() ([]store.Event, error) {
+		c, err := rs.repo.Get(key)
+		return []store.Event{{Key: key, Value: c}}, err
+	})
+}
+
+// StreamPrefix streams the changes of all counters below the path following /_stream
+func (rs *Routes) StreamPrefix(w http.ResponseWriter, r *http.Request) {
+	prefix := strings.TrimPrefix(r.URL.Path, reservedPrefix+"stream")
+	if strings.Trim(prefix, "/") == "" {
+		prefix = "/"
+	} else {
+		var err error
+		if prefix, err = normalizeKey(prefix); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid key: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	log.Tracef("StreamPrefix on %v", prefix)
+
+	rs.stream(w, r, prefix, func(key string) bool {
+		if strings.HasPrefix(key, reservedPrefix) {
+			return false
+		}
+		return prefix == "/" || key == prefix || strings.HasPrefix(key, prefix+"/")
+	}, nil)
+}
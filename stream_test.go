@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"counter/store"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// readEvent reads the next Server-Sent Event and returns its lines
+func readEvent(t *testing.T, r *bufio.Reader) []string {
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		assert.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+func TestRoutes_StreamCounter(t *testing.T) {
+	s := store.NewMemoryStore()
+	assert.NoError(t, s.Create("/yeet", store.Value{Count: 1, AccessKey: uuid.New()}))
+	rs := NewRoutes(s)
+
+	srv := httptest.NewServer(http.HandlerFunc(rs.GetCounter))
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/yeet", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	r := bufio.NewReader(resp.Body)
+	assert.Equal(t, []string{"id: 1", "event: count", `data: { "/yeet": 1 }`}, readEvent(t, r))
+
+	// Other counters are not streamed
+	assert.NoError(t, s.Create("/yeet/other", store.Value{Count: 5, AccessKey: uuid.New()}))
+	assert.NoError(t, s.Increment("/yeet"))
+	assert.Equal(t, []string{"id: 2", "event: count", `data: { "/yeet": 2 }`}, readEvent(t, r))
+
+	assert.NoError(t, s.Delete("/yeet"))
+	assert.Equal(t, []string{"event: delete", `data: { "/yeet": null }`}, readEvent(t, r))
+}
+
+// changingStore increments a counter when a watch is started
+type changingStore struct {
+	store.Repository
+	key string
+}
+
+func (s *changingStore) Watch(ctx context.Context, prefix string) (<-chan store.Event, error) {
+	if err := s.Repository.Increment(s.key); err != nil {
+		return nil, err
+	}
+	return s.Repository.Watch(ctx, prefix)
+}
+
+func TestRoutes_StreamCounterChangedBeforeWatch(t *testing.T) {
+	s := store.NewMemoryStore()
+	assert.NoError(t, s.Create("/yeet", store.Value{Count: 1, AccessKey: uuid.New()}))
+	rs := NewRoutes(&changingStore{Repository: s, key: "/yeet"})
+
+	srv := httptest.NewServer(http.HandlerFunc(rs.GetCounter))
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/yeet", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	// The change made before watching is part of the initial value
+	r := bufio.NewReader(resp.Body)
+	assert.Equal(t, []string{"id: 2", "event: count", `data: { "/yeet": 2 }`}, readEvent(t, r))
+}
+
+func TestRoutes_StreamPrefix(t *testing.T) {
+	s := store.NewMemoryStore()
+	rs := NewRoutes(s)
+
+	srv := httptest.NewServer(http.HandlerFunc(rs.StreamPrefix))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/_stream/some")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	r := bufio.NewReader(resp.Body)
+
+	assert.NoError(t, s.Create("/something", store.Value{Count: 1, AccessKey: uuid.New()}))
+	assert.NoError(t, s.Create("/some/path", store.Value{Count: 2, AccessKey: uuid.New()}))
+	assert.Equal(t, []string{"id: 1", "event: count", `data: { "/some/path": 2 }`}, readEvent(t, r))
+}
+
+func TestRoutes_StreamPrefixInvalid(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/_stream/_reserved", nil)
+
+	rs := NewRoutes(store.NewMemoryStore())
+	rs.StreamPrefix(w, r)
+
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestClientTLSConfig(t *testing.T) {
+	cfg, err := clientTLSConfig("", "", "", true)
+	assert.NoError(t, err)
+	assert.True(t, cfg.InsecureSkipVerify)
+	assert.Nil(t, cfg.RootCAs)
+	assert.Empty(t, cfg.Certificates)
+
+	dir, err := ioutil.TempDir("", "counter-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = clientTLSConfig(filepath.Join(dir, "missing.pem"), "", "", false)
+	assert.Error(t, err)
+
+	invalid := filepath.Join(dir, "invalid.pem")
+	assert.NoError(t, ioutil.WriteFile(invalid, []byte("not a certificate"), 0644))
+	_, err = clientTLSConfig(invalid, "", "", false)
+	assert.Error(t, err)
+
+	// A certificate needs its key
+	_, err = clientTLSConfig("", invalid, "", false)
+	assert.Error(t, err)
+}
@@ -0,0 +1,817 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"counter/store"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// webhookPrefix is the path prefix under which the webhooks of a counter are managed
+	webhookPrefix = "/_webhooks"
+	// webhookRecordPrefix is the prefix of the store keys of webhook registrations
+	webhookRecordPrefix = reservedPrefix + "webhooks"
+	// webhookClaimPrefix is the prefix of the store keys of the records claiming the delivery of an event
+	webhookClaimPrefix = reservedPrefix + "webhook-claims/"
+	// webhookClaimWindow is how long a claim is kept, replicas whose watch lags further behind deliver again
+	webhookClaimWindow = time.Hour
+	// maxWebhooksPerCounter is the maximum amount of webhooks a single counter can have
+	maxWebhooksPerCounter = 10
+	// maxWebhookURLLength and maxWebhookSecretLength bound the size of registrations, which are stored with their
+	// records and sent in the change notifications of databases limiting their size
+	maxWebhookURLLength    = 2048
+	maxWebhookSecretLength = 256
+	// webhookQueueSize is the amount of deliveries that can be pending, deliveries that don't fit are dead letters
+	webhookQueueSize = 1024
+	// webhookWorkers is the amount of deliveries made at the same time
+	webhookWorkers = 4
+	// signatureHeader contains the hex encoded HMAC-SHA256 of the body, keyed with the secret of the webhook
+	signatureHeader = "X-Counter-Signature"
+	// webhookEventHeader contains the event that triggered a delivery
+	webhookEventHeader = "X-Counter-Event"
+)
+
+// Events a webhook can be registered for
+const (
+	webhookChange    = "change"
+	webhookThreshold = "threshold"
+	webhookDelete    = "delete"
+)
+
+// webhook is the registration of a webhook on a counter
+type webhook struct {
+	ID     string   `json:"id,omitempty"`
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	// Threshold is the count that triggers threshold events when it is crossed in either direction
+	Threshold *int   `json:"threshold,omitempty"`
+	Secret    string `json:"secret,omitempty"`
+}
+
+// wants reports whether the webhook is registered for the event
+func (h *webhook) wants(event string) bool {
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// registration is a webhook together with the store key of its record
+type registration struct {
+	key  string
+	hook webhook
+}
+
+// webhookRecordKey returns the store key of the record of a registration, its id is the access key of the record.
+// The key of the counter is hashed, so record keys have a fixed length and the records of a counter can be scanned
+// without the ones of the counters below it.
+func webhookRecordKey(key, id string) string {
+	sum := sha256.Sum256([]byte(key))
+	return webhookRecordPrefix + "/" + hex.EncodeToString(sum[:]) + "/" + id
+}
+
+// webhookRecord is the data of the record of a registration
+type webhookRecord struct {
+	Key string `json:"key"`
+	webhook
+}
+
+// parseWebhookRecord returns the counter key and registration stored in a record
+func parseWebhookRecord(recordKey string, v *store.Value) (string, webhook, error) {
+	var rec webhookRecord
+	if err := json.Unmarshal([]byte(v.Data), &rec); err != nil {
+		return "", webhook{}, fmt.Errorf("invalid webhook record %q: %w", recordKey, err)
+	}
+	rec.ID = v.AccessKey.String()
+	if webhookRecordKey(rec.Key, rec.ID) != recordKey {
+		return "", webhook{}, fmt.Errorf("invalid webhook record %q", recordKey)
+	}
+	return rec.Key, rec.webhook, nil
+}
+
+// webhookClaimKey returns the store key of the record claiming the delivery of a change. Every replica sees the same
+// value after a change, even when they disagree on the old one, so the claim is derived from the new value.
+func webhookClaimKey(e *store.Event) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%v\n%v\n%v\n%v", e.Key, e.Value.AccessKey, e.Value.Version, e.Value.Count)))
+	return webhookClaimPrefix + hex.EncodeToString(sum[:])
+}
+
+// webhookPayload is the body of a delivery
+type webhookPayload struct {
+	Webhook   string `json:"webhook"`
+	Event     string `json:"event"`
+	Key       string `json:"key"`
+	Old       *int   `json:"old"`
+	Count     *int   `json:"count"`
+	Threshold *int   `json:"threshold,omitempty"`
+	Time      int64  `json:"time"`
+}
+
+type webhookDelivery struct {
+	hook     webhook
+	event    string
+	body     []byte
+	attempts int
+}
+
+// deadLetter is written to the dead letter log for every delivery that failed permanently
+type deadLetter struct {
+	URL      string          `json:"url"`
+	Event    string          `json:"event"`
+	Attempts int             `json:"attempts"`
+	Error    string          `json:"error"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+// WebhookOptions configures the delivery of webhooks
+type WebhookOptions struct {
+	// MaxAttempts is how often a delivery is attempted before it is written to the dead letter log
+	MaxAttempts int
+	// Backoff is the delay before the first retry, it doubles on every following retry up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Timeout is the timeout of a single delivery attempt
+	Timeout time.Duration
+	// DeadLetters receives a JSON line for every delivery that failed permanently, they are logged if it is nil
+	DeadLetters io.Writer
+	// AllowPrivate allows deliveries to loopback, private and link-local addresses
+	AllowPrivate bool
+}
+
+var (
+	// errWebhookAddress is returned for deliveries to addresses that aren't allowed
+	errWebhookAddress = errors.New("address not allowed")
+	// errTooManyWebhooks is returned when registering more than maxWebhooksPerCounter webhooks on a counter
+	errTooManyWebhooks = errors.New("too many webhooks")
+	// errWebhooksClosed is the error of the dead letters of deliveries that were still pending when closing
+	errWebhooksClosed = errors.New("shutting down")
+)
+
+// publicOnly is a net.Dialer Control function refusing connections to addresses that aren't publicly routable, so
+// webhooks can't be used to reach the network the server is running in. It runs after resolving the host, so host
+// names resolving to such addresses and redirects to them are refused as well.
+func publicOnly(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("%w: %v", errWebhookAddress, host)
+	}
+	return nil
+}
+
+// Webhooks keeps the webhook registrations of counters and delivers their events.
+// Registrations are stored in the repository, every instance keeps them in memory and follows their changes.
+// Every instance sees every event, the one that claims it in the repository first delivers it.
+type Webhooks struct {
+	repo store.Repository
+	// id identifies the instance in its claims
+	id      uuid.UUID
+	opts    WebhookOptions
+	client  *http.Client
+	queue   chan *webhookDelivery
+	workers sync.WaitGroup
+
+	mutex sync.RWMutex
+	hooks map[string][]registration
+
+	// deliveryMutex guards the retries waiting for their backoff and closed
+	deliveryMutex sync.Mutex
+	retries       map[*webhookDelivery]*time.Timer
+	closed        bool
+
+	deadLetterMutex sync.Mutex
+}
+
+func NewWebhooks(repo store.Repository, opts WebhookOptions) *Webhooks {
+	dialer := &net.Dialer{Timeout: opts.Timeout}
+	if !opts.AllowPrivate {
+		dialer.Control = publicOnly
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy would be dialed instead of the host of the webhook
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &Webhooks{
+		repo:    repo,
+		id:      uuid.New(),
+		opts:    opts,
+		client:  &http.Client{Timeout: opts.Timeout, Transport: transport},
+		queue:   make(chan *webhookDelivery, webhookQueueSize),
+		hooks:   make(map[string][]registration),
+		retries: make(map[*webhookDelivery]*time.Timer),
+	}
+}
+
+// Run watches all counters and delivers the events of their webhooks until ctx is done, the registrations are loaded
+// every time the watch is established. Changes made while the watch is being re-established after losing it don't
+// trigger webhooks. Run returns once the deliveries in progress are finished.
+func (wh *Webhooks) Run(ctx context.Context) {
+	wh.startWorkers(ctx)
+	defer wh.workers.Wait()
+
+	backoff := wh.opts.Backoff
+	for ctx.Err() == nil {
+		events, err := wh.repo.Watch(ctx, "/")
+		if err != nil {
+			log.Errorf("Webhooks: couldn't watch database: %v", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > wh.opts.MaxBackoff {
+				backoff = wh.opts.MaxBackoff
+			}
+			continue
+		}
+
+		backoff = wh.opts.Backoff
+		if err := wh.load(); err != nil {
+			log.Errorf("Webhooks: couldn't load registrations: %v", err)
+		}
+		wh.dispatchAll(events)
+	}
+}
+
+func (wh *Webhooks) startWorkers(ctx context.Context) {
+	for i := 0; i < webhookWorkers; i++ {
+		wh.workers.Add(1)
+		go func() {
+			defer wh.workers.Done()
+			wh.worker(ctx)
+		}()
+	}
+}
+
+// load replaces the registrations kept in memory with the ones in the repository
+func (wh *Webhooks) load() error {
+	hooks := make(map[string][]registration)
+	err := wh.repo.Scan(webhookRecordPrefix+"/", func(recordKey string, v store.Value) error {
+		key, hook, err := parseWebhookRecord(recordKey, &v)
+		if err != nil {
+			log.Warnf("Webhooks: skipping registration: %v", err)
+			return nil
+		}
+		hooks[key] = append(hooks[key], registration{key: recordKey, hook: hook})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	wh.mutex.Lock()
+	wh.hooks = hooks
+	wh.mutex.Unlock()
+	return nil
+}
+
+// Close writes the deliveries that are still queued or waiting for a retry to the dead letter log, from then on
+// deliveries go there directly. It has to be called after Run returned.
+func (wh *Webhooks) Close() error {
+	wh.deliveryMutex.Lock()
+	wh.closed = true
+	pending := make([]*webhookDelivery, 0, len(wh.retries)+len(wh.queue))
+	for d, timer := range wh.retries {
+		timer.Stop()
+		pending = append(pending, d)
+	}
+	wh.retries = nil
+	for len(wh.queue) > 0 {
+		pending = append(pending, <-wh.queue)
+	}
+	wh.deliveryMutex.Unlock()
+
+	for _, d := range pending {
+		wh.deadLetter(d, errWebhooksClosed)
+	}
+	return nil
+}
+
+// dispatchAll dispatches events until the channel is closed
+func (wh *Webhooks) dispatchAll(events <-chan store.Event) {
+	for e := range events {
+		wh.dispatch(&e)
+	}
+}
+
+// crossed reports whether a count moved across the threshold
+func crossed(old, count, threshold int) bool {
+	return old < threshold && count >= threshold || old >= threshold && count < threshold
+}
+
+// dispatch queues the deliveries of all webhooks interested in the event
+func (wh *Webhooks) dispatch(e *store.Event) {
+	if strings.HasPrefix(e.Key, webhookRecordPrefix+"/") {
+		wh.follow(e)
+		return
+	} else if strings.HasPrefix(e.Key, reservedPrefix) {
+		return
+	}
+
+	wh.mutex.Lock()
+	hooks := wh.hooks[e.Key]
+	if e.Op == store.EventDelete {
+		// The webhooks belong to the counter
+		delete(wh.hooks, e.Key)
+	}
+	wh.mutex.Unlock()
+
+	if e.Op == store.EventDelete {
+		wh.dispatchDelete(e, hooks)
+		return
+	} else if e.Op == store.EventCreate {
+		return
+	}
+
+	type pending struct {
+		hook  *webhook
+		event string
+	}
+	var deliveries []pending
+	for i := range hooks {
+		hook := &hooks[i].hook
+		if hook.wants(webhookChange) {
+			deliveries = append(deliveries, pending{hook, webhookChange})
+		}
+		if hook.wants(webhookThreshold) && crossed(e.Old.Count, e.Value.Count, *hook.Threshold) {
+			deliveries = append(deliveries, pending{hook, webhookThreshold})
+		}
+	}
+	if len(deliveries) == 0 || !wh.claim(e) {
+		return
+	}
+	for _, d := range deliveries {
+		wh.enqueue(d.hook, d.event, e)
+	}
+}
+
+// claim reports whether this instance claimed the delivery of a change, false means another instance did or the
+// claim couldn't be made
+func (wh *Webhooks) claim(e *store.Event) bool {
+	_, err := wh.repo.Apply(store.Op{
+		Key:       webhookClaimKey(e),
+		Kind:      store.OpCreate,
+		AccessKey: wh.id,
+		Expires:   time.Now().Add(webhookClaimWindow).Unix(),
+	})
+	if err == store.ErrExists {
+		return false
+	} else if err != nil {
+		log.Errorf("Webhooks: couldn't claim change of %v: %v", e.Key, err)
+		return false
+	}
+	return true
+}
+
+// dispatchDelete removes the registrations of a deleted counter and queues their delete events. Deleting a
+// registration claims its delivery, the instance whose delete succeeds delivers it.
+func (wh *Webhooks) dispatchDelete(e *store.Event, hooks []registration) {
+	for i := range hooks {
+		_, err := wh.repo.Apply(store.Op{Key: hooks[i].key, Kind: store.OpDelete})
+		if err == store.ErrNotFound {
+			continue
+		} else if err != nil {
+			log.Errorf("Webhooks: couldn't delete registration of deleted counter %v: %v", e.Key, err)
+			continue
+		}
+
+		if hook := &hooks[i].hook; hook.wants(webhookDelete) {
+			wh.enqueue(hook, webhookDelete, e)
+		}
+	}
+}
+
+func (wh *Webhooks) enqueue(hook *webhook, event string, e *store.Event) {
+	payload := webhookPayload{
+		Webhook: hook.ID,
+		Event:   event,
+		Key:     e.Key,
+		Time:    time.Now().Unix(),
+	}
+	if e.Old.AccessKey != uuid.Nil {
+		old := e.Old.Count
+		payload.Old = &old
+	}
+	if e.Value.AccessKey != uuid.Nil {
+		count := e.Value.Count
+		payload.Count = &count
+	}
+	if event == webhookThreshold {
+		payload.Threshold = hook.Threshold
+	}
+
+	body, err := json.Marshal(&payload)
+	if err != nil {
+		log.Errorf("Webhooks: couldn't encode payload: %v", err)
+		return
+	}
+
+	wh.submit(&webhookDelivery{hook: *hook, event: event, body: body})
+}
+
+// follow applies a change of a registration made by any instance to the registrations kept in memory
+func (wh *Webhooks) follow(e *store.Event) {
+	if e.Op == store.EventDelete {
+		wh.removeRecord(e.Key)
+		return
+	}
+
+	key, hook, err := parseWebhookRecord(e.Key, &e.Value)
+	if err != nil {
+		log.Warnf("Webhooks: skipping registration: %v", err)
+		return
+	}
+	wh.add(key, registration{key: e.Key, hook: hook})
+}
+
+// add adds a registration to the ones kept in memory, unless it is known already
+func (wh *Webhooks) add(key string, reg registration) {
+	wh.mutex.Lock()
+	defer wh.mutex.Unlock()
+
+	for _, known := range wh.hooks[key] {
+		if known.key == reg.key {
+			return
+		}
+	}
+	wh.hooks[key] = append(wh.hooks[key], reg)
+}
+
+// remove removes a registration from the ones kept in memory
+func (wh *Webhooks) remove(key, recordKey string) {
+	wh.mutex.Lock()
+	defer wh.mutex.Unlock()
+
+	hooks := wh.hooks[key]
+	for i := range hooks {
+		if hooks[i].key == recordKey {
+			wh.hooks[key] = append(hooks[:i:i], hooks[i+1:]...)
+			if len(wh.hooks[key]) == 0 {
+				delete(wh.hooks, key)
+			}
+			return
+		}
+	}
+}
+
+// removeRecord removes a registration from the ones kept in memory, without knowing the key of its counter
+func (wh *Webhooks) removeRecord(recordKey string) {
+	wh.mutex.RLock()
+	key := ""
+	for k, regs := range wh.hooks {
+		for _, reg := range regs {
+			if reg.key == recordKey {
+				key = k
+			}
+		}
+	}
+	wh.mutex.RUnlock()
+
+	if key != "" {
+		wh.remove(key, recordKey)
+	}
+}
+
+// submit queues a delivery, if the queue is full or closed it is written to the dead letter log instead
+func (wh *Webhooks) submit(d *webhookDelivery) {
+	wh.deliveryMutex.Lock()
+	var err error
+	if wh.closed {
+		err = errWebhooksClosed
+	} else {
+		select {
+		case wh.queue <- d:
+		default:
+			err = fmt.Errorf("delivery queue is full")
+		}
+	}
+	wh.deliveryMutex.Unlock()
+
+	if err != nil {
+		wh.deadLetter(d, err)
+	}
+}
+
+// retry submits a delivery again after the backoff, unless closing in between writes it to the dead letter log
+func (wh *Webhooks) retry(d *webhookDelivery, backoff time.Duration) {
+	wh.deliveryMutex.Lock()
+	closed := wh.closed
+	if !closed {
+		wh.retries[d] = time.AfterFunc(backoff, func() {
+			wh.deliveryMutex.Lock()
+			_, ok := wh.retries[d]
+			delete(wh.retries, d)
+			wh.deliveryMutex.Unlock()
+
+			if ok {
+				wh.submit(d)
+			}
+		})
+	}
+	wh.deliveryMutex.Unlock()
+
+	if closed {
+		wh.deadLetter(d, errWebhooksClosed)
+	}
+}
+
+func (wh *Webhooks) worker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case d := <-wh.queue:
+			err := wh.deliver(ctx, d)
+			if err == nil {
+				continue
+			}
+
+			// Deliveries interrupted by shutting down aren't retried
+			if d.attempts >= wh.opts.MaxAttempts || ctx.Err() != nil {
+				wh.deadLetter(d, err)
+				continue
+			}
+
+			backoff := wh.opts.Backoff << (d.attempts - 1)
+			if backoff > wh.opts.MaxBackoff || backoff <= 0 {
+				backoff = wh.opts.MaxBackoff
+			}
+			log.Debugf("Webhooks: delivery to %v failed, retrying in %v: %v", d.hook.URL, backoff, err)
+			wh.retry(d, backoff)
+		}
+	}
+}
+
+// sign returns the hex encoded HMAC-SHA256 of the body
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (wh *Webhooks) deliver(ctx context.Context, d *webhookDelivery) error {
+	d.attempts++
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.hook.URL, bytes.NewReader(d.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, d.event)
+	req.Header.Set(signatureHeader, "sha256="+sign(d.hook.Secret, d.body))
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %v", resp.StatusCode)
+	}
+	return nil
+}
+
+func (wh *Webhooks) deadLetter(d *webhookDelivery, err error) {
+	b, _ := json.Marshal(&deadLetter{
+		URL:      d.hook.URL,
+		Event:    d.event,
+		Attempts: d.attempts,
+		Error:    err.Error(),
+		Payload:  d.body,
+	})
+
+	if wh.opts.DeadLetters == nil {
+		log.Warnf("Webhooks: giving up on delivery: %s", b)
+		return
+	}
+
+	wh.deadLetterMutex.Lock()
+	defer wh.deadLetterMutex.Unlock()
+	if _, err := wh.opts.DeadLetters.Write(append(b, '\n')); err != nil {
+		log.Errorf("Webhooks: couldn't write dead letter: %v", err)
+	}
+}
+
+// registrations returns the registrations of a counter stored in the repository
+func (wh *Webhooks) registrations(key string) ([]registration, error) {
+	var regs []registration
+	err := wh.repo.Scan(webhookRecordKey(key, ""), func(recordKey string, v store.Value) error {
+		_, hook, err := parseWebhookRecord(recordKey, &v)
+		if err != nil {
+			return err
+		}
+		regs = append(regs, registration{key: recordKey, hook: hook})
+		return nil
+	})
+	return regs, err
+}
+
+// register stores a webhook of a counter with a new id, it fails with errTooManyWebhooks if the counter has too
+// many webhooks
+func (wh *Webhooks) register(key string, hook *webhook) error {
+	regs, err := wh.registrations(key)
+	if err != nil {
+		return err
+	} else if len(regs) >= maxWebhooksPerCounter {
+		return errTooManyWebhooks
+	}
+
+	id := uuid.New()
+	hook.ID = ""
+	b, err := json.Marshal(&webhookRecord{Key: key, webhook: *hook})
+	if err != nil {
+		return err
+	}
+	recordKey := webhookRecordKey(key, id.String())
+	if err := wh.repo.Create(recordKey, store.Value{AccessKey: id, Data: string(b)}); err != nil {
+		return err
+	}
+
+	hook.ID = id.String()
+	wh.add(key, registration{key: recordKey, hook: *hook})
+	return nil
+}
+
+// list returns the webhooks of a counter without their secrets
+func (wh *Webhooks) list(key string) ([]webhook, error) {
+	regs, err := wh.registrations(key)
+	if err != nil {
+		return nil, err
+	}
+
+	hooks := make([]webhook, len(regs))
+	for i, reg := range regs {
+		hooks[i] = reg.hook
+		hooks[i].Secret = ""
+	}
+	return hooks, nil
+}
+
+// unregister removes a webhook from a counter, it returns false if the webhook doesn't exist
+func (wh *Webhooks) unregister(key, id string) (bool, error) {
+	regs, err := wh.registrations(key)
+	if err != nil {
+		return false, err
+	}
+
+	for _, reg := range regs {
+		if reg.hook.ID == id {
+			if err := wh.repo.Delete(reg.key); err != nil {
+				return false, err
+			}
+			wh.remove(key, reg.key)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// webhookCounter returns the key of the counter whose webhooks are managed by the request,
+// after checking the counter exists and the request has its access key
+func (rs *Routes) webhookCounter(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if rs.webhooks == nil {
+		http.Error(w, "Webhooks are disabled", http.StatusNotImplemented)
+		return "", false
+	}
+
+	key, err := normalizeKey(strings.TrimPrefix(r.URL.Path, webhookPrefix))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid key: %v", err), http.StatusBadRequest)
+		return "", false
+	}
+
+	if !rs.authenticate(w, r, key) {
+		return "", false
+	}
+
+	return key, true
+}
+
+// validate checks a webhook registration and fills in the defaults
+func (h *webhook) validate() error {
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url has to be an absolute http or https url")
+	} else if len(h.URL) > maxWebhookURLLength {
+		return fmt.Errorf("url can't be longer than %v characters", maxWebhookURLLength)
+	} else if len(h.Secret) > maxWebhookSecretLength {
+		return fmt.Errorf("secret can't be longer than %v characters", maxWebhookSecretLength)
+	}
+
+	if len(h.Events) == 0 {
+		h.Events = []string{webhookChange}
+	}
+	for _, e := range h.Events {
+		switch e {
+		case webhookChange, webhookDelete:
+		case webhookThreshold:
+			if h.Threshold == nil {
+				return fmt.Errorf("threshold events require a threshold")
+			}
+		default:
+			return fmt.Errorf("unknown event %q", e)
+		}
+	}
+
+	return nil
+}
+
+// RegisterWebhook adds a webhook to a counter, a signing secret is generated if none is given
+func (rs *Routes) RegisterWebhook(w http.ResponseWriter, r *http.Request) {
+	key, ok := rs.webhookCounter(w, r)
+	if !ok {
+		return
+	}
+	log.Tracef("RegisterWebhook on %v", key)
+
+	var hook webhook
+	if err := json.NewDecoder(r.Body).Decode(&hook); err != nil {
+		http.Error(w, "Could not decode json", http.StatusBadRequest)
+		return
+	} else if err := hook.validate(); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid webhook: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if hook.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			http.Error(w, "Couldn't generate secret", http.StatusInternalServerError)
+			return
+		}
+		hook.Secret = hex.EncodeToString(secret)
+	}
+
+	if err := rs.webhooks.register(key, &hook); err == errTooManyWebhooks {
+		http.Error(w, fmt.Sprintf("Counter already has %v webhooks", maxWebhooksPerCounter), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Couldn't store webhook in database", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(&hook)
+}
+
+// ListWebhooks lists the webhooks of a counter, without their secrets
+func (rs *Routes) ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	key, ok := rs.webhookCounter(w, r)
+	if !ok {
+		return
+	}
+	log.Tracef("ListWebhooks on %v", key)
+
+	hooks, err := rs.webhooks.list(key)
+	if err != nil {
+		http.Error(w, "Couldn't get webhooks from database", http.StatusInternalServerError)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(hooks)
+}
+
+// DeleteWebhook removes the webhook with the id given in the query string from a counter
+func (rs *Routes) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	key, ok := rs.webhookCounter(w, r)
+	if !ok {
+		return
+	}
+	log.Tracef("DeleteWebhook on %v", key)
+
+	found, err := rs.webhooks.unregister(key, r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Couldn't delete webhook from database", http.StatusInternalServerError)
+		return
+	} else if !found {
+		http.Error(w, "Webhook doesn't exist", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
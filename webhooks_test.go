@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"counter/store"
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type receivedWebhook struct {
+	event     string
+	signature string
+	body      []byte
+}
+
+// webhookReceiver starts a server that answers deliveries with the status returned by status
+func webhookReceiver(status func(attempt int) int) (*httptest.Server, <-chan receivedWebhook) {
+	received := make(chan receivedWebhook, 16)
+	var attempts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		code := status(int(atomic.AddInt32(&attempts, 1)))
+		if code == http.StatusOK {
+			received <- receivedWebhook{
+				event:     r.Header.Get(webhookEventHeader),
+				signature: r.Header.Get(signatureHeader),
+				body:      body,
+			}
+		}
+		w.WriteHeader(code)
+	}))
+	return srv, received
+}
+
+func nextWebhook(t *testing.T, received <-chan receivedWebhook) (receivedWebhook, webhookPayload) {
+	select {
+	case rec := <-received:
+		var payload webhookPayload
+		assert.NoError(t, json.Unmarshal(rec.body, &payload))
+		return rec, payload
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a webhook")
+		return receivedWebhook{}, webhookPayload{}
+	}
+}
+
+// chanWriter sends every write to a channel
+type chanWriter chan string
+
+func (c chanWriter) Write(b []byte) (int, error) {
+	c <- string(b)
+	return len(b), nil
+}
+
+// startWebhooks runs the webhooks of the store, the watch is established and the registrations are loaded before
+// returning. Deliveries to the local test servers are allowed.
+func startWebhooks(t *testing.T, s store.Repository, opts WebhookOptions) (*Webhooks, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	opts.AllowPrivate = true
+	wh := NewWebhooks(s, opts)
+	wh.startWorkers(ctx)
+
+	events, err := s.Watch(ctx, "/")
+	assert.NoError(t, err)
+	assert.NoError(t, wh.load())
+	go wh.dispatchAll(events)
+
+	return wh, func() {
+		cancel()
+		wh.workers.Wait()
+	}
+}
+
+func registerWebhook(t *testing.T, rs *Routes, key string, accessKey uuid.UUID, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/_webhooks"+key, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+accessKey.String())
+	rs.RegisterWebhook(w, r)
+	return w
+}
+
+func TestCrossed(t *testing.T) {
+	assert.True(t, crossed(9, 10, 10))
+	assert.True(t, crossed(5, 15, 10))
+	assert.True(t, crossed(10, 9, 10))
+	assert.False(t, crossed(10, 11, 10))
+	assert.False(t, crossed(8, 9, 10))
+}
+
+func TestWebhooks_Delivery(t *testing.T) {
+	s := store.NewMemoryStore()
+	accessKey := uuid.New()
+	assert.NoError(t, s.Create("/yeet", store.Value{Count: 1, AccessKey: accessKey}))
+
+	srv, received := webhookReceiver(func(int) int { return http.StatusOK })
+	defer srv.Close()
+
+	wh, stop := startWebhooks(t, s, WebhookOptions{MaxAttempts: 1, Backoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	defer stop()
+	rs := NewRoutesWithOptions(s, RoutesOptions{Webhooks: wh})
+
+	w := registerWebhook(t, &rs, "/yeet", accessKey, `{"url": "`+srv.URL+`", "events": ["threshold", "delete"], "threshold": 3, "secret": "hunter2"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var hook webhook
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&hook))
+	assert.NotEmpty(t, hook.ID)
+
+	// Only crossing the threshold triggers the webhook
+	assert.NoError(t, s.Increment("/yeet"))
+	assert.NoError(t, s.Increment("/yeet"))
+	rec, payload := nextWebhook(t, received)
+	assert.Equal(t, webhookThreshold, rec.event)
+	assert.Equal(t, "sha256="+sign("hunter2", rec.body), rec.signature)
+	assert.Equal(t, hook.ID, payload.Webhook)
+	assert.Equal(t, "/yeet", payload.Key)
+	assert.Equal(t, 2, *payload.Old)
+	assert.Equal(t, 3, *payload.Count)
+	assert.Equal(t, 3, *payload.Threshold)
+
+	assert.NoError(t, s.Delete("/yeet"))
+	rec, payload = nextWebhook(t, received)
+	assert.Equal(t, webhookDelete, rec.event)
+	assert.Nil(t, payload.Count)
+
+	// The webhooks are removed together with the counter
+	assert.Eventually(t, func() bool {
+		hooks, err := wh.list("/yeet")
+		return err == nil && len(hooks) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestWebhooks_Retries(t *testing.T) {
+	s := store.NewMemoryStore()
+	accessKey := uuid.New()
+	assert.NoError(t, s.Create("/yeet", store.Value{Count: 1, AccessKey: accessKey}))
+
+	srv, received := webhookReceiver(func(attempt int) int {
+		if attempt < 3 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	})
+	defer srv.Close()
+
+	wh, stop := startWebhooks(t, s, WebhookOptions{MaxAttempts: 3, Backoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond})
+	defer stop()
+	assert.NoError(t, wh.register("/yeet", &webhook{URL: srv.URL, Events: []string{webhookChange}}))
+
+	assert.NoError(t, s.Increment("/yeet"))
+	rec, payload := nextWebhook(t, received)
+	assert.Equal(t, webhookChange, rec.event)
+	assert.Equal(t, 2, *payload.Count)
+}
+
+func TestWebhooks_DeadLetters(t *testing.T) {
+	s := store.NewMemoryStore()
+	accessKey := uuid.New()
+	assert.NoError(t, s.Create("/yeet", store.Value{Count: 1, AccessKey: accessKey}))
+
+	srv, _ := webhookReceiver(func(int) int { return http.StatusInternalServerError })
+	defer srv.Close()
+
+	deadLetters := make(chanWriter, 1)
+	wh, stop := startWebhooks(t, s, WebhookOptions{
+		MaxAttempts: 2,
+		Backoff:     time.Millisecond,
+		MaxBackoff:  time.Millisecond,
+		DeadLetters: deadLetters,
+	})
+	defer stop()
+	assert.NoError(t, wh.register("/yeet", &webhook{URL: srv.URL, Events: []string{webhookChange}}))
+
+	assert.NoError(t, s.Increment("/yeet"))
+	select {
+	case line := <-deadLetters:
+		var dl deadLetter
+		assert.NoError(t, json.Unmarshal([]byte(line), &dl))
+		assert.Equal(t, srv.URL, dl.URL)
+		assert.Equal(t, 2, dl.Attempts)
+		assert.Equal(t, "unexpected status 500", dl.Error)
+		assert.Contains(t, string(dl.Payload), `"count":2`)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a dead letter")
+	}
+}
+
+func TestWebhooks_Persisted(t *testing.T) {
+	s := store.NewMemoryStore()
+	accessKey := uuid.New()
+	assert.NoError(t, s.Create("/yeet", store.Value{Count: 1, AccessKey: accessKey}))
+	assert.NoError(t, s.Create("/yeet/child", store.Value{Count: 1, AccessKey: accessKey}))
+
+	srv, received := webhookReceiver(func(int) int { return http.StatusOK })
+	defer srv.Close()
+
+	// Registered through one instance
+	registered := NewWebhooks(s, WebhookOptions{})
+	hook := webhook{URL: srv.URL, Events: []string{webhookChange}, Secret: "hunter2"}
+	assert.NoError(t, registered.register("/yeet", &hook))
+	assert.NoError(t, registered.register("/yeet/child", &webhook{URL: srv.URL, Events: []string{webhookDelete}}))
+
+	// And delivered by another one
+	wh, stop := startWebhooks(t, s, WebhookOptions{MaxAttempts: 1, Backoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	defer stop()
+	hooks, err := wh.list("/yeet")
+	assert.NoError(t, err)
+	assert.Equal(t, []webhook{{ID: hook.ID, URL: srv.URL, Events: []string{webhookChange}}}, hooks)
+
+	assert.NoError(t, s.Increment("/yeet"))
+	rec, payload := nextWebhook(t, received)
+	assert.Equal(t, "sha256="+sign("hunter2", rec.body), rec.signature)
+	assert.Equal(t, hook.ID, payload.Webhook)
+
+	// Registrations made after loading are followed as well
+	other := webhook{URL: srv.URL, Events: []string{webhookChange}}
+	assert.NoError(t, registered.register("/yeet", &other))
+	found, err := registered.unregister("/yeet", hook.ID)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Eventually(t, func() bool {
+		wh.mutex.RLock()
+		defer wh.mutex.RUnlock()
+		return len(wh.hooks["/yeet"]) == 1 && wh.hooks["/yeet"][0].hook.ID == other.ID
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, s.Increment("/yeet"))
+	_, payload = nextWebhook(t, received)
+	assert.Equal(t, other.ID, payload.Webhook)
+}
+
+func TestWebhooks_Replicas(t *testing.T) {
+	s := store.NewMemoryStore()
+	accessKey := uuid.New()
+	assert.NoError(t, s.Create("/yeet", store.Value{Count: 1, AccessKey: accessKey}))
+
+	srv, received := webhookReceiver(func(int) int { return http.StatusOK })
+	defer srv.Close()
+
+	// Both replicas see every event
+	opts := WebhookOptions{MaxAttempts: 1, Backoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	wh, stop := startWebhooks(t, s, opts)
+	defer stop()
+	_, stopOther := startWebhooks(t, s, opts)
+	defer stopOther()
+	assert.NoError(t, wh.register("/yeet", &webhook{URL: srv.URL, Events: []string{webhookChange, webhookDelete}}))
+
+	// But only one of them delivers it
+	assert.NoError(t, s.Increment("/yeet"))
+	assert.NoError(t, s.Increment("/yeet"))
+	counts := make(map[int]int)
+	for i := 0; i < 2; i++ {
+		_, payload := nextWebhook(t, received)
+		counts[*payload.Count]++
+	}
+	assert.Equal(t, map[int]int{2: 1, 3: 1}, counts)
+
+	assert.NoError(t, s.Delete("/yeet"))
+	rec, _ := nextWebhook(t, received)
+	assert.Equal(t, webhookDelete, rec.event)
+
+	select {
+	case rec := <-received:
+		t.Fatalf("Delivered twice: %s", rec.body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhookRecord(t *testing.T) {
+	s := store.NewMemoryStore()
+	wh := NewWebhooks(s, WebhookOptions{})
+	threshold := 10
+	hook := webhook{URL: "https://example.com/hook?a=b", Events: []string{webhookThreshold}, Threshold: &threshold,
+		Secret: "hunter2"}
+	assert.NoError(t, wh.register("/a/b", &hook))
+
+	// The key of the record only contains a hash of the counter key and the id
+	recordKey := webhookRecordKey("/a/b", hook.ID)
+	assert.Len(t, recordKey, len(webhookRecordPrefix)+1+64+1+36)
+	assert.NotContains(t, recordKey, "hunter2")
+	v, err := s.Get(recordKey)
+	assert.NoError(t, err)
+	assert.Equal(t, hook.ID, v.AccessKey.String())
+
+	key, parsed, err := parseWebhookRecord(recordKey, &v)
+	assert.NoError(t, err)
+	assert.Equal(t, "/a/b", key)
+	assert.Equal(t, hook, parsed)
+
+	// Records have to match their key
+	_, _, err = parseWebhookRecord(webhookRecordKey("/a", hook.ID), &v)
+	assert.Error(t, err)
+	_, _, err = parseWebhookRecord(recordKey, &store.Value{AccessKey: v.AccessKey, Data: "not json"})
+	assert.Error(t, err)
+}
+
+func TestWebhooks_Diskv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "counter-webhooks")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Registrations of long keys with long URLs fit into a file name
+	s := store.NewDiskvStore(dir)
+	wh := NewWebhooks(s, WebhookOptions{})
+	key := "/" + strings.Repeat("a", maxKeyLength-1)
+	hook := webhook{URL: "https://example.com/" + strings.Repeat("b", 1000), Events: []string{webhookChange},
+		Secret: strings.Repeat("c", 64)}
+	assert.NoError(t, wh.register(key, &hook))
+
+	hooks, err := wh.list(key)
+	assert.NoError(t, err)
+	hook.Secret = ""
+	assert.Equal(t, []webhook{hook}, hooks)
+}
+
+func TestWebhooks_PrivateAddresses(t *testing.T) {
+	for _, address := range []string{"127.0.0.1:80", "[::1]:80", "10.1.2.3:80", "192.168.0.1:443", "172.16.0.1:80",
+		"169.254.169.254:80", "[fe80::1]:80", "[fd00::1]:80", "0.0.0.0:80"} {
+		assert.True(t, errors.Is(publicOnly("tcp", address, nil), errWebhookAddress), address)
+	}
+	assert.NoError(t, publicOnly("tcp", "93.184.216.34:443", nil))
+	assert.NoError(t, publicOnly("tcp", "[2606:2800:220:1:248:1893:25c8:1946]:443", nil))
+
+	// Deliveries to the local test server are refused by default
+	s := store.NewMemoryStore()
+	assert.NoError(t, s.Create("/yeet", store.Value{Count: 1, AccessKey: uuid.New()}))
+	srv, received := webhookReceiver(func(int) int { return http.StatusOK })
+	defer srv.Close()
+
+	deadLetters := make(chanWriter, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wh := NewWebhooks(s, WebhookOptions{MaxAttempts: 1, DeadLetters: deadLetters})
+	wh.startWorkers(ctx)
+	assert.NoError(t, wh.register("/yeet", &webhook{URL: srv.URL, Events: []string{webhookChange}}))
+
+	wh.dispatch(&store.Event{Key: "/yeet", Op: store.EventIncrement, Old: store.Value{Count: 1}, Value: store.Value{Count: 2}})
+	select {
+	case line := <-deadLetters:
+		assert.Contains(t, line, errWebhookAddress.Error())
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a dead letter")
+	}
+	assert.Empty(t, received)
+}
+
+func TestWebhooks_Close(t *testing.T) {
+	s := store.NewMemoryStore()
+	assert.NoError(t, s.Create("/yeet", store.Value{Count: 1, AccessKey: uuid.New()}))
+
+	srv, _ := webhookReceiver(func(int) int { return http.StatusServiceUnavailable })
+	defer srv.Close()
+
+	deadLetters := make(chanWriter, 2)
+	wh, stop := startWebhooks(t, s, WebhookOptions{
+		MaxAttempts: 10,
+		Backoff:     time.Hour,
+		MaxBackoff:  time.Hour,
+		DeadLetters: deadLetters,
+	})
+	assert.NoError(t, wh.register("/yeet", &webhook{URL: srv.URL, Events: []string{webhookChange}}))
+
+	// One delivery waits for its retry, the other one is still queued when stopping
+	assert.NoError(t, s.Increment("/yeet"))
+	assert.Eventually(t, func() bool {
+		wh.deliveryMutex.Lock()
+		defer wh.deliveryMutex.Unlock()
+		return len(wh.retries) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	stop()
+	wh.submit(&webhookDelivery{hook: webhook{URL: srv.URL}, event: webhookChange, body: []byte(`{}`)})
+	assert.Empty(t, deadLetters)
+
+	assert.NoError(t, wh.Close())
+	for i := 0; i < 2; i++ {
+		var dl deadLetter
+		assert.NoError(t, json.Unmarshal([]byte(<-deadLetters), &dl))
+		assert.Equal(t, errWebhooksClosed.Error(), dl.Error)
+	}
+
+	// Deliveries after closing go to the dead letter log right away
+	wh.submit(&webhookDelivery{hook: webhook{URL: srv.URL}, event: webhookChange, body: []byte(`{}`)})
+	assert.Len(t, deadLetters, 1)
+}
+
+func TestRoutes_Webhooks(t *testing.T) {
+	s := store.NewMemoryStore()
+	accessKey := uuid.New()
+	assert.NoError(t, s.Create("/yeet", store.Value{Count: 1, AccessKey: accessKey}))
+	rs := NewRoutesWithOptions(s, RoutesOptions{Webhooks: NewWebhooks(s, WebhookOptions{})})
+
+	assert.Equal(t, http.StatusUnauthorized, registerWebhook(t, &rs, "/yeet", uuid.New(), `{"url": "http://localhost"}`).Code)
+	assert.Equal(t, http.StatusNotFound, registerWebhook(t, &rs, "/other", accessKey, `{"url": "http://localhost"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, registerWebhook(t, &rs, "/yeet", accessKey, `{"url": "localhost"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, registerWebhook(t, &rs, "/yeet", accessKey, `{"url": "http://localhost", "events": ["threshold"]}`).Code)
+	assert.Equal(t, http.StatusBadRequest, registerWebhook(t, &rs, "/yeet", accessKey, `{"url": "http://localhost", "events": ["yeet"]}`).Code)
+	assert.Equal(t, http.StatusBadRequest, registerWebhook(t, &rs, "/yeet", accessKey, `{"url": "http://localhost/`+strings.Repeat("a", maxWebhookURLLength)+`"}`).Code)
+
+	// A secret is generated if none is given
+	w := registerWebhook(t, &rs, "/yeet", accessKey, `{"url": "http://localhost"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var hook webhook
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&hook))
+	assert.Len(t, hook.Secret, 64)
+	assert.Equal(t, []string{webhookChange}, hook.Events)
+
+	// Secrets aren't listed
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/_webhooks/yeet", nil)
+	r.Header.Set("Authorization", "Bearer "+accessKey.String())
+	rs.ListWebhooks(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var hooks []webhook
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&hooks))
+	assert.Len(t, hooks, 1)
+	assert.Equal(t, hook.ID, hooks[0].ID)
+	assert.Empty(t, hooks[0].Secret)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodDelete, "/_webhooks/yeet?id="+hook.ID, nil)
+	r.Header.Set("Authorization", "Bearer "+accessKey.String())
+	rs.DeleteWebhook(w, r)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = httptest.NewRecorder()
+	rs.DeleteWebhook(w, r)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestRoutes_WebhooksDisabled(t *testing.T) {
+	rs := NewRoutes(store.NewMemoryStore())
+
+	w := registerWebhook(t, &rs, "/yeet", uuid.New(), `{"url": "http://localhost"}`)
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"counter/store"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// wsMaxMessageSize is the maximum size of a message sent by a client
+	wsMaxMessageSize = 4096
+	// wsMaxSubscriptions is the maximum amount of counters a single connection can subscribe to
+	wsMaxSubscriptions = 100
+	// wsMaxOpsPerSecond is the maximum amount of messages a single connection can send per second
+	wsMaxOpsPerSecond = 50
+	// wsSendBuffer is the amount of outgoing messages buffered per connection, if a client doesn't
+	// read fast enough to keep this buffer from filling up it is disconnected
+	wsSendBuffer = 64
+	// wsWriteWait is the time allowed to write a message
+	wsWriteWait = 10 * time.Second
+	// wsPongWait is the time allowed to read the next pong message
+	wsPongWait = 60 * time.Second
+	// wsPingInterval is how often pings are sent, it has to be less than wsPongWait
+	wsPingInterval = wsPongWait * 9 / 10
+)
+
+// wsRequest is a message sent by a client
+type wsRequest struct {
+	// ID is echoed in the response, so clients can match responses to requests
+	ID    int    `json:"id"`
+	Type  string `json:"type"`
+	Key   string `json:"key"`
+	Op    string `json:"op"`
+	Value *int   `json:"value"`
+	Token string `json:"token"`
+}
+
+// wsResponse is a message sent by the server, either in response to a request or as an update of a counter
+type wsResponse struct {
+	ID     int    `json:"id,omitempty"`
+	Type   string `json:"type"`
+	Key    string `json:"key,omitempty"`
+	Count  *int   `json:"count,omitempty"`
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type wsConn struct {
+	rs   *Routes
+	conn *websocket.Conn
+	send chan wsResponse
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+	// closeCode is sent to the client when the connection is closed by the server
+	closeCode int
+
+	// The rate limit is only used by the read loop
+	window    time.Time
+	windowOps int
+}
+
+// errTooManySubscriptions is returned when a connection subscribes to more than wsMaxSubscriptions counters
+var errTooManySubscriptions = errors.New("too many subscriptions")
+
+// wsHub shares a single watch of all counters between the websockets of the server, the changes of subscribed
+// counters are fanned out to the connections. The watch is started with the first subscription and stopped once
+// there are none left.
+type wsHub struct {
+	repo store.Repository
+
+	// mutex guards the subscriptions and the watch
+	mutex       sync.Mutex
+	subscribers map[string]map[*wsConn]bool
+	conns       map[*wsConn]map[string]bool
+	// cancel stops the watch, it is nil while not watching
+	cancel context.CancelFunc
+}
+
+func newWsHub(repo store.Repository) *wsHub {
+	return &wsHub{
+		repo:        repo,
+		subscribers: make(map[string]map[*wsConn]bool),
+		conns:       make(map[*wsConn]map[string]bool),
+	}
+}
+
+// subscribe subscribes a connection to the changes of a counter, starting the watch if necessary.
+// It returns false if the connection was subscribed already.
+func (h *wsHub) subscribe(c *wsConn, key string) (bool, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.subscribers[key][c] {
+		return false, nil
+	} else if len(h.conns[c]) >= wsMaxSubscriptions {
+		return false, errTooManySubscriptions
+	}
+
+	if h.cancel == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		events, err := h.repo.Watch(ctx, "/")
+		if err != nil {
+			cancel()
+			return false, err
+		}
+		h.cancel = cancel
+		go h.fanOut(ctx, events)
+	}
+
+	if h.subscribers[key] == nil {
+		h.subscribers[key] = make(map[*wsConn]bool)
+	}
+	if h.conns[c] == nil {
+		h.conns[c] = make(map[string]bool)
+	}
+	h.subscribers[key][c] = true
+	h.conns[c][key] = true
+	return true, nil
+}
+
+// unsubscribe removes the subscription of a connection to a counter, the watch is stopped with the last one.
+// h.mutex has to be held.
+func (h *wsHub) unsubscribe(c *wsConn, key string) {
+	delete(h.subscribers[key], c)
+	if len(h.subscribers[key]) == 0 {
+		delete(h.subscribers, key)
+	}
+	delete(h.conns[c], key)
+	if len(h.conns[c]) == 0 {
+		delete(h.conns, c)
+	}
+
+	if len(h.conns) == 0 && h.cancel != nil {
+		h.cancel()
+		h.cancel = nil
+	}
+}
+
+// remove removes the subscription of a connection to a counter
+func (h *wsHub) remove(c *wsConn, key string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.unsubscribe(c, key)
+}
+
+// leave removes all subscriptions of a connection
+func (h *wsHub) leave(c *wsConn) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for key := range h.conns[c] {
+		h.unsubscribe(c, key)
+	}
+}
+
+// fanOut sends the changes of subscribed counters to their connections. If the watch fails, all connections are
+// closed and have to reconnect, as they may have missed changes.
+func (h *wsHub) fanOut(ctx context.Context, events <-chan store.Event) {
+	for e := range events {
+		h.mutex.Lock()
+		for c := range h.subscribers[e.Key] {
+			c.enqueue(wsUpdate(e.Key, &e.Value))
+		}
+		h.mutex.Unlock()
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	// Unless the watch was stopped on purpose it failed
+	if ctx.Err() != nil {
+		return
+	}
+	for c := range h.conns {
+		c.close(websocket.CloseTryAgainLater)
+	}
+	h.subscribers = make(map[string]map[*wsConn]bool)
+	h.conns = make(map[*wsConn]map[string]bool)
+	h.cancel()
+	h.cancel = nil
+}
+
+// originAllowed checks the origin of websocket requests against the same origins as CORS,
+// requests from the same host are always allowed
+func (rs *Routes) originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	} else if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	for _, allowed := range rs.allowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// WebSocket upgrades the connection to a websocket, over which clients can subscribe to counters and modify them
+func (rs *Routes) WebSocket(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{CheckOrigin: rs.originAllowed}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader already responded
+		return
+	}
+	log.Tracef("WebSocket from %v", r.RemoteAddr)
+
+	// The connection ends together with the request context, which is cancelled when the server shuts down
+	ctx, cancel := context.WithCancel(r.Context())
+	c := &wsConn{
+		rs:        rs,
+		conn:      conn,
+		send:      make(chan wsResponse, wsSendBuffer),
+		ctx:       ctx,
+		cancel:    cancel,
+		closeCode: websocket.CloseNormalClosure,
+	}
+
+	go c.writeLoop()
+	c.readLoop()
+	rs.hub.leave(c)
+}
+
+// close closes the connection with the given code, only the first call has an effect
+func (c *wsConn) close(code int) {
+	c.closeOnce.Do(func() {
+		c.closeCode = code
+		c.cancel()
+	})
+}
+
+// enqueue queues a message for sending, if the client can't keep up the connection is closed
+func (c *wsConn) enqueue(msg wsResponse) {
+	select {
+	case c.send <- msg:
+	case <-c.ctx.Done():
+	default:
+		c.close(websocket.CloseTryAgainLater)
+	}
+}
+
+func (c *wsConn) writeLoop() {
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	defer c.conn.Close()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			// If the connection wasn't closed on purpose the server is going away
+			c.close(websocket.CloseGoingAway)
+			msg := websocket.FormatCloseMessage(c.closeCode, "")
+			_ = c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteWait))
+			return
+		case msg := <-c.send:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteJSON(msg); err != nil {
+				c.close(websocket.CloseAbnormalClosure)
+				return
+			}
+		case <-ping.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				c.close(websocket.CloseAbnormalClosure)
+				return
+			}
+		}
+	}
+}
+
+func (c *wsConn) readLoop() {
+	defer c.close(websocket.CloseNormalClosure)
+
+	c.conn.SetReadLimit(wsMaxMessageSize)
+	_ = c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		var req wsRequest
+		if err := c.conn.ReadJSON(&req); err != nil {
+			if _, ok := err.(*websocket.CloseError); !ok && !strings.Contains(err.Error(), "use of closed") {
+				log.Debugf("WebSocket: reading failed: %v", err)
+			}
+			return
+		}
+
+		if !c.allow() {
+			c.enqueue(wsResponse{ID: req.ID, Type: "error", Status: http.StatusTooManyRequests, Error: "Too many requests"})
+			continue
+		}
+
+		c.handle(&req)
+	}
+}
+
+// allow enforces the rate limit of the connection
+func (c *wsConn) allow() bool {
+	if now := time.Now(); now.Sub(c.window) >= time.Second {
+		c.window, c.windowOps = now, 0
+	}
+	c.windowOps++
+	return c.windowOps <= wsMaxOpsPerSecond
+}
+
+func (c *wsConn) fail(req *wsRequest, status int, msg string) {
+	c.enqueue(wsResponse{ID: req.ID, Type: "error", Key: req.Key, Status: status, Error: msg})
+}
+
+func (c *wsConn) handle(req *wsRequest) {
+	key, err := normalizeKey(req.Key)
+	if err != nil {
+		c.fail(req, http.StatusBadRequest, fmt.Sprintf("Invalid key: %v", err))
+		return
+	}
+
+	switch req.Type {
+	case "subscribe":
+		c.subscribe(req, key)
+	case "unsubscribe":
+		c.rs.hub.remove(c, key)
+		c.enqueue(wsResponse{ID: req.ID, Type: "ok", Key: key})
+	case "patch":
+		c.patch(req, key)
+	default:
+		c.fail(req, http.StatusBadRequest, fmt.Sprintf("Invalid type: %v", req.Type))
+	}
+}
+
+// subscribe records the subscription before reading the current value, so no change is missed. Updates seen in
+// between may be sent before the response.
+func (c *wsConn) subscribe(req *wsRequest, key string) {
+	added, err := c.rs.hub.subscribe(c, key)
+	if err == errTooManySubscriptions {
+		c.fail(req, http.StatusTooManyRequests, fmt.Sprintf("Can't subscribe to more than %v counters", wsMaxSubscriptions))
+		return
+	} else if err != nil {
+		c.fail(req, http.StatusInternalServerError, "Couldn't watch database")
+		return
+	} else if !added {
+		c.enqueue(wsResponse{ID: req.ID, Type: "ok", Key: key})
+		return
+	}
+
+	v, err := c.rs.repo.Get(key)
+	if err != nil {
+		c.rs.hub.remove(c, key)
+		c.fail(req, http.StatusInternalServerError, "Couldn't get value from database")
+		return
+	}
+	c.enqueue(wsResponse{ID: req.ID, Type: "ok", Key: key})
+	c.enqueue(wsUpdate(key, &v))
+}
+
+// wsUpdate creates the update message for a counter, deleted counters have no count
+func wsUpdate(key string, v *store.Value) wsResponse {
+	msg := wsResponse{Type: "update", Key: key}
+	if v.AccessKey != uuid.Nil {
+		count := v.Count
+		msg.Count = &count
+	}
+	return msg
+}
+
+func (c *wsConn) patch(req *wsRequest, key string) {
+	op, status, msg := parseBatchItem(&batchItem{Key: key, Op: req.Op, Value: req.Value, Token: req.Token})
+	if status != http.StatusOK {
+		c.fail(req, status, msg)
+		return
+	}
+
+	v, err := c.rs.repo.Apply(op)
+	switch err {
+	case nil:
+	case store.ErrNotFound, store.ErrWrongAccessKey:
+		c.fail(req, batchErrorStatus(err), err.Error())
+		return
+	default:
+		c.fail(req, http.StatusInternalServerError, fmt.Sprintf("Couldn't %v value in database", req.Op))
+		return
+	}
+
+	c.enqueue(wsResponse{ID: req.ID, Type: "result", Key: key, Count: &v.Count})
+}
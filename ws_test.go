@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"counter/store"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func dialWebSocket(t *testing.T, rs *Routes) (*websocket.Conn, func()) {
+	srv := httptest.NewServer(http.HandlerFunc(rs.WebSocket))
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/_ws", nil)
+	assert.NoError(t, err)
+
+	return conn, func() {
+		conn.Close()
+		srv.Close()
+	}
+}
+
+func readResponse(t *testing.T, conn *websocket.Conn) wsResponse {
+	var resp wsResponse
+	assert.NoError(t, conn.ReadJSON(&resp))
+	return resp
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func TestRoutes_WebSocket(t *testing.T) {
+	s := store.NewMemoryStore()
+	accessKey := uuid.New()
+	assert.NoError(t, s.Create("/yeet", store.Value{Count: 1, AccessKey: accessKey}))
+	rs := NewRoutes(s)
+
+	conn, closeConn := dialWebSocket(t, &rs)
+	defer closeConn()
+
+	assert.NoError(t, conn.WriteJSON(wsRequest{ID: 1, Type: "subscribe", Key: "/yeet"}))
+	assert.Equal(t, wsResponse{ID: 1, Type: "ok", Key: "/yeet"}, readResponse(t, conn))
+	assert.Equal(t, wsResponse{Type: "update", Key: "/yeet", Count: intPtr(1)}, readResponse(t, conn))
+
+	// Changes made elsewhere are pushed
+	assert.NoError(t, s.Increment("/yeet"))
+	assert.Equal(t, wsResponse{Type: "update", Key: "/yeet", Count: intPtr(2)}, readResponse(t, conn))
+
+	// Changes made over the websocket are answered and pushed
+	assert.NoError(t, conn.WriteJSON(wsRequest{ID: 2, Type: "patch", Key: "/yeet", Op: "increment", Value: intPtr(3), Token: accessKey.String()}))
+	responses := []wsResponse{readResponse(t, conn), readResponse(t, conn)}
+	assert.Contains(t, responses, wsResponse{ID: 2, Type: "result", Key: "/yeet", Count: intPtr(5)})
+	assert.Contains(t, responses, wsResponse{Type: "update", Key: "/yeet", Count: intPtr(5)})
+
+	assert.NoError(t, conn.WriteJSON(wsRequest{ID: 3, Type: "unsubscribe", Key: "/yeet"}))
+	assert.Equal(t, wsResponse{ID: 3, Type: "ok", Key: "/yeet"}, readResponse(t, conn))
+
+	assert.NoError(t, s.Delete("/yeet"))
+	assert.NoError(t, conn.WriteJSON(wsRequest{ID: 4, Type: "subscribe", Key: "/yeet"}))
+	assert.Equal(t, wsResponse{ID: 4, Type: "ok", Key: "/yeet"}, readResponse(t, conn))
+	assert.Equal(t, wsResponse{Type: "update", Key: "/yeet"}, readResponse(t, conn))
+}
+
+func TestRoutes_WebSocketErrors(t *testing.T) {
+	s := store.NewMemoryStore()
+	assert.NoError(t, s.Create("/yeet", store.Value{Count: 1, AccessKey: uuid.New()}))
+	rs := NewRoutes(s)
+
+	conn, closeConn := dialWebSocket(t, &rs)
+	defer closeConn()
+
+	assert.NoError(t, conn.WriteJSON(wsRequest{ID: 1, Type: "patch", Key: "/yeet", Op: "increment", Token: uuid.New().String()}))
+	resp := readResponse(t, conn)
+	assert.Equal(t, "error", resp.Type)
+	assert.Equal(t, http.StatusUnauthorized, resp.Status)
+
+	assert.NoError(t, conn.WriteJSON(wsRequest{ID: 2, Type: "patch", Key: "/yeet", Op: "increment"}))
+	assert.Equal(t, http.StatusUnauthorized, readResponse(t, conn).Status)
+
+	assert.NoError(t, conn.WriteJSON(wsRequest{ID: 3, Type: "subscribe", Key: "/_reserved"}))
+	assert.Equal(t, http.StatusBadRequest, readResponse(t, conn).Status)
+
+	assert.NoError(t, conn.WriteJSON(wsRequest{ID: 4, Type: "yeet", Key: "/yeet"}))
+	assert.Equal(t, http.StatusBadRequest, readResponse(t, conn).Status)
+}
+
+// watchCountingStore counts the watches started on the wrapped store
+type watchCountingStore struct {
+	store.Repository
+	watches int32
+}
+
+func (s *watchCountingStore) Watch(ctx context.Context, prefix string) (<-chan store.Event, error) {
+	atomic.AddInt32(&s.watches, 1)
+	return s.Repository.Watch(ctx, prefix)
+}
+
+func TestRoutes_WebSocketSubscriptionLimit(t *testing.T) {
+	s := &watchCountingStore{Repository: store.NewMemoryStore()}
+	rs := NewRoutes(s)
+
+	conn, closeConn := dialWebSocket(t, &rs)
+	defer closeConn()
+
+	for i := 0; i < wsMaxSubscriptions; i++ {
+		assert.NoError(t, conn.WriteJSON(wsRequest{ID: i + 1, Type: "subscribe", Key: fmt.Sprintf("/key%v", i)}))
+		assert.Equal(t, "ok", readResponse(t, conn).Type)
+		assert.Equal(t, "update", readResponse(t, conn).Type)
+
+		// Stay below the rate limit
+		if i%wsMaxOpsPerSecond == wsMaxOpsPerSecond-1 {
+			time.Sleep(time.Second)
+		}
+	}
+
+	assert.NoError(t, conn.WriteJSON(wsRequest{ID: 1000, Type: "subscribe", Key: "/onemore"}))
+	resp := readResponse(t, conn)
+	assert.Equal(t, http.StatusTooManyRequests, resp.Status)
+	assert.Contains(t, resp.Error, "subscribe")
+
+	// All subscriptions share a single watch, including the ones of other connections
+	other, closeOther := dialWebSocket(t, &rs)
+	defer closeOther()
+	assert.NoError(t, other.WriteJSON(wsRequest{ID: 1, Type: "subscribe", Key: "/key0"}))
+	assert.Equal(t, "ok", readResponse(t, other).Type)
+	assert.Equal(t, "update", readResponse(t, other).Type)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&s.watches))
+}
+
+func TestRoutes_WebSocketSharedWatch(t *testing.T) {
+	s := store.NewMemoryStore()
+	rs := NewRoutes(s)
+
+	conn, closeConn := dialWebSocket(t, &rs)
+	other, closeOther := dialWebSocket(t, &rs)
+	defer closeOther()
+
+	for _, c := range []*websocket.Conn{conn, other} {
+		assert.NoError(t, c.WriteJSON(wsRequest{ID: 1, Type: "subscribe", Key: "/yeet"}))
+		assert.Equal(t, wsResponse{ID: 1, Type: "ok", Key: "/yeet"}, readResponse(t, c))
+		assert.Equal(t, wsResponse{Type: "update", Key: "/yeet"}, readResponse(t, c))
+	}
+
+	// Changes are sent to every subscribed connection
+	assert.NoError(t, s.Create("/yeet", store.Value{Count: 1, AccessKey: uuid.New()}))
+	for _, c := range []*websocket.Conn{conn, other} {
+		assert.Equal(t, wsResponse{Type: "update", Key: "/yeet", Count: intPtr(1)}, readResponse(t, c))
+	}
+
+	// And to the remaining ones once a connection is gone
+	closeConn()
+	assert.Eventually(t, func() bool {
+		rs.hub.mutex.Lock()
+		defer rs.hub.mutex.Unlock()
+		return len(rs.hub.conns) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.NoError(t, s.Increment("/yeet"))
+	assert.Equal(t, wsResponse{Type: "update", Key: "/yeet", Count: intPtr(2)}, readResponse(t, other))
+
+	// The watch is stopped with the last subscription
+	assert.NoError(t, other.WriteJSON(wsRequest{ID: 2, Type: "unsubscribe", Key: "/yeet"}))
+	assert.Equal(t, wsResponse{ID: 2, Type: "ok", Key: "/yeet"}, readResponse(t, other))
+	rs.hub.mutex.Lock()
+	assert.Nil(t, rs.hub.cancel)
+	rs.hub.mutex.Unlock()
+}
+
+func TestRoutes_WebSocketRateLimit(t *testing.T) {
+	rs := NewRoutes(store.NewMemoryStore())
+
+	conn, closeConn := dialWebSocket(t, &rs)
+	defer closeConn()
+
+	for i := 0; i <= wsMaxOpsPerSecond; i++ {
+		assert.NoError(t, conn.WriteJSON(wsRequest{ID: i + 1, Type: "unsubscribe", Key: "/yeet"}))
+	}
+	for i := 0; i < wsMaxOpsPerSecond; i++ {
+		assert.Equal(t, "ok", readResponse(t, conn).Type)
+	}
+	resp := readResponse(t, conn)
+	assert.Equal(t, wsMaxOpsPerSecond+1, resp.ID)
+	assert.Equal(t, http.StatusTooManyRequests, resp.Status)
+}
+
+func TestRoutes_WebSocketOrigin(t *testing.T) {
+	rs := NewRoutesWithOptions(store.NewMemoryStore(), RoutesOptions{AllowedOrigins: []string{"https://example.com"}})
+
+	r := httptest.NewRequest(http.MethodGet, "http://counter.local/_ws", nil)
+	assert.True(t, rs.originAllowed(r))
+
+	r.Header.Set("Origin", "http://counter.local")
+	assert.True(t, rs.originAllowed(r))
+
+	r.Header.Set("Origin", "https://example.com")
+	assert.True(t, rs.originAllowed(r))
+
+	r.Header.Set("Origin", "https://evil.com")
+	assert.False(t, rs.originAllowed(r))
+}